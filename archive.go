@@ -0,0 +1,487 @@
+package darkstore
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	archiveMagic      = "DSEXPORT"
+	archiveVersion    = 1
+	archiveHeaderLen  = len(archiveMagic) + 1 + 4 + 4 + 1 + saltLength + 12
+	archiveManifest   = "MANIFEST.json"
+	archiveSecretsDir = "secrets/"
+)
+
+// ConflictPolicy decides what happens when a secret being copied into a
+// store already exists there.
+type ConflictPolicy int
+
+const (
+	// ConflictFail refuses to copy anything if any secret exists.
+	ConflictFail ConflictPolicy = iota
+	// ConflictSkip keeps the existing secret.
+	ConflictSkip
+	// ConflictOverwrite replaces the existing secret.
+	ConflictOverwrite
+	// ConflictNewest keeps whichever secret was saved most recently.
+	// Re-encryption by Rotate does not count as saving.
+	ConflictNewest
+)
+
+// ErrConflict is returned with ConflictFail when a secret already
+// exists in the destination store.
+var ErrConflict = errors.New("secret already exists")
+
+// ExportOptions controls which secrets Export writes.
+type ExportOptions struct {
+	// Prefixes limits the export to secrets whose paths start with one
+	// of these prefixes.  All secrets are exported if it is empty.
+	Prefixes []string
+}
+
+// ImportResult lists what Import did with each secret in the archive.
+type ImportResult struct {
+	Imported []string
+	Skipped  []string
+}
+
+// archiveManifestData is the manifest stored as the first entry in the
+// archive's tarball.
+type archiveManifestData struct {
+	Version int                  `json:"version"`
+	Created time.Time            `json:"created"`
+	Secrets []archiveSecretEntry `json:"secrets"`
+}
+
+type archiveSecretEntry struct {
+	Path    string    `json:"path"`
+	Size    int       `json:"size"`
+	SHA256  string    `json:"sha256"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// Export writes the store's secrets to w as a single password-protected
+// archive that can be moved to another machine and loaded into any store
+// with Import.  The secrets are decrypted, put in a tarball along with a
+// manifest, and the tarball is encrypted with AES-256-GCM under a key
+// derived with Argon2id from password, which need not be the store's
+// password.
+func (s *Store) Export(w io.Writer, password []byte, opts ExportOptions) error {
+	if s == nil {
+		return fmt.Errorf("no store")
+	}
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	if err := s.checkApproved("Argon2id archives"); err != nil {
+		return err
+	}
+	if len(password) == 0 {
+		return fmt.Errorf("password must not be empty")
+	}
+
+	files, err := s.listDataFiles()
+	if err != nil {
+		return fmt.Errorf("failed to list data files: %w", err)
+	}
+	sort.Strings(files)
+
+	mf := archiveManifestData{Version: archiveVersion, Created: time.Now().UTC()}
+	var secrets [][]byte
+	defer func() {
+		for _, data := range secrets {
+			Wipe(data)
+		}
+	}()
+	for _, file := range files {
+		rel := s.relPath(file)
+		if !hasAnyPrefix(rel, opts.Prefixes) {
+			continue
+		}
+		modTime, err := s.modTime(file)
+		if err != nil {
+			return fmt.Errorf("error checking %s: %w", rel, err)
+		}
+		data, err := s.Load(rel)
+		if err != nil {
+			return fmt.Errorf("failed to load %s: %w", rel, err)
+		}
+		secrets = append(secrets, data)
+		sum := sha256.Sum256(data)
+		mf.Secrets = append(mf.Secrets, archiveSecretEntry{
+			Path:    rel,
+			Size:    len(data),
+			SHA256:  hex.EncodeToString(sum[:]),
+			ModTime: modTime.UTC(),
+		})
+	}
+
+	mfData, err := json.Marshal(&mf)
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	// The tarball is built in a buffer sized up front, so that it is
+	// never copied while growing and is wiped in full afterwards.
+	size := tarSizeBound(archiveManifest, len(mfData)) + 2*tarBlockSize
+	for i, entry := range mf.Secrets {
+		size += tarSizeBound(archiveSecretsDir+entry.Path, len(secrets[i]))
+	}
+	buf := lockedOrHeap(size)
+	defer buf.Destroy()
+	fw := &fixedWriter{buf: buf.Bytes()}
+	tw := tar.NewWriter(fw)
+	if err := writeTarEntry(tw, archiveManifest, mfData, mf.Created); err != nil {
+		return err
+	}
+	for i, entry := range mf.Secrets {
+		if err := writeTarEntry(tw, archiveSecretsDir+entry.Path, secrets[i], entry.ModTime); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+
+	header, key, err := newArchiveHeader(password)
+	if err != nil {
+		return err
+	}
+	defer Wipe(key)
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	nonce := header[len(header)-gcm.NonceSize():]
+	if _, err := w.Write(header); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	if _, err := w.Write(gcm.Seal(nil, nonce, fw.buf[:fw.n], header)); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	return nil
+}
+
+// Import reads an archive written by Export and saves its secrets into
+// dst, resolving secrets that already exist in dst with policy.  All of
+// the secrets are saved in a single transaction, so either all of them
+// are imported or none are.  ImportDir imports into a store that may
+// not exist yet.
+func Import(r io.Reader, password []byte, dst *Store, policy ConflictPolicy) (*ImportResult, error) {
+	if dst == nil {
+		return nil, fmt.Errorf("no store")
+	}
+	if err := dst.checkApproved("Argon2id archives"); err != nil {
+		return nil, err
+	}
+	mf, secrets, err := readArchive(r, password)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeSecrets(secrets)
+	return dst.importSecrets(mf, secrets, policy)
+}
+
+// ImportDir is like Import, but for the store at dir, which is opened
+// with storePassword or created with it if there is no store there yet.
+// The archive is decrypted first, so a wrong password or corrupt archive
+// does not leave an empty store behind.
+func ImportDir(r io.Reader, password []byte, dir string, storePassword []byte,
+	policy ConflictPolicy, opts ...Option) (*ImportResult, error) {
+	mf, secrets, err := readArchive(r, password)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeSecrets(secrets)
+	dst, err := NewStore(dir, storePassword, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer dst.Close()
+	if err := dst.checkApproved("Argon2id archives"); err != nil {
+		return nil, err
+	}
+	return dst.importSecrets(mf, secrets, policy)
+}
+
+// wipeSecrets wipes the secrets returned by readArchive.
+func wipeSecrets(secrets map[string][]byte) {
+	for _, data := range secrets {
+		Wipe(data)
+	}
+}
+
+// importSecrets saves the secrets of an archive into s in one
+// transaction.
+func (s *Store) importSecrets(mf *archiveManifestData, secrets map[string][]byte, policy ConflictPolicy) (*ImportResult, error) {
+	result := &ImportResult{}
+	err := s.Update(func(tx *Tx) error {
+		for _, entry := range mf.Secrets {
+			write, err := s.resolveConflict(entry.Path, entry.ModTime, policy)
+			if err != nil {
+				return err
+			}
+			if !write {
+				result.Skipped = append(result.Skipped, entry.Path)
+				continue
+			}
+			if err := tx.Save(entry.Path, secrets[entry.Path]); err != nil {
+				return fmt.Errorf("failed to import %s: %w", entry.Path, err)
+			}
+			result.Imported = append(result.Imported, entry.Path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// resolveConflict reports whether a secret modified at modTime should
+// be written to rel in s under policy.
+func (s *Store) resolveConflict(rel string, modTime time.Time, policy ConflictPolicy) (bool, error) {
+	fullPath, err := s.secretPath(rel)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(fullPath)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, fmt.Errorf("error checking %s: %w", rel, err)
+	}
+	switch policy {
+	case ConflictSkip:
+		return false, nil
+	case ConflictOverwrite:
+		return true, nil
+	case ConflictNewest:
+		existing, err := s.modTime(fullPath)
+		if err != nil {
+			return false, fmt.Errorf("error checking %s: %w", rel, err)
+		}
+		return modTime.After(existing), nil
+	}
+	return false, fmt.Errorf("%s: %w", rel, ErrConflict)
+}
+
+// readArchive decrypts an archive and returns its manifest and secrets,
+// keyed by path, after checking every secret against the manifest.
+func readArchive(r io.Reader, password []byte) (*archiveManifestData, map[string][]byte, error) {
+	if len(password) == 0 {
+		return nil, nil, fmt.Errorf("password must not be empty")
+	}
+	header := make([]byte, archiveHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, fmt.Errorf("failed to read archive header: %w", err)
+	}
+	key, err := archiveKey(header, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer Wipe(key)
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	ciphertext, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	nonce := header[len(header)-gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, header)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decrypt archive: wrong password or corrupt archive")
+	}
+	defer Wipe(plaintext)
+
+	var mf archiveManifestData
+	secrets := make(map[string][]byte)
+	ok := false
+	defer func() {
+		if !ok {
+			wipeSecrets(secrets)
+		}
+	}()
+	tr := tar.NewReader(bytes.NewReader(plaintext))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("invalid archive: %w", err)
+		}
+		// Read into a buffer of the final size, which the caller
+		// wipes, rather than one that leaves copies as it grows.
+		if hdr.Size < 0 || hdr.Size > int64(len(plaintext)) {
+			return nil, nil, fmt.Errorf("invalid archive: bad size for %s", hdr.Name)
+		}
+		data := make([]byte, hdr.Size)
+		if _, err := io.ReadFull(tr, data); err != nil {
+			Wipe(data)
+			return nil, nil, fmt.Errorf("invalid archive: %w", err)
+		}
+		switch {
+		case hdr.Name == archiveManifest:
+			err = json.Unmarshal(data, &mf)
+			Wipe(data)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid archive manifest: %w", err)
+			}
+		case strings.HasPrefix(hdr.Name, archiveSecretsDir):
+			name := strings.TrimPrefix(hdr.Name, archiveSecretsDir)
+			Wipe(secrets[name]) // Only in an archive with duplicates.
+			secrets[name] = data
+		default:
+			Wipe(data)
+			return nil, nil, fmt.Errorf("invalid archive: unexpected entry %s", hdr.Name)
+		}
+	}
+
+	if mf.Version != archiveVersion {
+		return nil, nil, fmt.Errorf("unsupported archive version: %d", mf.Version)
+	}
+	if len(mf.Secrets) != len(secrets) {
+		return nil, nil, fmt.Errorf("invalid archive: manifest lists %d secrets, found %d",
+			len(mf.Secrets), len(secrets))
+	}
+	for _, entry := range mf.Secrets {
+		data, ok := secrets[entry.Path]
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid archive: %s missing", entry.Path)
+		}
+		sum := sha256.Sum256(data)
+		if len(data) != entry.Size || hex.EncodeToString(sum[:]) != entry.SHA256 {
+			return nil, nil, fmt.Errorf("invalid archive: %s does not match manifest", entry.Path)
+		}
+	}
+	ok = true
+	return &mf, secrets, nil
+}
+
+// newArchiveHeader generates the header of a new archive: the magic
+// string, format version, Argon2id parameters, salt and nonce.  It
+// returns the header and the key derived from password.
+func newArchiveHeader(password []byte) ([]byte, []byte, error) {
+	header := make([]byte, 0, archiveHeaderLen)
+	header = append(header, archiveMagic...)
+	header = append(header, archiveVersion)
+	header = binary.BigEndian.AppendUint32(header, argon2Time)
+	header = binary.BigEndian.AppendUint32(header, argon2Memory)
+	header = append(header, argon2Threads)
+	random := make([]byte, saltLength+12)
+	if _, err := rand.Read(random); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	header = append(header, random...)
+	key, err := archiveKey(header, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, key, nil
+}
+
+// archiveKey derives the archive key from password using the Argon2id
+// parameters and salt in header.
+func archiveKey(header []byte, password []byte) ([]byte, error) {
+	if !bytes.HasPrefix(header, []byte(archiveMagic)) {
+		return nil, fmt.Errorf("not a darkstore archive")
+	}
+	p := header[len(archiveMagic):]
+	if p[0] != archiveVersion {
+		return nil, fmt.Errorf("unsupported archive version: %d", p[0])
+	}
+	iterations := binary.BigEndian.Uint32(p[1:5])
+	memory := binary.BigEndian.Uint32(p[5:9])
+	threads := p[9]
+	salt := p[10 : 10+saltLength]
+	return deriveKeyWithParams(password, salt, iterations, memory, threads)
+}
+
+// newGCM returns an AES-GCM AEAD for key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return gcm, nil
+}
+
+// tarBlockSize is the size of tar headers and the unit data is padded
+// to.
+const tarBlockSize = 512
+
+// tarSizeBound returns at least the size of the tar entry for a file
+// called name holding size bytes, counting a PAX header in case name is
+// too long for a plain one.
+func tarSizeBound(name string, size int) int {
+	blocks := func(n int) int {
+		return (n + tarBlockSize - 1) / tarBlockSize * tarBlockSize
+	}
+	return 2*tarBlockSize + blocks(len(name)+tarBlockSize) + blocks(size)
+}
+
+// fixedWriter writes into buf without ever growing it.
+type fixedWriter struct {
+	buf []byte
+	n   int
+}
+
+func (w *fixedWriter) Write(p []byte) (int, error) {
+	if len(p) > len(w.buf)-w.n {
+		return 0, io.ErrShortBuffer
+	}
+	w.n += copy(w.buf[w.n:], p)
+	return len(p), nil
+}
+
+func writeTarEntry(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	hdr := &tar.Header{
+		Name:    path.Clean(name),
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: modTime,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	return nil
+}
+
+// hasAnyPrefix reports whether rel starts with any of prefixes, or
+// true if there are no prefixes.
+func hasAnyPrefix(rel string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(rel, strings.TrimPrefix(prefix, "/")) {
+			return true
+		}
+	}
+	return false
+}
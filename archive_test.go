@@ -0,0 +1,143 @@
+package darkstore
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_ExportImport(t *testing.T) {
+	assert := assert.New(t)
+
+	srcDir := filepath.Join(testStoreDir, "export_src")
+	defer os.RemoveAll(srcDir) //nolint: errcheck
+
+	src, err := newTestStore(srcDir)
+	assert.NoError(err)
+	defer src.Close()
+	assert.NoError(src.Save("db/user", []byte("admin")))
+	assert.NoError(src.Save("db/pass", []byte("hunter2")))
+	assert.NoError(src.Save("api/key", []byte("abc123")))
+
+	exportPassword := []byte("export-password")
+
+	// Test case 1: Export everything into a new store
+	t.Run("Full round trip", func(t *testing.T) {
+		var buf bytes.Buffer
+		assert.NoError(src.Export(&buf, exportPassword, ExportOptions{}))
+		assert.False(bytes.Contains(buf.Bytes(), []byte("hunter2")))
+
+		dstDir := filepath.Join(testStoreDir, "export_dst1")
+		defer os.RemoveAll(dstDir) //nolint: errcheck
+		dst, err := newTestStore(dstDir)
+		assert.NoError(err)
+		defer dst.Close()
+
+		result, err := Import(&buf, exportPassword, dst, ConflictFail)
+		assert.NoError(err)
+		assert.ElementsMatch([]string{"api/key", "db/pass", "db/user"}, result.Imported)
+		data, err := dst.Load("db/pass")
+		assert.NoError(err)
+		assert.Equal([]byte("hunter2"), data)
+		assert.NoError(dst.CheckIntegrity())
+	})
+
+	// Test case 2: Selective export and conflict policies
+	t.Run("Prefix and conflicts", func(t *testing.T) {
+		var buf bytes.Buffer
+		assert.NoError(src.Export(&buf, exportPassword, ExportOptions{Prefixes: []string{"db/"}}))
+		archive := buf.Bytes()
+
+		dstDir := filepath.Join(testStoreDir, "export_dst2")
+		defer os.RemoveAll(dstDir) //nolint: errcheck
+		dst, err := newTestStore(dstDir)
+		assert.NoError(err)
+		defer dst.Close()
+		assert.NoError(dst.Save("db/user", []byte("local")))
+
+		_, err = Import(bytes.NewReader(archive), exportPassword, dst, ConflictFail)
+		assert.True(errors.Is(err, ErrConflict), "got %v", err)
+		_, err = dst.Load("db/pass")
+		assert.Error(err, "nothing imported on conflict")
+
+		result, err := Import(bytes.NewReader(archive), exportPassword, dst, ConflictSkip)
+		assert.NoError(err)
+		assert.Equal([]string{"db/pass"}, result.Imported)
+		assert.Equal([]string{"db/user"}, result.Skipped)
+		data, err := dst.Load("db/user")
+		assert.NoError(err)
+		assert.Equal([]byte("local"), data)
+
+		result, err = Import(bytes.NewReader(archive), exportPassword, dst, ConflictOverwrite)
+		assert.NoError(err)
+		assert.Len(result.Imported, 2)
+		data, err = dst.Load("db/user")
+		assert.NoError(err)
+		assert.Equal([]byte("admin"), data)
+
+		_, err = dst.Load("api/key")
+		assert.Error(err, "outside the exported prefix")
+	})
+
+	// Test case 3: Wrong password and corrupt archives
+	t.Run("Bad archives", func(t *testing.T) {
+		var buf bytes.Buffer
+		assert.NoError(src.Export(&buf, exportPassword, ExportOptions{}))
+		archive := buf.Bytes()
+
+		dstDir := filepath.Join(testStoreDir, "export_dst3")
+		defer os.RemoveAll(dstDir) //nolint: errcheck
+		dst, err := newTestStore(dstDir)
+		assert.NoError(err)
+		defer dst.Close()
+
+		_, err = Import(bytes.NewReader(archive), []byte("wrong"), dst, ConflictOverwrite)
+		assert.Error(err)
+		assert.Contains(err.Error(), "wrong password")
+
+		corrupt := append([]byte{}, archive...)
+		corrupt[len(corrupt)-1] ^= 0xff
+		_, err = Import(bytes.NewReader(corrupt), exportPassword, dst, ConflictOverwrite)
+		assert.Error(err)
+
+		_, err = Import(bytes.NewReader([]byte("not an archive at all, clearly")), exportPassword, dst, ConflictOverwrite)
+		assert.Error(err)
+
+		assert.Error(src.Export(&buf, nil, ExportOptions{}))
+	})
+
+	// Test case 4: Import into a store directory, creating the store
+	t.Run("Import to directory", func(t *testing.T) {
+		long := strings.Repeat("long/", 40) + "name"
+		assert.NoError(src.Save(long, []byte("needs a PAX header")))
+		var buf bytes.Buffer
+		assert.NoError(src.Export(&buf, exportPassword, ExportOptions{}))
+		archive := buf.Bytes()
+
+		dstDir := filepath.Join(testStoreDir, "export_dst4")
+		defer os.RemoveAll(dstDir) //nolint: errcheck
+		_, err := ImportDir(bytes.NewReader(archive), []byte("wrong"), dstDir, testPassword, ConflictFail)
+		assert.Error(err)
+		_, err = os.Stat(dstDir)
+		assert.True(os.IsNotExist(err), "no store is created for a bad archive")
+
+		result, err := ImportDir(bytes.NewReader(archive), exportPassword, dstDir, testPassword, ConflictFail)
+		assert.NoError(err)
+		assert.Len(result.Imported, 4)
+		result, err = ImportDir(bytes.NewReader(archive), exportPassword, dstDir, testPassword, ConflictSkip)
+		assert.NoError(err)
+		assert.Len(result.Skipped, 4, "merges into the existing store")
+
+		dst, err := NewStore(dstDir, testPassword)
+		assert.NoError(err)
+		defer dst.Close()
+		data, err := dst.Load(long)
+		assert.NoError(err)
+		assert.Equal([]byte("needs a PAX header"), data)
+	})
+}
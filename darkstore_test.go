@@ -25,6 +25,11 @@ func newTestStore(dir string) (*Store, error) {
 		saltFile:      filepath.Join(fullPath, keyDirName, primarySaltFile),
 		curKeyIdxFile: filepath.Join(fullPath, keyDirName, curKeyIdxFile),
 		lockFile:      filepath.Join(fullPath, keyDirName, lockFileName),
+		tempDir:       filepath.Join(fullPath, keyDirName, tempDirName),
+		txLockFile:    filepath.Join(fullPath, keyDirName, txLockFileName),
+		journalDir:    filepath.Join(fullPath, keyDirName, journalDirName),
+		manifestFile:  filepath.Join(fullPath, keyDirName, manifestFileName),
+		slotsDir:      filepath.Join(fullPath, keyDirName, slotsDirName),
 	}
 	store.dirPerm = 0700
 	store.filePerm = 0600
@@ -33,6 +38,13 @@ func newTestStore(dir string) (*Store, error) {
 		return nil, err
 	}
 
+	if err := store.touchFile(store.lockFile); err != nil {
+		return nil, err
+	}
+	if err := store.touchFile(store.txLockFile); err != nil {
+		return nil, err
+	}
+
 	salt := make([]byte, saltLength)
 	if err := store.writeFile(store.saltFile, salt); err != nil {
 		return nil, err
@@ -47,5 +59,8 @@ func newTestStore(dir string) (*Store, error) {
 	if err := store.saveCurrentKeyIndex(); err != nil {
 		return nil, err
 	}
+	if err := store.initManifest(); err != nil {
+		return nil, err
+	}
 	return store, nil
 }
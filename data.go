@@ -1,9 +1,8 @@
 package darkstore
 
 import (
-	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -15,15 +14,30 @@ func (s *Store) Save(path string, data []byte) error {
 	if s == nil {
 		return fmt.Errorf("no store")
 	}
-	// Validate path
-	if path == "" {
-		return fmt.Errorf("path must not be empty")
+	if err := s.checkClosed(); err != nil {
+		return err
 	}
-	fullPath := filepath.Join(s.dir, path)
-	if !strings.HasPrefix(fullPath, s.dir+"/") {
-		return fmt.Errorf("path outside store hierarchy: %s", path)
+	if s.writeOnly != nil {
+		return s.saveSealed(path, data)
+	}
+	if s.reauth.Load() {
+		return ErrReauthRequired
+	}
+	if err := s.checkLocked(); err != nil {
+		return err
+	}
+	fullPath, err := s.secretPath(path)
+	if err != nil {
+		return err
 	}
 
+	// The data file and the manifest must change together.
+	lk, err := s.lock(s.txLockFile)
+	if err != nil {
+		return fmt.Errorf("error locking %s: %w", s.txLockFile, err)
+	}
+	defer lk.unlock()
+
 	// Create directory structure if needed
 	dir := filepath.Dir(fullPath)
 	if err := os.MkdirAll(dir, s.dirPerm); err != nil {
@@ -42,34 +56,112 @@ func (s *Store) Save(path string, data []byte) error {
 		return fmt.Errorf("failed to encrypt data: %w", err)
 	}
 
-	return s.writeFile(fullPath, encryptedData)
+	if err = s.writeFile(fullPath, encryptedData); err != nil {
+		return err
+	}
+	return s.updateManifest(func(m *manifest) {
+		m.set(s.relPath(fullPath), encryptedData)
+	})
 }
 
 // Load retrieves sensitive data from the given path
 func (s *Store) Load(path string) ([]byte, error) {
+	return s.load(path, nil)
+}
+
+// LoadLocked is like Load, but decrypts the data straight into a
+// LockedBuffer, which the caller must Destroy.
+func (s *Store) LoadLocked(path string) (*LockedBuffer, error) {
+	var buf *LockedBuffer
+	_, err := s.load(path, func(size int) ([]byte, error) {
+		var err error
+		buf, err = NewLockedBuffer(size)
+		return buf.Bytes(), err
+	})
+	if err != nil {
+		buf.Destroy()
+		return nil, err
+	}
+	return buf, nil
+}
+
+// newSecretBuffer returns the buffers With decrypts into.  Tests replace
+// it to see the buffers after they are wiped.
+var newSecretBuffer = lockedOrHeap
+
+// With decrypts the secret at path into a LockedBuffer, calls fn with
+// it, and wipes it once fn returns or panics, so fn must not keep the
+// slice.  If memory cannot be locked, the secret is decrypted into
+// ordinary memory, which is wiped all the same.  With returns fn's
+// error.
+func (s *Store) With(path string, fn func(secret []byte) error) error {
+	return s.WithMany([]string{path}, func(secrets [][]byte) error {
+		return fn(secrets[0])
+	})
+}
+
+// WithMany is like With for several secrets at once.  fn is called with
+// the secrets in the order of paths, and only if all of them load.
+func (s *Store) WithMany(paths []string, fn func(secrets [][]byte) error) error {
+	secrets := make([][]byte, len(paths))
+	var bufs []*LockedBuffer
+	defer func() {
+		for _, buf := range bufs {
+			buf.Destroy()
+		}
+	}()
+	for i, path := range paths {
+		_, err := s.load(path, func(size int) ([]byte, error) {
+			buf := newSecretBuffer(size)
+			bufs = append(bufs, buf)
+			secrets[i] = buf.Bytes()
+			return secrets[i], nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return fn(secrets)
+}
+
+// load reads and decrypts the secret at path, into the buffer from
+// alloc if it is not nil.
+func (s *Store) load(path string, alloc func(size int) ([]byte, error)) ([]byte, error) {
 	if s == nil {
 		return nil, fmt.Errorf("no store")
 	}
-	// Validate path
-	if path == "" {
-		return nil, fmt.Errorf("path must not be empty")
+	if err := s.checkOpen(); err != nil {
+		return nil, err
 	}
-	fullPath := filepath.Join(s.dir, path)
-	if !strings.HasPrefix(fullPath, s.dir+"/") {
-		return nil, fmt.Errorf("path outside store hierarchy: %s", path)
+	fullPath, err := s.secretPath(path)
+	if err != nil {
+		return nil, err
 	}
 
+	// Readers must not see a transaction half-applied.
+	lk, err := s.rLock(s.txLockFile)
+	if err != nil {
+		return nil, fmt.Errorf("error locking %s: %w", s.txLockFile, err)
+	}
+	defer lk.unlock()
+
 	// Read encrypted data
 	encryptedData, err := s.readFile(fullPath)
 	if err != nil {
 		if os.IsNotExist(err) {
+			if err = s.checkManifest(fullPath, nil); err != nil {
+				return nil, err
+			}
 			return nil, fmt.Errorf("secret not found: %s", path)
 		}
 		return nil, fmt.Errorf("failed to read file: %w", err)
 	}
+	if err = s.checkManifest(fullPath, encryptedData); err != nil {
+		return nil, err
+	}
 
 	// Decrypt data
-	data, err := s.decryptData(encryptedData)
+	data, err := s.decryptDataTo(encryptedData, alloc)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decrypt data: %w", err)
 	}
@@ -82,10 +174,12 @@ func (s *Store) Delete(path string) error {
 	if s == nil {
 		return fmt.Errorf("no store")
 	}
-	// Clean and validate path
-	fullPath := filepath.Clean(filepath.Join(s.dir, path))
-	if !strings.HasPrefix(fullPath, s.dir) {
-		return fmt.Errorf("path outside store hierarchy: %s", path)
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	fullPath, err := s.secretPath(path)
+	if err != nil {
+		return err
 	}
 
 	if _, err := os.Stat(fullPath); err != nil {
@@ -95,6 +189,13 @@ func (s *Store) Delete(path string) error {
 		return err
 	}
 
+	// The data file and the manifest must change together.
+	txLk, err := s.lock(s.txLockFile)
+	if err != nil {
+		return fmt.Errorf("error locking %s: %w", s.txLockFile, err)
+	}
+	defer txLk.unlock()
+
 	// Exclusive lock before delete
 	lk, err := s.lock(fullPath)
 	if err != nil {
@@ -102,79 +203,105 @@ func (s *Store) Delete(path string) error {
 	}
 	defer lk.unlock()
 
-	return os.Remove(fullPath)
+	if err = os.Remove(fullPath); err != nil {
+		return err
+	}
+	return s.updateManifest(func(m *manifest) {
+		delete(m.entries, s.relPath(fullPath))
+	})
 }
 
-// encryptData encrypts data using the current key
-func (s *Store) encryptData(data []byte) ([]byte, error) {
-	block, err := aes.NewCipher(s.currentKey)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher: %w", err)
+// secretPath validates the path of a secret and returns its full path
+// within the store.
+func (s *Store) secretPath(path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("path must not be empty")
+	}
+	fullPath := filepath.Join(s.dir, path)
+	if !strings.HasPrefix(fullPath, s.dir+"/") {
+		return "", fmt.Errorf("path outside store hierarchy: %s", path)
+	}
+	if strings.HasPrefix(fullPath, s.keyDir) {
+		return "", fmt.Errorf("path inside keys directory: %s", path)
 	}
+	return fullPath, nil
+}
 
-	gcm, err := cipher.NewGCM(block)
+// encryptData encrypts data using the current key
+func (s *Store) encryptData(data []byte) ([]byte, error) {
+	gcm, keyIndex, err := s.currentAEAD()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create GCM: %w", err)
+		return nil, err
 	}
 
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := rand.Read(nonce); err != nil {
-		return nil, fmt.Errorf("failed to generate nonce: %w", err)
-	}
+	// Create data file structure: the key index, then the nonce and
+	// ciphertext from Seal.
+	result := make([]byte, 1, 1+len(data)+gcm.Overhead())
+	result[0] = keyIndex
+	return gcm.Seal(result, nil, data, nil), nil
+}
 
-	encryptedData := gcm.Seal(nil, nonce, data, nil)
+// errUndecryptable is wrapped by the errors of decryptDataTo when the
+// encrypted data itself is bad: it is too short or fails
+// authentication.  Only then is the data known to be useless.
+var errUndecryptable = errors.New("failed to decrypt")
 
-	// Create data file structure
-	result := make([]byte, 1+len(nonce)+len(encryptedData))
-	result[0] = s.currentKeyIndex
-	copy(result[1:], nonce)
-	copy(result[1+len(nonce):], encryptedData)
+// keyLoadError is returned by decryptDataTo when the key the data was
+// encrypted with could not be had, for example because the store was
+// locked or a KeyWrapper failed to unwrap it.  The data may be fine.
+type keyLoadError struct {
+	index uint8
+	err   error
+}
 
-	return result, nil
+func (e *keyLoadError) Error() string {
+	return fmt.Sprintf("failed to load key %d: %v", e.index, e.err)
 }
 
+func (e *keyLoadError) Unwrap() error { return e.err }
+
 // decryptData decrypts data using the appropriate key
 func (s *Store) decryptData(encryptedData []byte) ([]byte, error) {
+	return s.decryptDataTo(encryptedData, nil)
+}
+
+// decryptDataTo decrypts data into the buffer returned by alloc for the
+// size of the plaintext, or into a new slice if alloc is nil.
+func (s *Store) decryptDataTo(encryptedData []byte, alloc func(size int) ([]byte, error)) ([]byte, error) {
 	if len(encryptedData) < 1 {
-		return nil, fmt.Errorf("invalid encrypted data format")
+		return nil, fmt.Errorf("%w: invalid encrypted data format", errUndecryptable)
 	}
 
 	keyIndex := encryptedData[0]
 
 	// Get the key for this data
-	var key []byte
-	if keyIndex == s.currentKeyIndex {
-		key = s.currentKey
-	} else {
+	gcm, curIndex, err := s.currentAEAD()
+	if err != nil {
+		return nil, &keyLoadError{index: keyIndex, err: err}
+	}
+	if keyIndex != curIndex {
 		// Load the specific key
-		var err error
-		key, err = s.loadKey(keyIndex)
+		gcm, err = s.loadAEAD(keyIndex)
 		if err != nil {
-			return nil, fmt.Errorf("failed to load key %d: %w", keyIndex, err)
+			return nil, &keyLoadError{index: keyIndex, err: err}
 		}
 	}
 
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	if len(encryptedData) < 1+gcm.Overhead() {
+		return nil, fmt.Errorf("%w: invalid encrypted data format", errUndecryptable)
 	}
 
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create GCM: %w", err)
-	}
+	ciphertext := encryptedData[1:]
 
-	nonceSize := gcm.NonceSize()
-	if len(encryptedData) < 1+nonceSize {
-		return nil, fmt.Errorf("invalid encrypted data format")
+	var out []byte
+	if alloc != nil {
+		if out, err = alloc(len(ciphertext) - gcm.Overhead()); err != nil {
+			return nil, err
+		}
 	}
-
-	nonce := encryptedData[1 : 1+nonceSize]
-	ciphertext := encryptedData[1+nonceSize:]
-
-	data, err := gcm.Open(nil, nonce, ciphertext, nil)
+	data, err := gcm.Open(out[:0], nil, ciphertext, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt: %w", err)
+		return nil, fmt.Errorf("%w: %w", errUndecryptable, err)
 	}
 	if data == nil { // Return an empty byte slice instead of nil.
 		data = make([]byte, 0)
@@ -183,6 +310,19 @@ func (s *Store) decryptData(encryptedData []byte) ([]byte, error) {
 	return data, nil
 }
 
+// loadAEAD returns an AES-GCM cipher with the key index, keeping the
+// key itself in a LockedBuffer while it is needed.
+func (s *Store) loadAEAD(index uint8) (cipher.AEAD, error) {
+	key, err := s.loadKey(index)
+	if err != nil {
+		return nil, err
+	}
+	buf := lockedCopy(key)
+	Wipe(key)
+	defer buf.Destroy()
+	return newAEAD(buf.Bytes())
+}
+
 // getKeyIndex returns the key index used to encrypt a file.
 func (s *Store) getKeyIndex(file string) (uint8, error) {
 	// Read encrypted data
@@ -1,6 +1,8 @@
 package darkstore
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -134,6 +136,113 @@ func TestStore_SaveLoadDelete(t *testing.T) {
 		assert.NoError(err)
 		assert.Equal(store.currentKeyIndex, keyIndex)
 	})
+	// Test case 11: The keys directory and sibling directories cannot
+	// be deleted from
+	t.Run("Delete keys", func(t *testing.T) {
+		keyFile := filepath.Join(store.keyDir, "key0")
+		for _, path := range []string{keyDirName + "/key0", keyDirName + "/" + manifestFileName,
+			"../" + filepath.Base(dir) + "-other/secret", "."} {
+			assert.Error(store.Delete(path), path)
+		}
+		_, err := os.Stat(keyFile)
+		assert.NoError(err)
+	})
+}
+
+func TestStore_With(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := filepath.Join(testStoreDir, "with_test")
+	defer os.RemoveAll(dir) //nolint: errcheck
+
+	store, err := newTestStore(dir)
+	assert.NoError(err)
+	defer store.Close()
+
+	assert.NoError(store.Save("one", []byte("first secret")))
+	assert.NoError(store.Save("two", []byte("second secret")))
+
+	// Keep the buffers on the heap so that they can be read once wiped.
+	var kept [][]byte
+	defer func() { newSecretBuffer = lockedOrHeap }()
+	newSecretBuffer = func(size int) *LockedBuffer {
+		buf := &LockedBuffer{data: make([]byte, size)}
+		kept = append(kept, buf.data)
+		return buf
+	}
+	wiped := func() bool {
+		for _, secret := range kept {
+			if !bytes.Equal(secret, make([]byte, len(secret))) {
+				return false
+			}
+		}
+		return len(kept) > 0
+	}
+
+	// Test case 1: fn sees the secret, which is wiped afterwards
+	t.Run("With", func(t *testing.T) {
+		kept = nil
+		err := store.With("one", func(secret []byte) error {
+			assert.Equal([]byte("first secret"), secret)
+			return nil
+		})
+		assert.NoError(err)
+		assert.True(wiped())
+	})
+
+	// Test case 2: fn's error is returned
+	t.Run("Error", func(t *testing.T) {
+		errFn := errors.New("callback failed")
+		assert.Equal(errFn, store.With("one", func(secret []byte) error {
+			return errFn
+		}))
+	})
+
+	// Test case 3: The secret is wiped when fn panics
+	t.Run("Panic", func(t *testing.T) {
+		kept = nil
+		assert.PanicsWithValue("boom", func() {
+			_ = store.With("one", func(secret []byte) error {
+				panic("boom")
+			})
+		})
+		assert.True(wiped())
+	})
+
+	// Test case 4: WithMany passes the secrets in order and wipes them all
+	t.Run("WithMany", func(t *testing.T) {
+		kept = nil
+		err := store.WithMany([]string{"two", "one"}, func(secrets [][]byte) error {
+			assert.Equal([][]byte{[]byte("second secret"), []byte("first secret")}, secrets)
+			return nil
+		})
+		assert.NoError(err)
+		assert.Len(kept, 2)
+		assert.True(wiped())
+	})
+
+	// Test case 5: fn is not called if any secret fails to load
+	t.Run("Missing", func(t *testing.T) {
+		kept = nil
+		called := false
+		err := store.WithMany([]string{"one", "missing"}, func(secrets [][]byte) error {
+			called = true
+			return nil
+		})
+		assert.ErrorContains(err, "secret not found")
+		assert.False(called)
+		assert.True(wiped())
+	})
+
+	// Test case 6: Without the test buffers, secrets are in locked memory
+	t.Run("Locked", func(t *testing.T) {
+		newSecretBuffer = lockedOrHeap
+		err := store.With("two", func(secret []byte) error {
+			assert.Equal([]byte("second secret"), secret)
+			return nil
+		})
+		assert.NoError(err)
+	})
 }
 
 func BenchmarkEncrypt(b *testing.B) {
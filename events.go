@@ -0,0 +1,104 @@
+package darkstore
+
+import (
+	"errors"
+)
+
+// eventBufferSize is how many events are kept for a slow reader before
+// new ones are dropped.
+const eventBufferSize = 16
+
+// ErrReauthRequired is returned once another process has changed the
+// store's keys so that this Store can no longer read them, for example
+// with RewrapKeys.  Close the store and open it again.
+var ErrReauthRequired = errors.New("store keys were changed, reopen the store")
+
+// Event is something that happened to a store, possibly in another
+// process, reported on the channel from Events.
+type Event int
+
+const (
+	// PasswordChanged means the keys directory was replaced, as Passwd,
+	// RewrapKeys and SetKeyWrapper do.  If the store can still read its
+	// keys, it goes on working.
+	PasswordChanged Event = iota + 1
+	// Rotated means the store's current key changed.
+	Rotated
+	// Locked means the store can no longer be used and every operation
+	// returns ErrReauthRequired.
+	Locked
+	// IdleLocked means the store locked itself after being idle, and
+	// returns ErrLocked until it is unlocked with Unlock.
+	IdleLocked
+	// Unlocked means Unlock unlocked the store.
+	Unlocked
+	// UnlockFailed means an attempt to unlock the store, by this or
+	// another process, failed.  It is only reported for stores with a
+	// ThrottlePolicy.
+	UnlockFailed
+)
+
+func (e Event) String() string {
+	switch e {
+	case PasswordChanged:
+		return "password changed"
+	case Rotated:
+		return "rotated"
+	case Locked:
+		return "locked"
+	case IdleLocked:
+		return "idle locked"
+	case Unlocked:
+		return "unlocked"
+	case UnlockFailed:
+		return "unlock failed"
+	}
+	return "unknown event"
+}
+
+// Events returns a channel of the events of the store.  Events are
+// dropped if the channel is not read and its buffer fills.  Close
+// closes the channel once the store's background goroutines have
+// stopped, so a loop ranging over it ends.
+func (s *Store) Events() <-chan Event {
+	return s.events
+}
+
+// emit sends e on the events channel without blocking, unless the
+// store was closed.
+func (s *Store) emit(e Event) {
+	s.eventsMu.Lock()
+	defer s.eventsMu.Unlock()
+	if s.eventsClosed {
+		return
+	}
+	select {
+	case s.events <- e:
+	default:
+		s.debug("dropped event: %s", e)
+	}
+}
+
+// checkOpen returns ErrClosed after Close, ErrWriteOnly for stores
+// from OpenWriteOnly, ErrReauthRequired once the store's keys were
+// changed under it, and ErrLocked while it is locked after being idle.
+func (s *Store) checkOpen() error {
+	if err := s.checkClosed(); err != nil {
+		return err
+	}
+	if s.writeOnly != nil {
+		return ErrWriteOnly
+	}
+	if s.reauth.Load() {
+		return ErrReauthRequired
+	}
+	return s.checkLocked()
+}
+
+// requireReauth locks the store out until it is reopened.
+func (s *Store) requireReauth(err error) {
+	s.debug("store keys changed: %v", err)
+	if !s.reauth.Swap(true) {
+		s.emit(Locked)
+	}
+}
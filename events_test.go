@@ -0,0 +1,118 @@
+package darkstore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// waitForEvent returns the next event from s other than skip, or 0 if
+// none arrives in time.
+func waitForEvent(s *Store, skip ...Event) Event {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-s.Events():
+			skipped := false
+			for _, k := range skip {
+				skipped = skipped || e == k
+			}
+			if !skipped {
+				return e
+			}
+		case <-timeout:
+			return 0
+		}
+	}
+}
+
+func TestStore_Events(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := filepath.Join(testStoreDir, "events")
+	defer os.RemoveAll(dir) //nolint: errcheck
+
+	// Two handles on one store stand in for two processes.
+	other, err := NewStore(dir, testPassword)
+	assert.NoError(err)
+	defer other.Close()
+	assert.NoError(other.Save("secret", []byte("shared")))
+	store, err := NewStore(dir, testPassword)
+	assert.NoError(err)
+	defer store.Close()
+
+	// Test case 1: A rotation by another process
+	t.Run("Rotated", func(t *testing.T) {
+		assert.NoError(other.Rotate())
+		assert.Equal(Rotated, waitForEvent(other))
+		assert.Equal(Rotated, waitForEvent(store))
+		assert.Equal(other.keyIndex(), store.keyIndex())
+		waitForRotation(t, other)
+	})
+
+	// Test case 2: A password change keeps the store working
+	t.Run("PasswordChanged", func(t *testing.T) {
+		assert.NoError(other.Passwd([]byte("new password")))
+		assert.Equal(PasswordChanged, waitForEvent(store))
+
+		data, err := store.Load("secret")
+		assert.NoError(err)
+		assert.Equal([]byte("shared"), data)
+
+		// The watch was re-established on the new keys directory.
+		assert.NoError(other.Rotate())
+		assert.Equal(Rotated, waitForEvent(store))
+		waitForRotation(t, other)
+	})
+
+	// Test case 3: A new master key locks out other processes
+	t.Run("Locked", func(t *testing.T) {
+		// The store's watcher may briefly hold the key lock.
+		var err error
+		assert.Eventually(func() bool {
+			_, _, err = other.RewrapKeys([]byte("new password"), RewrapOptions{})
+			return !errors.Is(err, syscall.EAGAIN)
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.NoError(err)
+		assert.Equal(Locked, waitForEvent(store, PasswordChanged, Rotated))
+
+		_, err = store.Load("secret")
+		assert.True(errors.Is(err, ErrReauthRequired), "got %v", err)
+		assert.True(errors.Is(store.Save("secret", []byte("x")), ErrReauthRequired))
+
+		// The process that rewrapped goes on working.
+		data, err := other.Load("secret")
+		assert.NoError(err)
+		assert.Equal([]byte("shared"), data)
+
+		reopened, err := NewStore(dir, []byte("new password"))
+		assert.NoError(err)
+		data, err = reopened.Load("secret")
+		assert.NoError(err)
+		assert.Equal([]byte("shared"), data)
+		reopened.Close()
+	})
+
+	// Test case 4: Close ends a loop ranging over the events
+	t.Run("Close", func(t *testing.T) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for range store.Events() {
+			}
+		}()
+		store.Close()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Error("events channel was not closed")
+		}
+	})
+
+	assert.Equal("password changed", PasswordChanged.String())
+}
@@ -70,12 +70,13 @@ func main() {
 	time.Sleep(100 * time.Millisecond) // Wait for update to rotate data.
 
 	// Verify data is still accessible after rotation
-	loadedData, err = store.Load(secretPath)
+	err = store.With(secretPath, func(secret []byte) error {
+		fmt.Printf("Secret still accessible after rotation: %s\n", string(secret))
+		return nil
+	})
 	if err != nil {
 		log.Fatalf("Error loading secret after rotation: %v", err)
 	}
-	fmt.Printf("Secret still accessible after rotation: %s\n", string(loadedData))
-	darkstore.Wipe(loadedData)
 
 	// Demonstrate secure memory wiping
 	fmt.Println("\n=== Secure Memory Wiping Example ===")
@@ -0,0 +1,168 @@
+package darkstore
+
+import (
+	"crypto/fips140"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"unsafe"
+)
+
+const (
+	fipsFileName = "fips"
+	fipsVersion  = 1
+
+	// pbkdf2Iterations is the PBKDF2-HMAC-SHA256 work factor of the key
+	// slots of a FIPS store, as OWASP recommends.
+	pbkdf2Iterations = 600000
+
+	fipsManifestKeyInfo = "darkstore fips manifest v1"
+)
+
+// ErrNotApproved is returned when a FIPS store would have to use an
+// algorithm that FIPS 140-3 does not approve, and when a store that
+// is not a FIPS store is opened in FIPS mode.
+var ErrNotApproved = errors.New("algorithm not approved in FIPS mode")
+
+// WithFIPS has NewStore create a FIPS store, and NewStore and Open
+// refuse to open a store that is not one.  It is implied when Go's
+// FIPS 140-3 mode is on, as with GODEBUG=fips140=on.
+//
+// A FIPS store derives the keys of its password and recovery slots
+// with PBKDF2-HMAC-SHA256 instead of Argon2id, and refuses Shamir
+// shares, X25519 and SSH recipients, write-only stores and password
+// protected archives, which use algorithms that FIPS 140-3 does not
+// approve.  Everything else is AES-256-GCM, HMAC-SHA256 and HKDF.
+func WithFIPS() Option {
+	return func(o *options) {
+		o.fips = true
+	}
+}
+
+// FIPS reports whether s is a FIPS store.
+func (s *Store) FIPS() bool {
+	return s != nil && s.fips
+}
+
+// fipsRequested reports whether the store must be a FIPS store.
+func (o *options) fipsRequested() bool {
+	return o.fips || fips140.Enabled()
+}
+
+// fipsFile returns the path of the file that marks a FIPS store.
+func (s *Store) fipsFile() string {
+	return filepath.Join(s.keyDir, fipsFileName)
+}
+
+// writeFIPS marks a new store as a FIPS store.
+func (s *Store) writeFIPS() error {
+	if err := s.writeFile(s.fipsFile(), []byte{fipsVersion}); err != nil {
+		return fmt.Errorf("failed to write FIPS marker: %w", err)
+	}
+	return nil
+}
+
+// isFIPSStore reports whether the store on disk is marked as a FIPS
+// store.
+func (s *Store) isFIPSStore() (bool, error) {
+	data, err := s.readFile(s.fipsFile())
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to read FIPS marker: %w", err)
+	}
+	if len(data) != 1 || data[0] != fipsVersion {
+		return false, fmt.Errorf("invalid FIPS marker")
+	}
+	return true, nil
+}
+
+// loadFIPS sets whether the store is a FIPS store before it is
+// unlocked, and rejects it if it uses an algorithm that is not
+// approved, or if FIPS mode was requested and it is not a FIPS store.
+// The marker cannot be removed unnoticed: PBKDF2 slots are only made
+// for FIPS stores, and the manifest key depends on the mode.  The
+// caller must hold the keys lock.
+func (s *Store) loadFIPS() error {
+	fips, err := s.isFIPSStore()
+	if err != nil {
+		return err
+	}
+	s.fips = fips
+	slots, err := s.readSlots()
+	if err != nil {
+		return err
+	}
+	if !s.fips {
+		for _, ks := range slots {
+			if ks.kdf == kdfPBKDF2 {
+				return fmt.Errorf("FIPS marker missing: %w", ErrTampered)
+			}
+		}
+		if s.opts.fipsRequested() {
+			return fmt.Errorf("store at %s is not a FIPS store: %w", s.dir, ErrNotApproved)
+		}
+		return nil
+	}
+	if _, err := os.Stat(s.saltFile); err == nil {
+		return fmt.Errorf("argon2id primary key: %w", ErrNotApproved)
+	}
+	for _, ks := range slots {
+		if !ks.approved() {
+			return fmt.Errorf("key slot %s uses %s: %w", ks.name, ks.info().KDF, ErrNotApproved)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(s.keyDir, writeKeyFile)); err == nil {
+		return fmt.Errorf("x25519 write key: %w", ErrNotApproved)
+	}
+	return nil
+}
+
+// checkApproved returns ErrNotApproved if s is a FIPS store.  what names
+// the algorithm that is not approved.
+func (s *Store) checkApproved(what string) error {
+	if s.fips {
+		return fmt.Errorf("%s: %w", what, ErrNotApproved)
+	}
+	return nil
+}
+
+// slotKDF returns the KDF of the store's new password and recovery
+// slots.
+func (s *Store) slotKDF() uint8 {
+	if s.fips {
+		return kdfPBKDF2
+	}
+	return kdfArgon2id
+}
+
+// approved reports whether a FIPS store may use the slot.
+func (ks *keySlot) approved() bool {
+	switch {
+	case ks.kind == slotTypePassword && ks.kdf == kdfPBKDF2:
+	case ks.kind == slotTypeRecovery && ks.kdf == kdfPBKDF2:
+	case ks.kind == slotTypeKey && ks.kdf == kdfNone:
+	case ks.kind == slotTypeKMS && ks.kdf == kdfExternal:
+	default:
+		return false
+	}
+	return true
+}
+
+// deriveKeyPBKDF2 derives a key from password with PBKDF2-HMAC-SHA256.
+func deriveKeyPBKDF2(password, salt []byte, iterations uint32) ([]byte, error) {
+	if len(salt) < saltLength {
+		return nil, fmt.Errorf("salt must be at least %d bytes", saltLength)
+	}
+	// pbkdf2.Key takes a string; converting password would leave a copy
+	// that cannot be wiped.
+	pw := unsafe.String(unsafe.SliceData(password), len(password))
+	key, err := pbkdf2.Key(sha256.New, pw, salt, int(iterations), int(argon2KeyLen))
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	return key, nil
+}
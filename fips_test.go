@@ -0,0 +1,169 @@
+package darkstore
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/fips140"
+	"crypto/rand"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestStore_FIPS(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := filepath.Join(testStoreDir, "fips")
+	plainDir := filepath.Join(testStoreDir, "fips_plain")
+	keyPath := filepath.Join(testStoreDir, "fips_keyfile")
+	defer os.RemoveAll(dir)      //nolint: errcheck
+	defer os.RemoveAll(plainDir) //nolint: errcheck
+	defer os.RemoveAll(keyPath)  //nolint: errcheck
+
+	var recoveryKey []byte
+	store, err := NewStore(dir, testPassword, WithFIPS(), WithRecoveryKey(&recoveryKey))
+	assert.NoError(err)
+	assert.True(store.FIPS())
+	assert.NoError(store.Save("secret", []byte("approved")))
+
+	// Test case 1: Password and recovery slots use PBKDF2
+	t.Run("Slots", func(t *testing.T) {
+		slots, err := store.ListKeySlots()
+		assert.NoError(err)
+		assert.Len(slots, 2)
+		for _, slot := range slots {
+			assert.Equal("pbkdf2-hmac-sha256", slot.KDF)
+			assert.Equal(uint32(pbkdf2Iterations), slot.Time)
+		}
+		assert.NoError(store.AddKeySlot("oncall", []byte("on-call-password")))
+		slots, err = store.ListKeySlots()
+		assert.NoError(err)
+		assert.Equal("pbkdf2-hmac-sha256", slots[1].KDF)
+	})
+
+	// Test case 2: Algorithms that are not approved are refused
+	t.Run("NotApproved", func(t *testing.T) {
+		_, err := store.SplitKey(2, 3, SplitOptions{})
+		assert.ErrorIs(err, ErrNotApproved)
+		pub, _, err := GenerateIdentity()
+		assert.NoError(err)
+		assert.ErrorIs(store.AddRecipient("bob", pub), ErrNotApproved)
+		_, err = store.WriteKey()
+		assert.ErrorIs(err, ErrNotApproved)
+		_, err = OpenWriteOnly(dir, pub)
+		assert.ErrorIs(err, ErrNotApproved)
+		assert.ErrorIs(store.Export(&bytes.Buffer{}, testPassword, ExportOptions{}), ErrNotApproved)
+
+		edPub, _, err := ed25519.GenerateKey(rand.Reader)
+		assert.NoError(err)
+		sshPub, err := ssh.NewPublicKey(edPub)
+		assert.NoError(err)
+		assert.ErrorIs(store.AddKeySlot("alice", ssh.MarshalAuthorizedKey(sshPub)), ErrNotApproved)
+	})
+
+	// Test case 3: The mode survives reopening and changing the password
+	t.Run("Reopen", func(t *testing.T) {
+		newPassword := []byte("a-new-fips-password")
+		assert.NoError(store.Passwd(append([]byte{}, newPassword...)))
+		store.Close()
+
+		store, err = Open(dir, Password(newPassword))
+		assert.NoError(err)
+		assert.True(store.FIPS())
+		data, err := store.Load("secret")
+		assert.NoError(err)
+		assert.Equal([]byte("approved"), data)
+		slots, err := store.ListKeySlots()
+		assert.NoError(err)
+		assert.Equal("pbkdf2-hmac-sha256", slots[0].KDF)
+		assert.NoError(store.Rotate())
+	})
+	store.Close()
+
+	// Test case 4: A store that is not a FIPS store is refused in FIPS
+	// mode, and cannot be made one by adding the marker
+	t.Run("NotFIPSStore", func(t *testing.T) {
+		plain, err := NewStore(plainDir, testPassword)
+		assert.NoError(err)
+		assert.False(plain.FIPS())
+		plain.Close()
+
+		_, err = NewStore(plainDir, testPassword, WithFIPS())
+		assert.ErrorIs(err, ErrNotApproved)
+		assert.NoError(os.WriteFile(filepath.Join(plainDir, keyDirName, fipsFileName), []byte{fipsVersion}, 0600))
+		_, err = NewStore(plainDir, testPassword)
+		assert.ErrorIs(err, ErrNotApproved)
+	})
+
+	// Test case 5: Removing the marker is noticed
+	t.Run("Downgrade", func(t *testing.T) {
+		marker := filepath.Join(dir, keyDirName, fipsFileName)
+		assert.NoError(os.Remove(marker))
+		_, err := Open(dir, Password([]byte("a-new-fips-password")))
+		assert.ErrorIs(err, ErrTampered)
+
+		// Without PBKDF2 slots, the manifest gives it away.
+		assert.NoError(os.WriteFile(marker, []byte{fipsVersion}, 0600))
+		store, err := Open(dir, Password([]byte("a-new-fips-password")))
+		assert.NoError(err)
+		assert.NoError(GenerateKeyFile(keyPath))
+		key, err := os.ReadFile(keyPath)
+		assert.NoError(err)
+		assert.NoError(store.AddKeyFileSlot("ci", key))
+		for _, name := range []string{"default", "oncall", recoverySlotName} {
+			assert.NoError(store.RemoveKeySlot(name))
+		}
+		store.Close()
+
+		assert.NoError(os.Remove(marker))
+		_, err = Open(dir, KeyFile(keyPath))
+		assert.ErrorIs(err, ErrTampered)
+		assert.NoError(os.WriteFile(marker, []byte{fipsVersion}, 0600))
+		store, err = Open(dir, KeyFile(keyPath))
+		assert.NoError(err)
+		store.Close()
+	})
+}
+
+// TestFIPS140Only runs a FIPS store in a copy of the test binary with
+// GODEBUG=fips140=only, where Go fails every non-approved algorithm.
+func TestFIPS140Only(t *testing.T) {
+	assert := assert.New(t)
+
+	if os.Getenv("DARKSTORE_FIPS140_CHILD") == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestFIPS140Only$")
+		cmd.Env = append(os.Environ(), "GODEBUG=fips140=only", "DARKSTORE_FIPS140_CHILD=1")
+		out, err := cmd.CombinedOutput()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			t.Fatalf("fips140=only run failed:\n%s", out)
+		}
+		assert.NoError(err)
+		return
+	}
+
+	dir := filepath.Join(testStoreDir, "fips140_only")
+	defer os.RemoveAll(dir) //nolint: errcheck
+
+	assert.True(fips140.Enabled())
+	store, err := NewStore(dir, testPassword)
+	assert.NoError(err)
+	assert.True(store.FIPS(), "FIPS mode makes FIPS stores")
+	assert.NoError(store.Save("secret", []byte("only")))
+	assert.NoError(store.Rotate())
+	assert.NoError(store.Passwd(append([]byte{}, testPassword...)))
+	store.Close()
+
+	store, err = NewStore(dir, testPassword)
+	assert.NoError(err)
+	assert.NoError(store.CheckIntegrity())
+	data, err := store.Load("secret")
+	assert.NoError(err)
+	assert.Equal([]byte("only"), data)
+	store.Close()
+}
@@ -0,0 +1,62 @@
+package darkstore
+
+import (
+	"sync"
+)
+
+// Process hardening is shared by every store opened WithHardening: the
+// first one to open saves the process's settings and the last one to
+// close restores them.
+var (
+	hardenMu    sync.Mutex
+	hardenCount int
+	hardenSaved processState
+)
+
+// WithHardening has the store, while it is open, keep the process from
+// dumping core or being attached to with ptrace by other processes of
+// the same user.  On Linux this sets PR_SET_DUMPABLE to 0 and lowers
+// the RLIMIT_CORE soft limit to 0.  The previous settings are restored
+// when the last store opened with WithHardening is closed.  NewStore
+// and Open fail if the process cannot be hardened.
+func WithHardening() Option {
+	return func(o *options) {
+		o.harden = true
+	}
+}
+
+// harden hardens the process if the store was opened WithHardening.
+func (s *Store) harden() error {
+	if !s.opts.harden {
+		return nil
+	}
+	hardenMu.Lock()
+	defer hardenMu.Unlock()
+	if hardenCount == 0 {
+		saved, err := hardenProcess()
+		if err != nil {
+			return err
+		}
+		hardenSaved = saved
+	}
+	hardenCount++
+	s.hardened = true
+	return nil
+}
+
+// unharden undoes harden, restoring the process's settings once no
+// hardened store is left open.
+func (s *Store) unharden() {
+	if !s.hardened {
+		return
+	}
+	s.hardened = false
+	hardenMu.Lock()
+	defer hardenMu.Unlock()
+	hardenCount--
+	if hardenCount == 0 {
+		if err := restoreProcess(hardenSaved); err != nil {
+			s.debug("failed to restore process settings: %v", err)
+		}
+	}
+}
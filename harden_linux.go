@@ -0,0 +1,48 @@
+package darkstore
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// processState is what hardenProcess changes.
+type processState struct {
+	dumpable int
+	core     unix.Rlimit
+}
+
+// hardenProcess makes the process non-dumpable and stops it from
+// writing core files, and returns the settings it replaced.  Only the
+// soft core limit is lowered, so that it can be raised again.
+func hardenProcess() (processState, error) {
+	var saved processState
+	dumpable, err := unix.PrctlRetInt(unix.PR_GET_DUMPABLE, 0, 0, 0, 0)
+	if err != nil {
+		return saved, fmt.Errorf("failed to get dumpable flag: %w", err)
+	}
+	saved.dumpable = dumpable
+	if err = unix.Getrlimit(unix.RLIMIT_CORE, &saved.core); err != nil {
+		return saved, fmt.Errorf("failed to get core limit: %w", err)
+	}
+	if err = unix.Prctl(unix.PR_SET_DUMPABLE, 0, 0, 0, 0); err != nil {
+		return saved, fmt.Errorf("failed to clear dumpable flag: %w", err)
+	}
+	core := unix.Rlimit{Cur: 0, Max: saved.core.Max}
+	if err = unix.Setrlimit(unix.RLIMIT_CORE, &core); err != nil {
+		_ = unix.Prctl(unix.PR_SET_DUMPABLE, uintptr(dumpable), 0, 0, 0)
+		return saved, fmt.Errorf("failed to lower core limit: %w", err)
+	}
+	return saved, nil
+}
+
+// restoreProcess puts back the settings returned by hardenProcess.
+func restoreProcess(saved processState) error {
+	if err := unix.Setrlimit(unix.RLIMIT_CORE, &saved.core); err != nil {
+		return fmt.Errorf("failed to restore core limit: %w", err)
+	}
+	if err := unix.Prctl(unix.PR_SET_DUMPABLE, uintptr(saved.dumpable), 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to restore dumpable flag: %w", err)
+	}
+	return nil
+}
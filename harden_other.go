@@ -0,0 +1,17 @@
+//go:build !linux
+
+package darkstore
+
+import (
+	"errors"
+)
+
+// processState is what hardenProcess changes.
+type processState struct{}
+
+// hardenProcess fails where process hardening is not implemented.
+func hardenProcess() (processState, error) {
+	return processState{}, errors.New("process hardening is only supported on linux")
+}
+
+func restoreProcess(saved processState) error { return nil }
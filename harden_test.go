@@ -0,0 +1,89 @@
+package darkstore
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestStore_Hardening(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := filepath.Join(testStoreDir, "hardening")
+	defer os.RemoveAll(dir) //nolint: errcheck
+
+	// Allow core files, so that lowering the limit shows.
+	var saved unix.Rlimit
+	assert.NoError(unix.Getrlimit(unix.RLIMIT_CORE, &saved))
+	defer unix.Setrlimit(unix.RLIMIT_CORE, &saved) //nolint: errcheck
+	assert.NoError(unix.Setrlimit(unix.RLIMIT_CORE,
+		&unix.Rlimit{Cur: min(1<<20, saved.Max), Max: saved.Max}))
+	before := coreLimit(t)
+	assert.NotEqual("0", before)
+	assert.Equal(1, dumpable(t))
+
+	// Test case 1: Stores opened without WithHardening change nothing
+	t.Run("Off", func(t *testing.T) {
+		store, err := NewStore(dir, testPassword)
+		assert.NoError(err)
+		assert.Equal(before, coreLimit(t))
+		assert.Equal(1, dumpable(t))
+		store.Close()
+	})
+
+	// Test case 2: Hardening lasts until the last hardened store closes
+	t.Run("RefCount", func(t *testing.T) {
+		first, err := NewStore(dir, testPassword, WithHardening())
+		assert.NoError(err)
+		assert.Equal("0", coreLimit(t))
+		assert.Equal(0, dumpable(t))
+
+		second, err := Open(dir, Password(testPassword), WithHardening())
+		assert.NoError(err)
+		first.Close()
+		first.Close()
+		assert.Equal("0", coreLimit(t))
+		assert.Equal(0, dumpable(t))
+
+		second.Close()
+		assert.Equal(before, coreLimit(t))
+		assert.Equal(1, dumpable(t))
+	})
+
+	// Test case 3: A failed open does not leave the process hardened
+	t.Run("Failed", func(t *testing.T) {
+		_, err := NewStore(dir, []byte("wrong"), WithHardening())
+		assert.Error(err)
+		assert.Equal(before, coreLimit(t))
+		assert.Equal(1, dumpable(t))
+	})
+}
+
+// coreLimit returns the soft core file size limit shown in
+// /proc/self/limits.
+func coreLimit(t *testing.T) string {
+	data, err := os.ReadFile("/proc/self/limits")
+	if err != nil {
+		t.Skip("no /proc/self/limits")
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if rest, ok := strings.CutPrefix(line, "Max core file size"); ok {
+			return strings.Fields(rest)[0]
+		}
+	}
+	t.Fatal("no core limit in /proc/self/limits")
+	return ""
+}
+
+// dumpable returns the process's PR_GET_DUMPABLE flag.
+func dumpable(t *testing.T) int {
+	d, err := unix.PrctlRetInt(unix.PR_GET_DUMPABLE, 0, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("failed to get dumpable flag: %v", err)
+	}
+	return d
+}
@@ -0,0 +1,109 @@
+// Package hsm wraps darkstore data keys with an AES key that never
+// leaves a PKCS#11 token, such as an HSM or SoftHSM.
+//
+// The library does not link a PKCS#11 module itself.  Token is the
+// small part of a PKCS#11 session the wrapper needs; implement it over
+// a PKCS#11 binding, such as github.com/miekg/pkcs11, with:
+//   - FindKey: C_FindObjectsInit with CKA_CLASS = CKO_SECRET_KEY,
+//     CKA_KEY_TYPE = CKK_AES and CKA_LABEL, then C_FindObjects.
+//   - Encrypt: C_EncryptInit with CKM_AES_GCM and CK_GCM_PARAMS holding
+//     the IV, the additional data and a 128-bit tag, then C_Encrypt.
+//   - Decrypt: the same with C_DecryptInit and C_Decrypt.
+//
+// The AES key should be generated on the token with CKA_SENSITIVE set
+// and CKA_EXTRACTABLE clear, so that it cannot be read out.  SoftToken
+// is an in-process Token with those semantics for tests.
+package hsm
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+const (
+	wrapVersion = 1
+	ivLen       = 12
+)
+
+// Errors returned by tokens, after the PKCS#11 return values.
+var (
+	ErrKeyNotFound   = errors.New("hsm: key not found")             // No object matched
+	ErrNotLoggedIn   = errors.New("hsm: user not logged in")        // CKR_USER_NOT_LOGGED_IN
+	ErrPINIncorrect  = errors.New("hsm: PIN incorrect")             // CKR_PIN_INCORRECT
+	ErrSensitive     = errors.New("hsm: attribute is sensitive")    // CKR_ATTRIBUTE_SENSITIVE
+	ErrInvalidHandle = errors.New("hsm: object handle is invalid")  // CKR_OBJECT_HANDLE_INVALID
+	ErrEncrypted     = errors.New("hsm: encrypted data is invalid") // CKR_ENCRYPTED_DATA_INVALID
+	ErrKeyExists     = errors.New("hsm: key with label exists")     // Duplicate CKA_LABEL
+)
+
+// ObjectHandle identifies an object on a token, like CK_OBJECT_HANDLE.
+type ObjectHandle uint
+
+// Token is a logged-in session with a PKCS#11 token.
+type Token interface {
+	// FindKey returns the handle of the AES secret key labeled label.
+	FindKey(label string) (ObjectHandle, error)
+	// Encrypt encrypts plaintext with CKM_AES_GCM under key, returning
+	// the ciphertext followed by the tag.
+	Encrypt(key ObjectHandle, iv, aad, plaintext []byte) ([]byte, error)
+	// Decrypt reverses Encrypt, failing if the tag does not match.
+	Decrypt(key ObjectHandle, iv, aad, ciphertext []byte) ([]byte, error)
+}
+
+// Wrapper is a darkstore.KeyWrapper that wraps keys on a Token.
+type Wrapper struct {
+	token  Token
+	handle ObjectHandle
+	id     string
+}
+
+// New returns a Wrapper using the AES key labeled label on token.  Its
+// KeyID is "pkcs11:" followed by the label, so the label must not
+// change while any store uses it.
+func New(token Token, label string) (*Wrapper, error) {
+	if label == "" {
+		return nil, fmt.Errorf("hsm: key label must not be empty")
+	}
+	handle, err := token.FindKey(label)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find key %s: %w", label, err)
+	}
+	return &Wrapper{token: token, handle: handle, id: "pkcs11:" + label}, nil
+}
+
+// KeyID returns "pkcs11:" and the key's label.
+func (w *Wrapper) KeyID() string { return w.id }
+
+// Wrap encrypts key on the token with AES-GCM and a random IV, with the
+// KeyID as additional data.  The result is a version byte, the IV, and
+// the ciphertext and tag.
+func (w *Wrapper) Wrap(key []byte) ([]byte, error) {
+	iv := make([]byte, ivLen)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, fmt.Errorf("failed to generate IV: %w", err)
+	}
+	ct, err := w.token.Encrypt(w.handle, iv, []byte(w.id), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap key: %w", err)
+	}
+	out := make([]byte, 0, 1+ivLen+len(ct))
+	out = append(out, wrapVersion)
+	out = append(out, iv...)
+	return append(out, ct...), nil
+}
+
+// Unwrap decrypts a key wrapped by Wrap on the token.
+func (w *Wrapper) Unwrap(wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 1+ivLen {
+		return nil, fmt.Errorf("wrapped key is too short")
+	}
+	if wrapped[0] != wrapVersion {
+		return nil, fmt.Errorf("unsupported wrapped key version: %d", wrapped[0])
+	}
+	key, err := w.token.Decrypt(w.handle, wrapped[1:1+ivLen], []byte(w.id), wrapped[1+ivLen:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap key: %w", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,150 @@
+package hsm
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kenm928/darkstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSoftToken(t *testing.T) {
+	assert := assert.New(t)
+
+	token := NewSoftToken([]byte("1234"))
+	_, err := token.GenerateKey("kek")
+	assert.True(errors.Is(err, ErrNotLoggedIn))
+	assert.True(errors.Is(token.Login([]byte("0000")), ErrPINIncorrect))
+	assert.NoError(token.Login([]byte("1234")))
+
+	h, err := token.GenerateKey("kek")
+	assert.NoError(err)
+	_, err = token.GenerateKey("kek")
+	assert.True(errors.Is(err, ErrKeyExists))
+	_, err = token.KeyValue(h)
+	assert.True(errors.Is(err, ErrSensitive), "keys are not extractable")
+
+	found, err := token.FindKey("kek")
+	assert.NoError(err)
+	assert.Equal(h, found)
+	_, err = token.FindKey("other")
+	assert.True(errors.Is(err, ErrKeyNotFound))
+
+	token.Logout()
+	_, err = token.Encrypt(h, make([]byte, ivLen), nil, []byte("x"))
+	assert.True(errors.Is(err, ErrNotLoggedIn))
+}
+
+// logoutToken is a SoftToken that logs out once it has wrapped a key
+// after logoutAfterWrap is set, as if the session ended mid-rotation.
+// It counts the failed decrypts.
+type logoutToken struct {
+	*SoftToken
+	logoutAfterWrap bool
+	failed          atomic.Int32
+}
+
+func (t *logoutToken) Encrypt(key ObjectHandle, iv, aad, plaintext []byte) ([]byte, error) {
+	ct, err := t.SoftToken.Encrypt(key, iv, aad, plaintext)
+	if t.logoutAfterWrap {
+		t.Logout()
+	}
+	return ct, err
+}
+
+func (t *logoutToken) Decrypt(key ObjectHandle, iv, aad, ciphertext []byte) ([]byte, error) {
+	pt, err := t.SoftToken.Decrypt(key, iv, aad, ciphertext)
+	if err != nil {
+		t.failed.Add(1)
+	}
+	return pt, err
+}
+
+func TestWrapper(t *testing.T) {
+	assert := assert.New(t)
+
+	token := NewSoftToken([]byte("1234"))
+	assert.NoError(token.Login([]byte("1234")))
+	_, err := token.GenerateKey("darkstore-kek")
+	assert.NoError(err)
+	w, err := New(token, "darkstore-kek")
+	assert.NoError(err)
+	assert.Equal("pkcs11:darkstore-kek", w.KeyID())
+	_, err = New(token, "missing")
+	assert.Error(err)
+
+	// Test case 1: Wrap and unwrap
+	t.Run("Wrap", func(t *testing.T) {
+		key := []byte("0123456789abcdef0123456789abcdef")
+		wrapped, err := w.Wrap(key)
+		assert.NoError(err)
+		unwrapped, err := w.Unwrap(wrapped)
+		assert.NoError(err)
+		assert.Equal(key, unwrapped)
+
+		wrapped[len(wrapped)-1] ^= 1
+		_, err = w.Unwrap(wrapped)
+		assert.True(errors.Is(err, ErrEncrypted), "got %v", err)
+		_, err = w.Unwrap(wrapped[:5])
+		assert.Error(err)
+	})
+
+	// Test case 2: A store whose data keys are wrapped on the token
+	t.Run("Store", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "store")
+		password := []byte("password")
+		store, err := darkstore.NewStore(dir, password, darkstore.WithKeyWrapper(w))
+		assert.NoError(err)
+		assert.NoError(store.Save("secret", []byte("hsm protected")))
+		store.Close()
+
+		store, err = darkstore.NewStore(dir, password, darkstore.WithKeyWrapper(w))
+		assert.NoError(err)
+		data, err := store.Load("secret")
+		assert.NoError(err)
+		assert.Equal([]byte("hsm protected"), data)
+		store.Close()
+
+		token.Logout()
+		_, err = darkstore.NewStore(dir, password, darkstore.WithKeyWrapper(w))
+		assert.True(errors.Is(err, ErrNotLoggedIn), "got %v", err)
+		assert.NoError(token.Login([]byte("1234")))
+	})
+
+	// Test case 3: Secrets survive a rotation while logged out
+	t.Run("Rotate logged out", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "store")
+		password := []byte("password")
+		lt := &logoutToken{SoftToken: token}
+		lw, err := New(lt, "darkstore-kek")
+		assert.NoError(err)
+
+		store, err := darkstore.NewStore(dir, password)
+		assert.NoError(err)
+		for i := range 5 {
+			assert.NoError(store.Save(fmt.Sprintf("secret%d", i), []byte("hsm protected")))
+		}
+		assert.NoError(store.SetKeyWrapper(lw))
+		lt.logoutAfterWrap = true
+		assert.NoError(store.Rotate())
+		// Every secret needs the old key, which the token won't unwrap.
+		assert.Eventually(func() bool { return lt.failed.Load() >= 5 },
+			5*time.Second, 10*time.Millisecond)
+		store.Close()
+
+		lt.logoutAfterWrap = false
+		assert.NoError(token.Login([]byte("1234")))
+		store, err = darkstore.NewStore(dir, password, darkstore.WithKeyWrapper(lw))
+		assert.NoError(err)
+		for i := range 5 {
+			data, err := store.Load(fmt.Sprintf("secret%d", i))
+			assert.NoError(err)
+			assert.Equal([]byte("hsm protected"), data)
+		}
+		store.Close()
+	})
+}
@@ -0,0 +1,171 @@
+package hsm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"sync"
+
+	"github.com/kenm928/darkstore"
+)
+
+// SoftToken is an in-process Token for tests, in the manner of SoftHSM.
+// Its keys are generated inside it and cannot be read out, it must be
+// logged in to with its PIN before use, and everything is lost when it
+// is garbage collected.
+type SoftToken struct {
+	mu       sync.Mutex
+	pin      []byte
+	loggedIn bool
+	next     ObjectHandle
+	keys     map[ObjectHandle]*softKey
+}
+
+// softKey is a sensitive, non-extractable AES-256 key.
+type softKey struct {
+	label string
+	aead  cipher.AEAD
+}
+
+// NewSoftToken returns an empty token with the user PIN pin.
+func NewSoftToken(pin []byte) *SoftToken {
+	return &SoftToken{
+		pin:  append([]byte{}, pin...),
+		next: 1,
+		keys: make(map[ObjectHandle]*softKey),
+	}
+}
+
+// Login logs the user in, like C_Login with CKU_USER.
+func (t *SoftToken) Login(pin []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if subtle.ConstantTimeCompare(pin, t.pin) != 1 {
+		return ErrPINIncorrect
+	}
+	t.loggedIn = true
+	return nil
+}
+
+// Logout logs the user out, like C_Logout.
+func (t *SoftToken) Logout() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.loggedIn = false
+}
+
+// GenerateKey generates an AES-256 key labeled label on the token, like
+// C_GenerateKey with CKM_AES_KEY_GEN, CKA_SENSITIVE and without
+// CKA_EXTRACTABLE.
+func (t *SoftToken) GenerateKey(label string) (ObjectHandle, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.loggedIn {
+		return 0, ErrNotLoggedIn
+	}
+	for _, k := range t.keys {
+		if k.label == label {
+			return 0, ErrKeyExists
+		}
+	}
+	raw := make([]byte, 32)
+	defer darkstore.Wipe(raw)
+	if _, err := rand.Read(raw); err != nil {
+		return 0, err
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return 0, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return 0, err
+	}
+	h := t.next
+	t.next++
+	t.keys[h] = &softKey{label: label, aead: aead}
+	return h, nil
+}
+
+// KeyValue always fails: the key is sensitive, as C_GetAttributeValue
+// of CKA_VALUE would.
+func (t *SoftToken) KeyValue(h ObjectHandle) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.keys[h]; !ok {
+		return nil, ErrInvalidHandle
+	}
+	return nil, ErrSensitive
+}
+
+// DestroyKey removes a key from the token, like C_DestroyObject.
+func (t *SoftToken) DestroyKey(h ObjectHandle) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.loggedIn {
+		return ErrNotLoggedIn
+	}
+	if _, ok := t.keys[h]; !ok {
+		return ErrInvalidHandle
+	}
+	delete(t.keys, h)
+	return nil
+}
+
+// FindKey implements Token.
+func (t *SoftToken) FindKey(label string) (ObjectHandle, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.loggedIn {
+		return 0, ErrNotLoggedIn
+	}
+	for h, k := range t.keys {
+		if k.label == label {
+			return h, nil
+		}
+	}
+	return 0, ErrKeyNotFound
+}
+
+// key returns the key for h if the user is logged in.
+func (t *SoftToken) key(h ObjectHandle) (*softKey, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.loggedIn {
+		return nil, ErrNotLoggedIn
+	}
+	k, ok := t.keys[h]
+	if !ok {
+		return nil, ErrInvalidHandle
+	}
+	return k, nil
+}
+
+// Encrypt implements Token.
+func (t *SoftToken) Encrypt(h ObjectHandle, iv, aad, plaintext []byte) ([]byte, error) {
+	k, err := t.key(h)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != k.aead.NonceSize() {
+		return nil, ErrEncrypted
+	}
+	return k.aead.Seal(nil, iv, plaintext, aad), nil
+}
+
+// Decrypt implements Token.
+func (t *SoftToken) Decrypt(h ObjectHandle, iv, aad, ciphertext []byte) ([]byte, error) {
+	k, err := t.key(h)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != k.aead.NonceSize() {
+		return nil, ErrEncrypted
+	}
+	plaintext, err := k.aead.Open(nil, iv, ciphertext, aad)
+	if err != nil {
+		return nil, ErrEncrypted
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,135 @@
+package darkstore
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrLocked is returned once a store opened WithIdleTimeout has locked
+// itself after being idle.  Call Unlock to use it again.
+var ErrLocked = errors.New("store is locked, unlock it")
+
+// WithIdleTimeout has the store lock itself once none of its methods
+// has been called for d.  Locking wipes the keys from memory, as Close
+// does, but the Store can be unlocked again with Unlock.  Until then,
+// methods that need the keys return ErrLocked.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.idleTimeout = d
+	}
+}
+
+// checkLocked returns ErrLocked while the store is locked, and
+// otherwise counts as use of the store.
+func (s *Store) checkLocked() error {
+	if s.isLocked() {
+		return ErrLocked
+	}
+	s.lastUse.Store(time.Now().UnixNano())
+	return nil
+}
+
+// isLocked reports whether the store locked itself after being idle.
+func (s *Store) isLocked() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.locked
+}
+
+// startIdleWatch starts the goroutine that locks the store when it is
+// idle, if the store was opened WithIdleTimeout.
+func (s *Store) startIdleWatch() {
+	if s.opts.idleTimeout <= 0 {
+		return
+	}
+	s.lastUse.Store(time.Now().UnixNano())
+	s.goBackground(s.idleWatch)
+}
+
+// idleWatch locks the store whenever it has not been used for the idle
+// timeout.
+func (s *Store) idleWatch() {
+	timeout := s.opts.idleTimeout
+	ticker := time.NewTicker(max(timeout/4, time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopChan:
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, s.lastUse.Load())) >= timeout {
+				s.lockIdle()
+			}
+		}
+	}
+}
+
+// lockIdle wipes the keys and locks the store.
+func (s *Store) lockIdle() {
+	s.mu.Lock()
+	if s.closed || s.locked {
+		s.mu.Unlock()
+		return
+	}
+	s.wipeKeys()
+	s.locked = true
+	s.mu.Unlock()
+	s.debug("store locked after being idle")
+	s.emit(IdleLocked)
+}
+
+// wipeKeys wipes and drops the master key and current key.  The caller
+// must hold s.mu.
+func (s *Store) wipeKeys() {
+	releaseKey(s.primaryBuf, s.primaryKey)
+	releaseKey(s.currentBuf, s.currentKey)
+	s.primaryBuf, s.primaryKey = nil, nil
+	s.currentBuf, s.currentKey = nil, nil
+}
+
+// Unlock unlocks a store that locked itself after being idle, with a
+// credential for any of its key slots, and reloads its keys.  The Store
+// and its watcher carry on as before.  Unlock does nothing if the store
+// is not locked.
+func (s *Store) Unlock(u Unlocker) error {
+	if s == nil {
+		return fmt.Errorf("no store")
+	}
+	if err := s.checkClosed(); err != nil {
+		return err
+	}
+	if !s.isLocked() {
+		return nil
+	}
+	if pw, ok := u.(*passwordUnlocker); ok {
+		defer pw.done()
+	}
+
+	err := s.throttled(func() error {
+		lk, err := s.rLock(s.lockFile)
+		if err != nil {
+			return fmt.Errorf("error locking %s: %w", s.keyDir, err)
+		}
+		defer lk.unlock()
+
+		err = u.unlockStore(s)
+		if err == nil {
+			err = s.checkKeyWrapper()
+		}
+		if err == nil {
+			err = s.loadCurrentKey()
+		}
+		return err
+	})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.wipeKeys()
+		return err
+	}
+	s.locked = false
+	s.lastUse.Store(time.Now().UnixNano())
+	s.emit(Unlocked)
+	return nil
+}
@@ -0,0 +1,72 @@
+package darkstore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_IdleTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := filepath.Join(testStoreDir, "idle_timeout")
+	defer os.RemoveAll(dir) //nolint: errcheck
+
+	store, err := NewStore(dir, testPassword, WithIdleTimeout(50*time.Millisecond))
+	assert.NoError(err)
+	defer store.Close()
+	assert.NoError(store.Save("secret", []byte("idle data")))
+
+	// Test case 1: The store locks itself and wipes its keys when idle
+	t.Run("Lock", func(t *testing.T) {
+		assert.Eventually(store.isLocked, time.Second, 5*time.Millisecond)
+		assert.Equal(IdleLocked, waitForEvent(store, Rotated))
+		store.mu.RLock()
+		assert.Nil(store.primaryKey)
+		assert.Nil(store.currentKey)
+		store.mu.RUnlock()
+
+		_, err := store.Load("secret")
+		assert.ErrorIs(err, ErrLocked)
+		assert.ErrorIs(store.Save("secret", []byte("more")), ErrLocked)
+		assert.ErrorIs(store.Rotate(), ErrLocked)
+		assert.ErrorIs(store.Passwd([]byte("new")), ErrLocked)
+	})
+
+	// Test case 2: A wrong credential leaves it locked
+	t.Run("WrongPassword", func(t *testing.T) {
+		assert.Error(store.Unlock(Password([]byte("wrong"))))
+		assert.True(store.isLocked())
+		assert.False(store.hasMaster())
+	})
+
+	// Test case 3: Unlock makes the same Store usable again
+	t.Run("Unlock", func(t *testing.T) {
+		assert.NoError(store.Unlock(Password(testPassword)))
+		assert.Equal(Unlocked, waitForEvent(store, Rotated))
+		data, err := store.Load("secret")
+		assert.NoError(err)
+		assert.Equal([]byte("idle data"), data)
+		assert.True(store.Health().Running)
+		assert.NoError(store.Unlock(Password([]byte("ignored"))))
+	})
+
+	// Test case 4: Use keeps the store from locking
+	t.Run("Use", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			_, err := store.Load("secret")
+			assert.NoError(err)
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.False(store.isLocked())
+	})
+
+	// Test case 5: Unlock after Close
+	t.Run("Closed", func(t *testing.T) {
+		store.Close()
+		assert.ErrorIs(store.Unlock(Password(testPassword)), ErrClosed)
+	})
+}
@@ -35,3 +35,39 @@ func (s *Store) writeFile(path string, data []byte) error {
 
 	return os.WriteFile(path, data, s.filePerm)
 }
+
+// touchFile creates an empty file at path if it does not already exist.
+func (s *Store) touchFile(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, s.filePerm)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// syncWrite writes data to a new file at path and flushes it to stable
+// storage before returning.
+func (s *Store) syncWrite(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, s.filePerm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// syncDir flushes directory entries in dir to stable storage.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close() //nolint: errcheck
+	return d.Sync()
+}
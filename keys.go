@@ -0,0 +1,172 @@
+package darkstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+)
+
+// The keys and the other state that Rotate, Passwd and the rotation
+// watcher change after the store is opened are read and replaced under
+// s.mu, so that a Store can be used from many goroutines.  File locks
+// keep processes apart, but not the goroutines of one process.  The
+// keys are kept in LockedBuffers, and handed out as copies in
+// LockedBuffers, so that a replaced key can be destroyed at once.
+
+// master returns a copy of the master key, or nil if the store has
+// none, as for stores from OpenWriteOnly.  The caller must Destroy it.
+func (s *Store) master() *LockedBuffer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.primaryKey) == 0 {
+		return nil
+	}
+	return lockedCopy(s.primaryKey)
+}
+
+// hasMaster reports whether the store has its master key.
+func (s *Store) hasMaster() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.primaryKey) != 0
+}
+
+// checkMaster returns ErrWriteOnly or ErrLocked if the store does not
+// have its master key.
+func (s *Store) checkMaster() error {
+	if s.hasMaster() {
+		return nil
+	}
+	if s.writeOnly != nil {
+		return ErrWriteOnly
+	}
+	return ErrLocked
+}
+
+// setMaster replaces the master key and the name of the slot it came
+// from.  It keeps a copy of key in a LockedBuffer, and wipes key and
+// the old master key.
+func (s *Store) setMaster(key []byte, slotName string) {
+	buf := lockedCopy(key)
+	Wipe(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	releaseKey(s.primaryBuf, s.primaryKey)
+	s.primaryBuf = buf
+	s.primaryKey = buf.Bytes()
+	s.slotName = slotName
+}
+
+// releaseKey wipes key and destroys the buffer it is kept in.
+func releaseKey(buf *LockedBuffer, key []byte) {
+	Wipe(key)
+	buf.Destroy()
+}
+
+// unlockedSlot returns the name of the slot the store was unlocked with.
+func (s *Store) unlockedSlot() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.slotName
+}
+
+// currentAEAD returns an AES-GCM cipher with the current data key, and
+// the key's index.
+func (s *Store) currentAEAD() (cipher.AEAD, uint8, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, 0, ErrClosed
+	}
+	if s.locked {
+		return nil, 0, ErrLocked
+	}
+	if len(s.currentKey) == 0 {
+		return nil, 0, fmt.Errorf("store has no current key")
+	}
+	gcm, err := newAEAD(s.currentKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	return gcm, s.currentKeyIndex, nil
+}
+
+// newAEAD returns an AES-GCM cipher with key.  It makes a random nonce
+// for each Seal and prepends it to the ciphertext, which is the only
+// way Go's FIPS 140-3 module allows GCM to be used.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCMWithRandomNonce(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return gcm, nil
+}
+
+// keyIndex returns the index of the current data key.
+func (s *Store) keyIndex() uint8 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.currentKeyIndex
+}
+
+// setCurrentKey replaces the current data key.  It keeps a copy of key
+// in a LockedBuffer, and wipes key and the old data key.
+func (s *Store) setCurrentKey(key []byte, index uint8) {
+	buf := lockedCopy(key)
+	Wipe(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	releaseKey(s.currentBuf, s.currentKey)
+	s.currentBuf = buf
+	s.currentKey = buf.Bytes()
+	s.currentKeyIndex = index
+}
+
+// wrapper returns the KeyWrapper set with WithKeyWrapper, SetKeyWrapper
+// or a KMS unlocker, or nil.
+func (s *Store) wrapper() KeyWrapper {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.opts.wrapper
+}
+
+// setWrapper replaces the store's KeyWrapper.
+func (s *Store) setWrapper(w KeyWrapper) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.opts.wrapper = w
+}
+
+// keyWrapper returns the key wrapper for the store's data keys, and a
+// function to call when done with it.
+func (s *Store) keyWrapper() (KeyWrapper, func()) {
+	if w := s.wrapper(); w != nil {
+		return w, func() {}
+	}
+	key := s.master()
+	return masterKeyWrapper{key.Bytes()}, key.Destroy
+}
+
+// seeGeneration records that the manifest generation gen was read or
+// written, failing with ErrRollback if a newer one was seen before.
+func (s *Store) seeGeneration(gen uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if gen < s.manifestGen {
+		return fmt.Errorf("manifest generation %d older than %d: %w",
+			gen, s.manifestGen, ErrRollback)
+	}
+	s.manifestGen = gen
+	return nil
+}
+
+// generation returns the newest manifest generation seen.
+func (s *Store) generation() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.manifestGen
+}
@@ -0,0 +1,96 @@
+package darkstore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestStore_Concurrent runs Save, Load, Rotate and Passwd on one Store
+// from many goroutines.  Run it with -race.
+func TestStore_Concurrent(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := filepath.Join(testStoreDir, "concurrent")
+	defer os.RemoveAll(dir) //nolint: errcheck
+
+	store, err := NewStore(dir, testPassword)
+	assert.NoError(err)
+
+	const workers, rounds = 8, 20
+	var wg sync.WaitGroup
+	for g := 0; g < workers; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				path := fmt.Sprintf("worker%d/secret%d", g, i%4)
+				value := []byte(fmt.Sprintf("value %d %d", g, i))
+				if !assert.NoError(store.Save(path, value)) {
+					return
+				}
+				data, err := store.Load(path)
+				assert.NoError(err)
+				assert.Equal(value, data)
+			}
+		}(g)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 4; i++ {
+			assert.NoError(store.Rotate())
+		}
+	}()
+
+	passwords := [][]byte{[]byte("first"), []byte("second"), []byte("third")}
+	var password []byte
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, pw := range passwords {
+			// Passwd does not wait for a rotation to let go of the keys.
+			err := store.Passwd(append([]byte{}, pw...))
+			for errors.Is(err, syscall.EAGAIN) {
+				err = store.Passwd(append([]byte{}, pw...))
+			}
+			if assert.NoError(err) {
+				password = pw
+			}
+		}
+	}()
+	wg.Wait()
+	store.Close()
+
+	// Everything saved last is there after reopening.
+	store, err = NewStore(dir, password)
+	assert.NoError(err)
+	defer store.Close()
+	for g := 0; g < workers; g++ {
+		for i := rounds - 4; i < rounds; i++ {
+			data, err := store.Load(fmt.Sprintf("worker%d/secret%d", g, i%4))
+			assert.NoError(err)
+			assert.Equal([]byte(fmt.Sprintf("value %d %d", g, i)), data)
+		}
+	}
+}
+
+func TestStore_checkMaster(t *testing.T) {
+	assert := assert.New(t)
+
+	// Test case 1: A store without its master key says why
+	t.Run("No master key", func(t *testing.T) {
+		store := &Store{}
+		assert.ErrorIs(store.checkMaster(), ErrLocked)
+		assert.ErrorIs(store.AddKeySlot("other", testPassword), ErrLocked)
+		store.writeOnly = []byte("public key")
+		assert.ErrorIs(store.checkMaster(), ErrWriteOnly)
+	})
+}
@@ -0,0 +1,607 @@
+package darkstore
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	slotsDirName    = "slots"
+	defaultSlotName = "default"
+	maxSlotNameLen  = 64
+	masterKeyLen    = 32
+
+	// Key slot format version
+	slotVersion = 1
+
+	// Key slot types
+	slotTypePassword = 0
+	slotTypeRecovery = 1
+	slotTypeShamir   = 2
+	slotTypeKey      = 3
+	slotTypeX25519   = 4
+	slotTypeSSH      = 5
+	slotTypeKMS      = 6
+
+	// Key derivation functions
+	kdfArgon2id = 0
+	kdfNone     = 1 // The credential is the key.
+	kdfX25519   = 2 // X25519 and HKDF-SHA256 to a public key.
+	kdfExternal = 3 // Wrapped by a KeyWrapper.
+	kdfPBKDF2   = 4 // PBKDF2-HMAC-SHA256, for FIPS stores.
+)
+
+// ErrNoMatchingSlot is returned when a credential does not unlock any
+// of a store's key slots.
+var ErrNoMatchingSlot = errors.New("credential does not match any key slot")
+
+// KeySlotInfo describes a key slot without revealing anything secret.
+type KeySlotInfo struct {
+	Name        string
+	Type        string // "password", "recovery", "shamir", "key", "recipient", "ssh" or "kms"
+	KDF         string
+	Time        uint32 // Argon2id or PBKDF2 iterations
+	Memory      uint32 // Argon2id memory in KiB
+	Threads     uint8  // Argon2id parallelism
+	Threshold   int    // Shares needed to unlock a Shamir slot
+	Shares      int    // Shares handed out for a Shamir slot
+	Fingerprint string // SHA256 fingerprint of an SSH slot's key
+	KeyID       string // Key wrapper of a KMS slot
+}
+
+// keySlot holds the store's master key wrapped under a key derived
+// from one credential.  Each slot has its own salt and KDF parameters,
+// so slots can be added, removed and changed independently without
+// touching the key files, which are wrapped under the master key.
+type keySlot struct {
+	name    string
+	kind    uint8
+	kdf     uint8
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    []byte // For Shamir slots, the share set ID, threshold and count.
+	wrapped []byte // Output of encryptKey.
+}
+
+// newPasswordSlot wraps masterKey under a key derived from password
+// with a fresh salt and the default parameters of kdf, which is
+// kdfArgon2id or kdfPBKDF2.
+func newPasswordSlot(name string, password, masterKey []byte, kdf uint8) (*keySlot, error) {
+	if len(password) == 0 {
+		return nil, fmt.Errorf("password must not be empty")
+	}
+	return newDerivedSlot(name, slotTypePassword, password, masterKey, kdf)
+}
+
+// newDerivedSlot wraps masterKey in a slot of the given kind under a
+// key derived from secret with kdf.
+func newDerivedSlot(name string, kind uint8, secret, masterKey []byte, kdf uint8) (*keySlot, error) {
+	if err := checkSlotName(name); err != nil {
+		return nil, err
+	}
+	salt, err := generateSalt()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate random salt: %w", err)
+	}
+	ks := &keySlot{name: name, kind: kind, kdf: kdf, salt: salt}
+	if kdf == kdfPBKDF2 {
+		ks.time = pbkdf2Iterations
+	} else {
+		ks.time, ks.memory, ks.threads = argon2Time, argon2Memory, argon2Threads
+	}
+	kek, err := ks.deriveKey(secret)
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(kek)
+	ks.wrapped, err = encryptKey(masterKey, kek)
+	if err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// unwrap returns the master key if secret is the slot's credential.
+func (ks *keySlot) unwrap(secret []byte) ([]byte, error) {
+	if ks.kdf == kdfNone {
+		return decryptKey(ks.wrapped, secret)
+	}
+	kek, err := ks.deriveKey(secret)
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(kek)
+	return decryptKey(ks.wrapped, kek)
+}
+
+// deriveKey derives the key that wraps the master key from secret with
+// the slot's KDF.
+func (ks *keySlot) deriveKey(secret []byte) ([]byte, error) {
+	if ks.kdf == kdfPBKDF2 {
+		return deriveKeyPBKDF2(secret, ks.salt, ks.time)
+	}
+	return deriveKeyWithParams(secret, ks.salt, ks.time, ks.memory, ks.threads)
+}
+
+// marshal serializes the slot as a version byte, the slot type, the
+// KDF, its parameters, a one-byte salt length and the salt, followed
+// by the wrapped master key.  Slots without a KDF have zero
+// parameters.  The slot's name is its file name.
+func (ks *keySlot) marshal() []byte {
+	data := []byte{slotVersion, ks.kind, ks.kdf}
+	data = binary.BigEndian.AppendUint32(data, ks.time)
+	data = binary.BigEndian.AppendUint32(data, ks.memory)
+	data = append(data, ks.threads, uint8(len(ks.salt)))
+	data = append(data, ks.salt...)
+	return append(data, ks.wrapped...)
+}
+
+// parseKeySlot parses a slot written by marshal.
+func parseKeySlot(name string, data []byte) (*keySlot, error) {
+	const fixedLen = 13
+	if len(data) < fixedLen {
+		return nil, fmt.Errorf("invalid key slot %s", name)
+	}
+	if data[0] != slotVersion {
+		return nil, fmt.Errorf("unsupported key slot version: %d", data[0])
+	}
+	ks := &keySlot{
+		name:    name,
+		kind:    data[1],
+		kdf:     data[2],
+		time:    binary.BigEndian.Uint32(data[3:7]),
+		memory:  binary.BigEndian.Uint32(data[7:11]),
+		threads: data[11],
+	}
+	switch {
+	case ks.kind == slotTypeShamir && ks.kdf == kdfNone:
+	case ks.kind == slotTypeKey && ks.kdf == kdfNone:
+	case ks.kind == slotTypePassword && ks.kdf == kdfArgon2id:
+	case ks.kind == slotTypeRecovery && ks.kdf == kdfArgon2id:
+	case ks.kind == slotTypePassword && ks.kdf == kdfPBKDF2 && ks.time > 0:
+	case ks.kind == slotTypeRecovery && ks.kdf == kdfPBKDF2 && ks.time > 0:
+	case ks.kind == slotTypeX25519 && ks.kdf == kdfX25519:
+	case ks.kind == slotTypeSSH && ks.kdf == kdfX25519:
+	case ks.kind == slotTypeKMS && ks.kdf == kdfExternal:
+	default:
+		return nil, fmt.Errorf("unsupported key slot type %d with key derivation function %d",
+			ks.kind, ks.kdf)
+	}
+	saltLen := int(data[12])
+	if len(data) < fixedLen+saltLen {
+		return nil, fmt.Errorf("invalid key slot %s", name)
+	}
+	if ks.kind == slotTypeShamir && saltLen != shareSetIDLen+2 {
+		return nil, fmt.Errorf("invalid key slot %s", name)
+	}
+	if ks.kind == slotTypeX25519 && saltLen != x25519KeyLen {
+		return nil, fmt.Errorf("invalid key slot %s", name)
+	}
+	if ks.kind == slotTypeSSH && saltLen != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid key slot %s", name)
+	}
+	if ks.kind == slotTypeKMS && saltLen == 0 {
+		return nil, fmt.Errorf("invalid key slot %s", name)
+	}
+	ks.salt = data[fixedLen : fixedLen+saltLen]
+	ks.wrapped = data[fixedLen+saltLen:]
+	return ks, nil
+}
+
+// info returns the public description of the slot.
+func (ks *keySlot) info() KeySlotInfo {
+	info := KeySlotInfo{
+		Name:    ks.name,
+		Type:    "password",
+		KDF:     "argon2id",
+		Time:    ks.time,
+		Memory:  ks.memory,
+		Threads: ks.threads,
+	}
+	if ks.kdf == kdfPBKDF2 {
+		info.KDF = "pbkdf2-hmac-sha256"
+	}
+	switch ks.kind {
+	case slotTypeRecovery:
+		info.Type = "recovery"
+	case slotTypeShamir:
+		info.Type = "shamir"
+		info.KDF = "none"
+		if len(ks.salt) >= shareSetIDLen+2 {
+			info.Threshold = int(ks.salt[shareSetIDLen])
+			info.Shares = int(ks.salt[shareSetIDLen+1])
+		}
+	case slotTypeKey:
+		info.Type = "key"
+		info.KDF = "none"
+	case slotTypeX25519:
+		info.Type = "recipient"
+		info.KDF = "x25519-hkdf-sha256"
+	case slotTypeSSH:
+		info.Type = "ssh"
+		info.KDF = "x25519-hkdf-sha256"
+		if pub, err := ssh.NewPublicKey(ed25519.PublicKey(ks.salt)); err == nil {
+			info.Fingerprint = ssh.FingerprintSHA256(pub)
+		}
+	case slotTypeKMS:
+		info.Type = "kms"
+		info.KDF = "external"
+		info.KeyID = string(ks.salt)
+	}
+	return info
+}
+
+// checkSlotName rejects names that are not usable as a file name.
+func checkSlotName(name string) error {
+	if name == "" || len(name) > maxSlotNameLen || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid key slot name %q", name)
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return fmt.Errorf("invalid key slot name %q", name)
+		}
+	}
+	return nil
+}
+
+// writeSlot atomically writes ks into the slots directory under keyDir,
+// which need not be the store's current keys directory.
+func (s *Store) writeSlot(keyDir string, ks *keySlot) error {
+	dir := filepath.Join(keyDir, slotsDirName)
+	if err := os.MkdirAll(dir, s.dirPerm); err != nil {
+		return fmt.Errorf("failed to create key slots directory: %w", err)
+	}
+	path := filepath.Join(dir, ks.name)
+	tmp := filepath.Join(dir, "."+ks.name+".tmp")
+	if err := s.syncWrite(tmp, ks.marshal()); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to write key slot %s: %w", ks.name, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to write key slot %s: %w", ks.name, err)
+	}
+	return syncDir(dir)
+}
+
+// readSlots returns every key slot of the store, sorted by name.
+func (s *Store) readSlots() ([]*keySlot, error) {
+	entries, err := os.ReadDir(s.slotsDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read key slots: %w", err)
+	}
+	var slots []*keySlot
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || checkSlotName(name) != nil {
+			continue
+		}
+		ks, err := s.readSlot(name)
+		if err != nil {
+			return nil, err
+		}
+		slots = append(slots, ks)
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i].name < slots[j].name })
+	return slots, nil
+}
+
+// readSlot returns the key slot called name.
+func (s *Store) readSlot(name string) (*keySlot, error) {
+	data, err := s.readFile(filepath.Join(s.slotsDir, name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key slot %s: %w", name, err)
+	}
+	return parseKeySlot(name, data)
+}
+
+// hasSlots reports whether the store uses key slots, as opposed to
+// the single password-derived primary key of older stores.
+func (s *Store) hasSlots() bool {
+	entries, err := os.ReadDir(s.slotsDir)
+	if err != nil {
+		return false
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && checkSlotName(entry.Name()) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// unlockSlots tries password against every password key slot and, on
+// success, sets the master key and remembers which slot it came from.
+func (s *Store) unlockSlots(password []byte) error {
+	return s.unlockSlotsOfKind(slotTypePassword, password)
+}
+
+// unlockSlotsOfKind tries secret against every key slot of kind.
+func (s *Store) unlockSlotsOfKind(kind uint8, secret []byte) error {
+	slots, err := s.readSlots()
+	if err != nil {
+		return err
+	}
+	for _, ks := range slots {
+		if ks.kind != kind {
+			continue
+		}
+		masterKey, err := ks.unwrap(secret)
+		if err != nil {
+			continue
+		}
+		s.setMaster(masterKey, ks.name)
+		return nil
+	}
+	return ErrNoMatchingSlot
+}
+
+// createMasterKey generates a random master key and wraps it in the
+// default key slot under password.
+func (s *Store) createMasterKey(password []byte) error {
+	masterKey := make([]byte, masterKeyLen)
+	if _, err := rand.Read(masterKey); err != nil {
+		return fmt.Errorf("failed to generate master key: %w", err)
+	}
+	ks, err := newPasswordSlot(defaultSlotName, password, masterKey, s.slotKDF())
+	if err != nil {
+		Wipe(masterKey)
+		return err
+	}
+	if err := s.writeSlot(s.keyDir, ks); err != nil {
+		Wipe(masterKey)
+		return err
+	}
+	s.setMaster(masterKey, defaultSlotName)
+	return nil
+}
+
+// migrateToSlots converts a store whose keys are wrapped directly under
+// a password-derived key into a store with key slots.  The derived key
+// becomes the master key, so no key file needs to be rewritten; it is
+// wrapped in the default slot and the salt it was derived from is
+// destroyed.
+func (s *Store) migrateToSlots(password []byte) error {
+	if _, err := os.Stat(s.saltFile); os.IsNotExist(err) {
+		return nil
+	}
+	lk, err := s.lock(s.lockFile)
+	if err != nil {
+		return fmt.Errorf("error locking %s: %w", s.lockFile, err)
+	}
+	defer lk.unlock()
+
+	// Another process may have migrated the store while we waited.
+	if _, err := os.Stat(s.saltFile); os.IsNotExist(err) {
+		return nil
+	}
+	if !s.hasSlots() {
+		master := s.master()
+		ks, err := newPasswordSlot(defaultSlotName, password, master.Bytes(), s.slotKDF())
+		master.Destroy()
+		if err != nil {
+			return err
+		}
+		if err := s.writeSlot(s.keyDir, ks); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.slotName = defaultSlotName
+		s.mu.Unlock()
+	}
+	zeroFile(s.saltFile)
+	if err := os.Remove(s.saltFile); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", s.saltFile, err)
+	}
+	return nil
+}
+
+// AddKeySlot adds a key slot called name that unlocks the store with
+// password.  The store's other slots keep working.  If password is an
+// authorized_keys line for an Ed25519 SSH key instead, the slot is
+// unlocked by that key's private key with SSHKeyFile.
+func (s *Store) AddKeySlot(name string, password []byte) error {
+	if s == nil {
+		return fmt.Errorf("no store")
+	}
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	if err := s.checkMaster(); err != nil {
+		return err
+	}
+	masterBuf := s.master()
+	defer masterBuf.Destroy()
+	master := masterBuf.Bytes()
+	if pub, isSSH, err := parseSSHAuthorizedKey(password); isSSH {
+		if err != nil {
+			return err
+		}
+		if err := s.checkApproved("SSH key slots"); err != nil {
+			return err
+		}
+		ks, err := newSSHSlot(name, pub, master)
+		if err != nil {
+			return err
+		}
+		return s.addSlot(ks)
+	}
+	ks, err := newPasswordSlot(name, password, master, s.slotKDF())
+	if err != nil {
+		return err
+	}
+	return s.addSlot(ks)
+}
+
+// AddKeyFileSlot adds a key slot called name that unlocks the store
+// with a 32-byte random key, such as one made by GenerateKeyFile, with
+// KeyFile or KeyFrom.  No KDF is run, so unlocking is cheap; the key
+// must be stored as carefully as the data it protects.
+func (s *Store) AddKeyFileSlot(name string, key []byte) error {
+	if s == nil {
+		return fmt.Errorf("no store")
+	}
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	if err := s.checkMaster(); err != nil {
+		return err
+	}
+	masterBuf := s.master()
+	defer masterBuf.Destroy()
+	master := masterBuf.Bytes()
+	if len(key) != rawKeyLen {
+		return fmt.Errorf("key must be %d bytes", rawKeyLen)
+	}
+	wrapped, err := encryptKey(master, key)
+	if err != nil {
+		return err
+	}
+	return s.addSlot(&keySlot{name: name, kind: slotTypeKey, kdf: kdfNone, wrapped: wrapped})
+}
+
+// addSlot writes ks unless a slot of the same name exists.
+func (s *Store) addSlot(ks *keySlot) error {
+	name := ks.name
+	lk, err := s.lock(s.lockFile)
+	if err != nil {
+		return fmt.Errorf("error locking %s: %w", s.lockFile, err)
+	}
+	defer lk.unlock()
+
+	if err := checkSlotName(name); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(s.slotsDir, name)); err == nil {
+		return fmt.Errorf("key slot %s already exists", name)
+	}
+	if !s.hasSlots() {
+		return fmt.Errorf("store at %s has no key slots, reopen it to upgrade", s.dir)
+	}
+	return s.writeSlot(s.keyDir, ks)
+}
+
+// RemoveKeySlot zeroes and removes the key slot called name, so its
+// credential no longer unlocks the store.  The last slot other than
+// the recovery slot cannot be removed.
+func (s *Store) RemoveKeySlot(name string) error {
+	if s == nil {
+		return fmt.Errorf("no store")
+	}
+	if err := s.checkClosed(); err != nil {
+		return err
+	}
+	lk, err := s.lock(s.lockFile)
+	if err != nil {
+		return fmt.Errorf("error locking %s: %w", s.lockFile, err)
+	}
+	defer lk.unlock()
+
+	if err := checkSlotName(name); err != nil {
+		return err
+	}
+	slots, err := s.readSlots()
+	if err != nil {
+		return err
+	}
+	var target *keySlot
+	unlocking := 0
+	for _, ks := range slots {
+		if ks.name == name {
+			target = ks
+		}
+		if ks.kind != slotTypeRecovery {
+			unlocking++
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("key slot %s does not exist", name)
+	}
+	if target.kind != slotTypeRecovery && unlocking == 1 {
+		return fmt.Errorf("cannot remove the last key slot that unlocks the store")
+	}
+	path := filepath.Join(s.slotsDir, name)
+	zeroFile(path)
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove key slot %s: %w", name, err)
+	}
+	return syncDir(s.slotsDir)
+}
+
+// removeOtherSlots zeroes and removes every key slot but keep.  The
+// caller must hold the keys lock.
+func (s *Store) removeOtherSlots(keep string) error {
+	slots, err := s.readSlots()
+	if err != nil {
+		return err
+	}
+	for _, ks := range slots {
+		if ks.name == keep {
+			continue
+		}
+		path := filepath.Join(s.slotsDir, ks.name)
+		zeroFile(path)
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove key slot %s: %w", ks.name, err)
+		}
+	}
+	return syncDir(s.slotsDir)
+}
+
+// UnlockMethods returns the kinds of credential that can unlock the
+// store, such as "password" or "key", as recorded by its key slots.
+func (s *Store) UnlockMethods() ([]string, error) {
+	slots, err := s.ListKeySlots()
+	if err != nil {
+		return nil, err
+	}
+	var methods []string
+	for _, slot := range slots {
+		if !slices.Contains(methods, slot.Type) {
+			methods = append(methods, slot.Type)
+		}
+	}
+	sort.Strings(methods)
+	return methods, nil
+}
+
+// ListKeySlots returns the store's key slots, sorted by name.
+func (s *Store) ListKeySlots() ([]KeySlotInfo, error) {
+	if s == nil {
+		return nil, fmt.Errorf("no store")
+	}
+	if err := s.checkClosed(); err != nil {
+		return nil, err
+	}
+	lk, err := s.rLock(s.lockFile)
+	if err != nil {
+		return nil, fmt.Errorf("error locking %s: %w", s.lockFile, err)
+	}
+	defer lk.unlock()
+
+	slots, err := s.readSlots()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]KeySlotInfo, 0, len(slots))
+	for _, ks := range slots {
+		infos = append(infos, ks.info())
+	}
+	return infos, nil
+}
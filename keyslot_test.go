@@ -0,0 +1,130 @@
+package darkstore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_KeySlots(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := filepath.Join(testStoreDir, "key_slots")
+	defer os.RemoveAll(dir) //nolint: errcheck
+
+	store, err := NewStore(dir, testPassword)
+	assert.NoError(err)
+	assert.NoError(store.Save("secret", []byte("shared")))
+	_, err = os.Stat(filepath.Join(dir, keyDirName, primarySaltFile))
+	assert.True(os.IsNotExist(err), "new stores have no primary salt")
+
+	oncall := []byte("on-call-password")
+
+	// Test case 1: Add and list slots
+	t.Run("Add", func(t *testing.T) {
+		assert.NoError(store.AddKeySlot("oncall", oncall))
+		err := store.AddKeySlot("oncall", oncall)
+		assert.Error(err)
+		assert.Contains(err.Error(), "already exists")
+		assert.Error(store.AddKeySlot("../escape", oncall))
+		assert.Error(store.AddKeySlot(".hidden", oncall))
+		assert.Error(store.AddKeySlot("empty", nil))
+
+		slots, err := store.ListKeySlots()
+		assert.NoError(err)
+		assert.Len(slots, 2)
+		assert.Equal("default", slots[0].Name)
+		assert.Equal("oncall", slots[1].Name)
+		assert.Equal("argon2id", slots[1].KDF)
+		assert.Equal(argon2Time, slots[1].Time)
+	})
+
+	// Test case 2: Either password opens the store
+	t.Run("Open with any slot", func(t *testing.T) {
+		other, err := NewStore(dir, oncall)
+		assert.NoError(err)
+		assert.Equal("oncall", other.slotName)
+		data, err := other.Load("secret")
+		assert.NoError(err)
+		assert.Equal([]byte("shared"), data)
+		other.Close()
+
+		_, err = NewStore(dir, []byte("wrong password"))
+		assert.True(errors.Is(err, ErrNoMatchingSlot), "got %v", err)
+	})
+
+	// Test case 3: Passwd changes only the slot in use
+	t.Run("Passwd", func(t *testing.T) {
+		other, err := NewStore(dir, oncall)
+		assert.NoError(err)
+		assert.NoError(other.Passwd([]byte("new-on-call-password")))
+		other.Close()
+
+		_, err = NewStore(dir, oncall)
+		assert.Error(err)
+		other, err = NewStore(dir, []byte("new-on-call-password"))
+		assert.NoError(err)
+		other.Close()
+		other, err = NewStore(dir, testPassword)
+		assert.NoError(err)
+		data, err := other.Load("secret")
+		assert.NoError(err)
+		assert.Equal([]byte("shared"), data)
+		other.Close()
+	})
+
+	// Test case 4: Remove slots
+	t.Run("Remove", func(t *testing.T) {
+		assert.Error(store.RemoveKeySlot("missing"))
+		assert.NoError(store.RemoveKeySlot("oncall"))
+		_, err := NewStore(dir, []byte("new-on-call-password"))
+		assert.Error(err)
+
+		err = store.RemoveKeySlot("default")
+		assert.Error(err)
+		assert.Contains(err.Error(), "last key slot")
+	})
+	store.Close()
+}
+
+func TestStore_migrateToSlots(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := filepath.Join(testStoreDir, "migrate_slots")
+	defer os.RemoveAll(dir) //nolint: errcheck
+
+	// Build a store the way it was laid out before key slots existed,
+	// with key0 wrapped directly under the password-derived key.
+	store, err := newTestStore(dir)
+	assert.NoError(err)
+	salt, err := os.ReadFile(store.saltFile)
+	assert.NoError(err)
+	store.primaryKey, err = deriveKeyFromPassword(testPassword, salt)
+	assert.NoError(err)
+	store.currentKey, err = store.newKey(0)
+	assert.NoError(err)
+	assert.NoError(os.Remove(store.manifestFile))
+	assert.NoError(store.initManifest())
+	assert.NoError(store.Save("secret", []byte("legacy")))
+	store.Close()
+
+	store, err = NewStore(dir, testPassword)
+	assert.NoError(err)
+	assert.Equal(defaultSlotName, store.slotName)
+	_, err = os.Stat(filepath.Join(dir, keyDirName, primarySaltFile))
+	assert.True(os.IsNotExist(err), "salt removed after migration")
+	data, err := store.Load("secret")
+	assert.NoError(err)
+	assert.Equal([]byte("legacy"), data)
+	store.Close()
+
+	store, err = NewStore(dir, testPassword)
+	assert.NoError(err)
+	slots, err := store.ListKeySlots()
+	assert.NoError(err)
+	assert.Len(slots, 1)
+	store.Close()
+}
@@ -0,0 +1,298 @@
+package darkstore
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	keyWrapperFile  = "wrapperid"
+	maxKeyWrapperID = 255
+)
+
+// KeyWrapper wraps the store's data keys, the key<N> files, under a key
+// held somewhere else, such as a cloud KMS, instead of under the
+// store's master key.  Plug in a KMS client by implementing it and
+// passing it to WithKeyWrapper or SetKeyWrapper.
+//
+// The contract:
+//   - Unwrap(Wrap(key)) returns key.  Wrapping the same key twice may
+//     give different results.
+//   - Unwrap returns an error, never wrong bytes, if wrapped was altered
+//     or was wrapped under another key; use authenticated encryption.
+//   - KeyID names the wrapping key.  It is recorded in the store, so it
+//     must be stable, must not be secret, and must be 1 to 255 bytes.
+//   - Keys are 32 bytes.  Wrapped keys may be up to 64 KiB.
+//   - Methods may be called from several goroutines at once, and from
+//     the store's background key rotation.
+//   - Errors are returned to the caller of the store method, wrapped.
+type KeyWrapper interface {
+	// KeyID identifies the wrapping key.
+	KeyID() string
+	// Wrap encrypts a data key.
+	Wrap(key []byte) ([]byte, error)
+	// Unwrap decrypts a data key encrypted by Wrap.
+	Unwrap(wrapped []byte) ([]byte, error)
+}
+
+// WithKeyWrapper has the store's data keys wrapped by w rather than by
+// the master key.  A new store records w.KeyID(), and an existing store
+// must be opened with the same key wrapper it was created or last
+// rewrapped with.  The master key is still needed to open the store
+// and check its integrity, so both a credential and access to w are
+// needed to read secrets.
+func WithKeyWrapper(w KeyWrapper) Option {
+	return func(o *options) {
+		o.wrapper = w
+	}
+}
+
+// masterKeyWrapper wraps data keys under a master key.
+type masterKeyWrapper struct {
+	key []byte
+}
+
+func (w masterKeyWrapper) KeyID() string { return "" }
+
+func (w masterKeyWrapper) Wrap(key []byte) ([]byte, error) {
+	return encryptKey(key, w.key)
+}
+
+func (w masterKeyWrapper) Unwrap(wrapped []byte) ([]byte, error) {
+	return decryptKey(wrapped, w.key)
+}
+
+// checkKeyWrapperID rejects KeyIDs the store cannot record.
+func checkKeyWrapperID(id string) error {
+	if id == "" || len(id) > maxKeyWrapperID {
+		return fmt.Errorf("key wrapper ID must be 1 to %d bytes", maxKeyWrapperID)
+	}
+	return nil
+}
+
+// readKeyWrapperID returns the KeyID recorded in keyDir, or "" if its
+// data keys are wrapped by the master key.
+func readKeyWrapperID(keyDir string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(keyDir, keyWrapperFile))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to read key wrapper: %w", err)
+	}
+	return string(bytes.TrimSpace(data)), nil
+}
+
+// writeKeyWrapperID records the KeyID of w in keyDir, or removes the
+// record if w is nil.
+func (s *Store) writeKeyWrapperID(keyDir string, w KeyWrapper) error {
+	path := filepath.Join(keyDir, keyWrapperFile)
+	if w == nil {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove key wrapper: %w", err)
+		}
+		return nil
+	}
+	if err := checkKeyWrapperID(w.KeyID()); err != nil {
+		return err
+	}
+	if err := s.writeFile(path, []byte(w.KeyID()+"\n")); err != nil {
+		return fmt.Errorf("failed to write key wrapper: %w", err)
+	}
+	return nil
+}
+
+// checkKeyWrapper makes sure the store is opened with the key wrapper
+// its data keys are wrapped by.
+func (s *Store) checkKeyWrapper() error {
+	id, err := readKeyWrapperID(s.keyDir)
+	if err != nil {
+		return err
+	}
+	w := s.wrapper()
+	switch {
+	case id == "" && w != nil:
+		return fmt.Errorf("keys of store at %s are not wrapped by a key wrapper, use SetKeyWrapper", s.dir)
+	case id != "" && w == nil:
+		return fmt.Errorf("keys of store at %s are wrapped by %s, open it WithKeyWrapper", s.dir, id)
+	case id != "" && w.KeyID() != id:
+		return fmt.Errorf("keys of store at %s are wrapped by %s, not %s", s.dir, id, w.KeyID())
+	}
+	return nil
+}
+
+// SetKeyWrapper rewraps every data key of the store with w, or with the
+// master key if w is nil.  Like Passwd, it works on a copy of the keys
+// directory and swaps it in, so an interruption leaves the store usable
+// with either the old or the new key wrapper, and writes zeroes over the
+// old key files.
+func (s *Store) SetKeyWrapper(w KeyWrapper) error {
+	if s == nil {
+		return fmt.Errorf("no store")
+	}
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	if err := s.checkMaster(); err != nil {
+		return err
+	}
+	if w != nil {
+		if err := checkKeyWrapperID(w.KeyID()); err != nil {
+			return err
+		}
+	}
+
+	lk, err := s.lockNB(s.lockFile)
+	if err != nil {
+		return fmt.Errorf("store at %s is being modified: %w", s.dir, err)
+	}
+	defer lk.unlock()
+	txLk, err := s.lock(s.txLockFile)
+	if err != nil {
+		return fmt.Errorf("error locking %s: %w", s.txLockFile, err)
+	}
+	defer txLk.unlock()
+
+	// Key files must not come and go under the rewrap.
+	keys, err := filepath.Glob(filepath.Join(s.keyDir, "key*"))
+	if err != nil {
+		return fmt.Errorf("failed to read keys directory: %w", err)
+	}
+	if len(keys) > 1 {
+		return fmt.Errorf("key rotation in progress, try again when it is done")
+	}
+
+	newdir, err := s.copyKeyDir()
+	if err != nil {
+		return err
+	}
+	defer passwdCleanup(newdir)
+
+	oldWrapper, done := s.keyWrapper()
+	defer done()
+	masterBuf := s.master()
+	defer masterBuf.Destroy()
+	master := masterBuf.Bytes()
+	newWrapper := KeyWrapper(masterKeyWrapper{master})
+	if w != nil {
+		newWrapper = w
+	}
+	if err := s.rewrapKeyFiles(newdir, oldWrapper, newWrapper); err != nil {
+		return err
+	}
+	if err := s.writeKeyWrapperID(newdir, w); err != nil {
+		return err
+	}
+	// The watcher reloads the keys as soon as the new directory is in
+	// place, so switch key wrappers first.
+	oldOpt := s.wrapper()
+	s.setWrapper(w)
+	if err := s.replaceKeyDir(newdir); err != nil {
+		s.setWrapper(oldOpt)
+		return err
+	}
+	return nil
+}
+
+// rewrapKeyFiles unwraps every key file in dir with from and wraps it
+// again with to.
+func (s *Store) rewrapKeyFiles(dir string, from, to KeyWrapper) error {
+	keyFiles, err := filepath.Glob(filepath.Join(dir, "key*"))
+	if err != nil {
+		return err
+	}
+	for _, keyPath := range keyFiles {
+		name := filepath.Base(keyPath)
+		if _, err := strconv.ParseUint(strings.TrimPrefix(name, "key"), 10, 8); err != nil {
+			continue // Not a key file.
+		}
+		data, err := s.readFile(keyPath)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		key, err := from.Unwrap(data)
+		if err != nil {
+			return fmt.Errorf("failed to unwrap %s: %w", name, err)
+		}
+		wrapped, err := to.Wrap(key)
+		Wipe(key)
+		if err != nil {
+			return fmt.Errorf("failed to wrap %s: %w", name, err)
+		}
+		if err := s.writeFile(keyPath, wrapped); err != nil {
+			return fmt.Errorf("failed to write %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// AddKMSSlot adds a key slot called name that wraps the master key with
+// w, so that the store can be opened with KMS(w) and no other
+// credential.
+func (s *Store) AddKMSSlot(name string, w KeyWrapper) error {
+	if s == nil {
+		return fmt.Errorf("no store")
+	}
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	if err := s.checkMaster(); err != nil {
+		return err
+	}
+	if err := checkKeyWrapperID(w.KeyID()); err != nil {
+		return err
+	}
+	masterBuf := s.master()
+	defer masterBuf.Destroy()
+	master := masterBuf.Bytes()
+	wrapped, err := w.Wrap(master)
+	if err != nil {
+		return fmt.Errorf("failed to wrap master key: %w", err)
+	}
+	return s.addSlot(&keySlot{name: name, kind: slotTypeKMS, kdf: kdfExternal,
+		salt: []byte(w.KeyID()), wrapped: wrapped})
+}
+
+// kmsUnlocker unlocks KMS key slots.
+type kmsUnlocker struct {
+	w KeyWrapper
+}
+
+// KMS returns an Unlocker that opens the store with the key slot added
+// for w with AddKMSSlot.  If the store's data keys are wrapped by w too,
+// WithKeyWrapper is not needed.
+func KMS(w KeyWrapper) Unlocker {
+	return &kmsUnlocker{w: w}
+}
+
+func (u *kmsUnlocker) unlockStore(s *Store) error {
+	id := u.w.KeyID()
+	slots, err := s.readSlots()
+	if err != nil {
+		return err
+	}
+	for _, ks := range slots {
+		if ks.kind != slotTypeKMS || string(ks.salt) != id {
+			continue
+		}
+		masterKey, err := u.w.Unwrap(ks.wrapped)
+		if err != nil {
+			return fmt.Errorf("failed to unwrap master key: %w", err)
+		}
+		if len(masterKey) != masterKeyLen {
+			Wipe(masterKey)
+			return fmt.Errorf("key wrapper %s returned a bad master key", id)
+		}
+		s.setMaster(masterKey, ks.name)
+		if s.wrapper() == nil {
+			if wrapperID, err := readKeyWrapperID(s.keyDir); err == nil && wrapperID == id {
+				s.setWrapper(u.w)
+			}
+		}
+		return nil
+	}
+	return ErrNoMatchingSlot
+}
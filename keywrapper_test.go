@@ -0,0 +1,154 @@
+package darkstore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testWrapper wraps keys with a fixed key, and can be made to fail.
+type testWrapper struct {
+	id   string
+	key  []byte
+	down bool
+}
+
+func (w *testWrapper) KeyID() string { return w.id }
+
+func (w *testWrapper) Wrap(key []byte) ([]byte, error) {
+	if w.down {
+		return nil, errors.New("kms unavailable")
+	}
+	return encryptKey(key, w.key)
+}
+
+func (w *testWrapper) Unwrap(wrapped []byte) ([]byte, error) {
+	if w.down {
+		return nil, errors.New("kms unavailable")
+	}
+	return decryptKey(wrapped, w.key)
+}
+
+// waitForRotation waits for the background re-encryption of a rotation
+// to remove the old key.
+func waitForRotation(t *testing.T, s *Store) {
+	assert.Eventually(t, func() bool {
+		keys, _ := filepath.Glob(filepath.Join(s.keyDir, "key*"))
+		if len(keys) != 1 {
+			return false
+		}
+		// updateFiles lets go of the keys after removing the old ones.
+		lk, err := s.lockNB(s.lockFile)
+		lk.unlock()
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestKeyWrapper(t *testing.T) {
+	assert := assert.New(t)
+
+	kms := &testWrapper{id: "projects/test/keys/one", key: make([]byte, 32)}
+	kms2 := &testWrapper{id: "projects/test/keys/two", key: make([]byte, 32)}
+	kms2.key[0] = 1
+
+	// Test case 1: A new store wraps its data keys with the KMS
+	t.Run("Create", func(t *testing.T) {
+		dir := filepath.Join(testStoreDir, "keywrapper_create")
+		defer os.RemoveAll(dir) //nolint: errcheck
+
+		store, err := NewStore(dir, testPassword, WithKeyWrapper(kms))
+		assert.NoError(err)
+		assert.NoError(store.Save("secret", []byte("kms protected")))
+		assert.NoError(store.Rotate())
+		waitForRotation(t, store)
+		store.Close()
+
+		_, err = NewStore(dir, testPassword)
+		assert.Error(err, "the KMS is needed too")
+		_, err = NewStore(dir, testPassword, WithKeyWrapper(kms2))
+		assert.Error(err)
+
+		kms.down = true
+		_, err = NewStore(dir, testPassword, WithKeyWrapper(kms))
+		assert.Error(err)
+		assert.Contains(err.Error(), "kms unavailable")
+		kms.down = false
+
+		store, err = NewStore(dir, testPassword, WithKeyWrapper(kms))
+		assert.NoError(err)
+		data, err := store.Load("secret")
+		assert.NoError(err)
+		assert.Equal([]byte("kms protected"), data)
+		report, err := store.Verify(t.Context())
+		assert.NoError(err)
+		assert.True(report.OK(), "%v", report.Problems)
+		store.Close()
+	})
+
+	// Test case 2: Rewrapping moves a store on and off a KMS
+	t.Run("SetKeyWrapper", func(t *testing.T) {
+		dir := filepath.Join(testStoreDir, "keywrapper_set")
+		defer os.RemoveAll(dir) //nolint: errcheck
+
+		store, err := NewStore(dir, testPassword)
+		assert.NoError(err)
+		assert.NoError(store.Save("secret", []byte("moving")))
+		assert.NoError(store.SetKeyWrapper(kms))
+		assert.NoError(store.Rotate())
+		waitForRotation(t, store)
+		assert.NoError(store.SetKeyWrapper(kms2))
+		data, err := store.Load("secret")
+		assert.NoError(err)
+		assert.Equal([]byte("moving"), data)
+		store.Close()
+
+		_, err = NewStore(dir, testPassword, WithKeyWrapper(kms))
+		assert.Error(err)
+		store, err = NewStore(dir, testPassword, WithKeyWrapper(kms2))
+		assert.NoError(err)
+		kms2.down = true
+		assert.Error(store.SetKeyWrapper(nil))
+		kms2.down = false
+		assert.NoError(store.SetKeyWrapper(nil))
+		store.Close()
+
+		store, err = NewStore(dir, testPassword)
+		assert.NoError(err)
+		data, err = store.Load("secret")
+		assert.NoError(err)
+		assert.Equal([]byte("moving"), data)
+		assert.Error(store.SetKeyWrapper(&testWrapper{key: make([]byte, 32)}), "empty KeyID")
+		store.Close()
+	})
+
+	// Test case 3: A KMS slot opens the store without a password
+	t.Run("KMS slot", func(t *testing.T) {
+		dir := filepath.Join(testStoreDir, "keywrapper_slot")
+		defer os.RemoveAll(dir) //nolint: errcheck
+
+		store, err := NewStore(dir, testPassword, WithKeyWrapper(kms))
+		assert.NoError(err)
+		assert.NoError(store.Save("secret", []byte("no password")))
+		assert.NoError(store.AddKMSSlot("kms", kms))
+		assert.NoError(store.RemoveKeySlot(defaultSlotName))
+		slots, err := store.ListKeySlots()
+		assert.NoError(err)
+		assert.Equal("kms", slots[0].Type)
+		assert.Equal(kms.id, slots[0].KeyID)
+		store.Close()
+
+		store, err = Open(dir, KMS(kms))
+		assert.NoError(err)
+		data, err := store.Load("secret")
+		assert.NoError(err)
+		assert.Equal([]byte("no password"), data)
+		store.Close()
+
+		_, err = Open(dir, KMS(kms2))
+		assert.True(errors.Is(err, ErrNoMatchingSlot), "got %v", err)
+	})
+}
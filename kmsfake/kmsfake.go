@@ -0,0 +1,183 @@
+// Package kmsfake provides fake implementations of darkstore.KeyWrapper
+// for testing code that uses a KMS: one that keeps its key in a local
+// file, and an HTTP server and client that stand in for a KMS service.
+// They are not meant to protect real secrets.
+package kmsfake
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/kenm928/darkstore"
+)
+
+const (
+	keyLen     = 32
+	maxRequest = 64 * 1024
+)
+
+// File is a KeyWrapper whose key is kept in a local file.
+type File struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// NewFile returns a File wrapper using the 32-byte key in the file at
+// path, creating the file with a random key if it does not exist.  Its
+// KeyID is derived from the key, so two wrappers with the same file
+// have the same ID.
+func NewFile(path string) (*File, error) {
+	key, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		key = make([]byte, keyLen)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate key: %w", err)
+		}
+		if err := os.WriteFile(path, key, 0600); err != nil {
+			return nil, fmt.Errorf("failed to write key: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read key: %w", err)
+	}
+	defer darkstore.Wipe(key)
+	if len(key) != keyLen {
+		return nil, fmt.Errorf("key in %s is not %d bytes", path, keyLen)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &File{id: "file:" + hex.EncodeToString(sum[:8]), aead: aead}, nil
+}
+
+// KeyID returns an ID derived from the key.
+func (f *File) KeyID() string { return f.id }
+
+// Wrap encrypts key with AES-256-GCM, with the KeyID as additional data.
+func (f *File) Wrap(key []byte) ([]byte, error) {
+	nonce := make([]byte, f.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return f.aead.Seal(nonce, nonce, key, []byte(f.id)), nil
+}
+
+// Unwrap decrypts a key wrapped by Wrap.
+func (f *File) Unwrap(wrapped []byte) ([]byte, error) {
+	n := f.aead.NonceSize()
+	if len(wrapped) < n {
+		return nil, errors.New("wrapped key is too short")
+	}
+	key, err := f.aead.Open(nil, wrapped[:n], wrapped[n:], []byte(f.id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap key: %w", err)
+	}
+	return key, nil
+}
+
+// Handler returns an HTTP handler that serves w like a KMS: GET /keyid
+// returns its KeyID, and POST /wrap and POST /unwrap take and return
+// raw bytes.
+func Handler(w darkstore.KeyWrapper) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /keyid", func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(rw, w.KeyID())
+	})
+	serve := func(fn func([]byte) ([]byte, error)) http.HandlerFunc {
+		return func(rw http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxRequest))
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer darkstore.Wipe(body)
+			out, err := fn(body)
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer darkstore.Wipe(out)
+			_, _ = rw.Write(out)
+		}
+	}
+	mux.HandleFunc("POST /wrap", serve(w.Wrap))
+	mux.HandleFunc("POST /unwrap", serve(w.Unwrap))
+	return mux
+}
+
+// Client is a KeyWrapper that calls a server run with Handler.
+type Client struct {
+	url  string
+	id   string
+	http *http.Client
+}
+
+// NewClient returns a Client for the server at url, asking it for its
+// KeyID.  If hc is nil, http.DefaultClient is used.
+func NewClient(url string, hc *http.Client) (*Client, error) {
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	c := &Client{url: strings.TrimSuffix(url, "/"), http: hc}
+	resp, err := hc.Get(c.url + "/keyid")
+	if err != nil {
+		return nil, err
+	}
+	id, err := readResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	c.id = string(id)
+	return c, nil
+}
+
+// KeyID returns the server's KeyID.
+func (c *Client) KeyID() string { return c.id }
+
+// Wrap asks the server to wrap key.
+func (c *Client) Wrap(key []byte) ([]byte, error) {
+	return c.post("/wrap", key)
+}
+
+// Unwrap asks the server to unwrap wrapped.
+func (c *Client) Unwrap(wrapped []byte) ([]byte, error) {
+	return c.post("/unwrap", wrapped)
+}
+
+func (c *Client) post(path string, body []byte) ([]byte, error) {
+	resp, err := c.http.Post(c.url+path, "application/octet-stream", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	return readResponse(resp)
+}
+
+// readResponse returns the body of a successful response.
+func readResponse(resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close() //nolint: errcheck
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRequest))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		darkstore.Wipe(body)
+		return nil, fmt.Errorf("kms: %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return body, nil
+}
@@ -0,0 +1,66 @@
+package kmsfake
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "kms.key")
+	f, err := NewFile(path)
+	assert.NoError(err)
+	again, err := NewFile(path)
+	assert.NoError(err)
+	assert.Equal(f.KeyID(), again.KeyID())
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	wrapped, err := f.Wrap(key)
+	assert.NoError(err)
+	unwrapped, err := again.Unwrap(wrapped)
+	assert.NoError(err)
+	assert.Equal(key, unwrapped)
+
+	wrapped[len(wrapped)-1] ^= 1
+	_, err = f.Unwrap(wrapped)
+	assert.Error(err)
+
+	other, err := NewFile(filepath.Join(dir, "other.key"))
+	assert.NoError(err)
+	assert.NotEqual(f.KeyID(), other.KeyID())
+
+	assert.NoError(os.WriteFile(filepath.Join(dir, "short.key"), []byte("short"), 0600))
+	_, err = NewFile(filepath.Join(dir, "short.key"))
+	assert.Error(err)
+}
+
+func TestClient(t *testing.T) {
+	assert := assert.New(t)
+
+	f, err := NewFile(filepath.Join(t.TempDir(), "kms.key"))
+	assert.NoError(err)
+	server := httptest.NewServer(Handler(f))
+	defer server.Close()
+
+	c, err := NewClient(server.URL, server.Client())
+	assert.NoError(err)
+	assert.Equal(f.KeyID(), c.KeyID())
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	wrapped, err := c.Wrap(key)
+	assert.NoError(err)
+	unwrapped, err := f.Unwrap(wrapped)
+	assert.NoError(err)
+	assert.Equal(key, unwrapped)
+
+	_, err = c.Unwrap([]byte("garbage"))
+	assert.Error(err)
+	_, err = NewClient("http://127.0.0.1:1", nil)
+	assert.Error(err)
+}
@@ -29,6 +29,16 @@ func (s *Store) lockNB(path string) (*fileLock, error) {
 }
 
 func (s *Store) writeLock(path string, bits int) (*fileLock, error) {
+	for {
+		lk, err := s.tryWriteLock(path, bits)
+		if err != nil || !lk.replaced(path) {
+			return lk, err
+		}
+		lk.unlock()
+	}
+}
+
+func (s *Store) tryWriteLock(path string, bits int) (*fileLock, error) {
 	var f *os.File
 	stat, err := os.Stat(path)
 	if err != nil {
@@ -73,6 +83,16 @@ func (s *Store) rLockNB(path string) (*fileLock, error) {
 */
 
 func (s *Store) readLock(path string, bits int) (*fileLock, error) {
+	for {
+		lk, err := s.tryReadLock(path, bits)
+		if err != nil || !lk.replaced(path) {
+			return lk, err
+		}
+		lk.unlock()
+	}
+}
+
+func (s *Store) tryReadLock(path string, bits int) (*fileLock, error) {
 	f, err := os.OpenFile(path, os.O_RDONLY, s.filePerm)
 	if err != nil {
 		return nil, err
@@ -84,6 +104,19 @@ func (s *Store) readLock(path string, bits int) (*fileLock, error) {
 	return &fileLock{f: f}, nil
 }
 
+// replaced reports whether the locked file was removed or replaced at
+// path while waiting for the lock, as when Passwd replaces the keys
+// directory with the lock files in it.  Then the lock does not keep
+// out those that lock the new file, and must be taken again.
+func (l *fileLock) replaced(path string) bool {
+	locked, err := l.f.Stat()
+	if err != nil {
+		return true
+	}
+	current, err := os.Stat(path)
+	return err != nil || !os.SameFile(locked, current)
+}
+
 // unlock releases the lock and closes the file descriptor.
 func (l *fileLock) unlock() {
 	if l == nil || l.f == nil {
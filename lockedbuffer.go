@@ -0,0 +1,65 @@
+package darkstore
+
+// LockedBuffer holds secret bytes in memory that is locked into RAM so
+// that it is never written to swap, left out of core dumps, and placed
+// between inaccessible guard pages, with the bytes at the end so that
+// running off them faults.  Destroy wipes and frees it; its Bytes must
+// not be used afterwards.  A LockedBuffer is not safe for concurrent
+// use.
+type LockedBuffer struct {
+	mem  []byte // The whole mapping, guard pages included; nil on the heap.
+	data []byte
+}
+
+// NewLockedBuffer returns a zeroed LockedBuffer of size bytes.  It fails
+// if the memory cannot be locked, for example because RLIMIT_MEMLOCK is
+// too low.
+func NewLockedBuffer(size int) (*LockedBuffer, error) {
+	return newLockedBuffer(size)
+}
+
+// Bytes returns the contents of the buffer, or nil once it is destroyed.
+func (b *LockedBuffer) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.data
+}
+
+// Len returns the size of the buffer.
+func (b *LockedBuffer) Len() int {
+	return len(b.Bytes())
+}
+
+// Destroy wipes the buffer and frees its memory.  It may be called more
+// than once.
+func (b *LockedBuffer) Destroy() {
+	if b == nil || b.data == nil {
+		return
+	}
+	Wipe(b.data)
+	if b.mem != nil {
+		b.free()
+	}
+	b.mem = nil
+	b.data = nil
+}
+
+// lockedCopy returns a LockedBuffer holding a copy of data.  If memory
+// cannot be locked, the copy is kept on the heap instead, so that the
+// store still works where RLIMIT_MEMLOCK is low.
+func lockedCopy(data []byte) *LockedBuffer {
+	b := lockedOrHeap(len(data))
+	copy(b.data, data)
+	return b
+}
+
+// lockedOrHeap returns a LockedBuffer of size bytes, on the heap if
+// memory cannot be locked.
+func lockedOrHeap(size int) *LockedBuffer {
+	b, err := newLockedBuffer(size)
+	if err != nil {
+		b = &LockedBuffer{data: make([]byte, size)}
+	}
+	return b
+}
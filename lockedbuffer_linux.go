@@ -0,0 +1,54 @@
+package darkstore
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// newLockedBuffer maps a guard page, enough locked pages for size bytes,
+// and another guard page, and excludes them all from core dumps.
+func newLockedBuffer(size int) (*LockedBuffer, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("invalid buffer size %d", size)
+	}
+	page := os.Getpagesize()
+	inner := max((size+page-1)/page*page, page)
+	mem, err := unix.Mmap(-1, 0, inner+2*page,
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map buffer: %w", err)
+	}
+	b := &LockedBuffer{mem: mem}
+	if err := b.setup(page, inner); err != nil {
+		_ = unix.Munmap(mem)
+		return nil, err
+	}
+	b.data = mem[page+inner-size : page+inner : page+inner]
+	return b, nil
+}
+
+// setup protects the guard pages and locks the pages between them.
+func (b *LockedBuffer) setup(page, inner int) error {
+	if err := unix.Mprotect(b.mem[:page], unix.PROT_NONE); err != nil {
+		return fmt.Errorf("failed to protect guard page: %w", err)
+	}
+	if err := unix.Mprotect(b.mem[page+inner:], unix.PROT_NONE); err != nil {
+		return fmt.Errorf("failed to protect guard page: %w", err)
+	}
+	if err := unix.Madvise(b.mem, unix.MADV_DONTDUMP); err != nil {
+		return fmt.Errorf("failed to exclude buffer from core dumps: %w", err)
+	}
+	if err := unix.Mlock(b.mem[page : page+inner]); err != nil {
+		return fmt.Errorf("failed to lock buffer: %w", err)
+	}
+	return nil
+}
+
+// free unlocks and unmaps the buffer's memory.
+func (b *LockedBuffer) free() {
+	page := os.Getpagesize()
+	_ = unix.Munlock(b.mem[page : len(b.mem)-page])
+	_ = unix.Munmap(b.mem)
+}
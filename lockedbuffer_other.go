@@ -0,0 +1,14 @@
+//go:build !linux
+
+package darkstore
+
+import (
+	"errors"
+)
+
+// newLockedBuffer fails where locked, guarded memory is not implemented.
+func newLockedBuffer(size int) (*LockedBuffer, error) {
+	return nil, errors.New("locked buffers are only supported on linux")
+}
+
+func (b *LockedBuffer) free() {}
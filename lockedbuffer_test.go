@@ -0,0 +1,130 @@
+package darkstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockedBuffer(t *testing.T) {
+	assert := assert.New(t)
+
+	// Test case 1: A buffer is zeroed, writable and wiped on Destroy
+	t.Run("Destroy", func(t *testing.T) {
+		b, err := NewLockedBuffer(100)
+		assert.NoError(err)
+		assert.Equal(100, b.Len())
+		assert.Equal(make([]byte, 100), b.Bytes())
+		copy(b.Bytes(), "secret")
+		assert.Equal([]byte("secret"), b.Bytes()[:6])
+
+		b.Destroy()
+		assert.Nil(b.Bytes())
+		assert.Equal(0, b.Len())
+		b.Destroy()
+
+		var nilBuf *LockedBuffer
+		assert.Nil(nilBuf.Bytes())
+		nilBuf.Destroy()
+	})
+
+	// Test case 2: Sizes around a page, and empty buffers
+	t.Run("Sizes", func(t *testing.T) {
+		page := os.Getpagesize()
+		for _, size := range []int{0, 1, page - 1, page, page + 1, 3 * page} {
+			b, err := NewLockedBuffer(size)
+			assert.NoError(err)
+			assert.Equal(size, b.Len())
+			assert.Equal(size, cap(b.Bytes()), "appending must not run into the guard page")
+			for i := range b.Bytes() {
+				b.Bytes()[i] = 0xff
+			}
+			b.Destroy()
+		}
+		_, err := NewLockedBuffer(-1)
+		assert.Error(err)
+	})
+
+	// Test case 3: The buffer is locked into RAM
+	t.Run("Locked", func(t *testing.T) {
+		before := lockedKB(t)
+		b, err := NewLockedBuffer(64 * 1024)
+		assert.NoError(err)
+		assert.GreaterOrEqual(lockedKB(t), before+64)
+		b.Destroy()
+		assert.Less(lockedKB(t), before+64)
+	})
+}
+
+// lockedKB returns VmLck from /proc/self/status.
+func lockedKB(t *testing.T) int {
+	data, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		t.Skip("no /proc/self/status")
+	}
+	var kb int
+	for _, line := range strings.Split(string(data), "\n") {
+		if n, _ := fmt.Sscanf(line, "VmLck: %d kB", &kb); n == 1 {
+			return kb
+		}
+	}
+	t.Skip("no VmLck in /proc/self/status")
+	return 0
+}
+
+func TestStore_LoadLocked(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := filepath.Join(testStoreDir, "load_locked")
+	defer os.RemoveAll(dir) //nolint: errcheck
+
+	store, err := NewStore(dir, testPassword)
+	assert.NoError(err)
+	defer store.Close()
+
+	assert.NoError(store.Save("secret", []byte("locked away")))
+	assert.NoError(store.Save("empty", []byte{}))
+
+	// Test case 1: The secret is decrypted into a locked buffer
+	t.Run("Load", func(t *testing.T) {
+		b, err := store.LoadLocked("secret")
+		assert.NoError(err)
+		assert.Equal([]byte("locked away"), b.Bytes())
+		b.Destroy()
+
+		b, err = store.LoadLocked("empty")
+		assert.NoError(err)
+		assert.Equal(0, b.Len())
+		b.Destroy()
+	})
+
+	// Test case 2: Errors are those of Load
+	t.Run("Errors", func(t *testing.T) {
+		_, err := store.LoadLocked("missing")
+		assert.ErrorContains(err, "secret not found")
+	})
+
+	// Test case 3: The store's keys are kept in locked buffers
+	t.Run("Keys", func(t *testing.T) {
+		// The watcher replaces the keys under store.mu.
+		checkKeys := func() {
+			store.mu.RLock()
+			defer store.mu.RUnlock()
+			assert.NotNil(store.primaryBuf.mem)
+			assert.NotNil(store.currentBuf.mem)
+			assert.Equal(store.primaryBuf.Bytes(), store.primaryKey)
+			assert.Equal(store.currentBuf.Bytes(), store.currentKey)
+		}
+		checkKeys()
+		assert.NoError(store.Rotate())
+		waitForRotation(t, store)
+		checkKeys()
+		data, err := store.Load("secret")
+		assert.NoError(err)
+		assert.Equal([]byte("locked away"), data)
+	})
+}
@@ -0,0 +1,403 @@
+package darkstore
+
+import (
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	manifestFileName = "manifest"
+	manifestVersion  = 4
+	manifestKeyInfo  = "darkstore manifest v1"
+)
+
+var (
+	// ErrTampered is returned when a secret or the manifest has been
+	// modified, added or deleted by something other than this library.
+	ErrTampered = errors.New("store has been tampered with")
+
+	// ErrRollback is returned when a secret or the manifest has been
+	// replaced by an older, otherwise valid, version of itself.
+	ErrRollback = errors.New("store has been rolled back")
+)
+
+// manifest is the authenticated list of every secret in a store.  It
+// lets the store notice secrets that were deleted, added, or swapped
+// for an older valid ciphertext, none of which per-file GCM can detect.
+type manifest struct {
+	generation uint64 // Incremented on every change to the manifest.
+	entries    map[string]manifestEntry
+	throttled  bool  // A ThrottlePolicy is set.
+	inboxTime  int64 // Seal time of the newest inbox entry taken in.
+}
+
+// manifestEntry records the state of a single secret.
+type manifestEntry struct {
+	revision uint64
+	modTime  int64             // When the secret was saved, in UnixNano.
+	hash     [sha256.Size]byte // SHA-256 of the encrypted data file.
+}
+
+// manifestKey derives the key used to MAC the manifest from the
+// primary key.  The caller should Wipe the result when done.
+func (s *Store) manifestKey() ([]byte, error) {
+	masterBuf := s.master()
+	defer masterBuf.Destroy()
+	master := masterBuf.Bytes()
+	return deriveManifestKey(master, s.fips)
+}
+
+// deriveManifestKey derives the manifest MAC key with HKDF-SHA256.  The
+// key of a FIPS store differs, so that the manifest of a store whose
+// FIPS marker was added or removed does not verify.
+func deriveManifestKey(primaryKey []byte, fips bool) ([]byte, error) {
+	if len(primaryKey) == 0 {
+		return nil, fmt.Errorf("store has no primary key")
+	}
+	info := manifestKeyInfo
+	if fips {
+		info = fipsManifestKeyInfo
+	}
+	return hkdf.Key(sha256.New, primaryKey, nil, info, sha256.Size)
+}
+
+// marshal serializes the manifest as a version byte, the generation,
+// the entry count, and each entry as a two-byte path length, the path,
+// the revision, the modification time and the hash, then a byte that
+// is 1 if a ThrottlePolicy is set and the inbox time, followed by an
+// HMAC-SHA256 of everything before it.  Entries are sorted by path so the output is
+// stable.
+func (m *manifest) marshal(key []byte) []byte {
+	paths := make([]string, 0, len(m.entries))
+	for path := range m.entries {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	data := make([]byte, 13)
+	data[0] = manifestVersion
+	binary.BigEndian.PutUint64(data[1:9], m.generation)
+	binary.BigEndian.PutUint32(data[9:13], uint32(len(paths)))
+	for _, path := range paths {
+		entry := m.entries[path]
+		data = binary.BigEndian.AppendUint16(data, uint16(len(path)))
+		data = append(data, path...)
+		data = binary.BigEndian.AppendUint64(data, entry.revision)
+		data = binary.BigEndian.AppendUint64(data, uint64(entry.modTime))
+		data = append(data, entry.hash[:]...)
+	}
+	if m.throttled {
+		data = append(data, 1)
+	} else {
+		data = append(data, 0)
+	}
+	data = binary.BigEndian.AppendUint64(data, uint64(m.inboxTime))
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(data)
+}
+
+// unmarshalManifest authenticates and parses a serialized manifest.
+// Version 1 manifests have no modification times, versions 1 and 2 do
+// not record a ThrottlePolicy, and versions 1 to 3 have no inbox time.
+func unmarshalManifest(data []byte, key []byte) (*manifest, error) {
+	if len(data) < 13+sha256.Size {
+		return nil, fmt.Errorf("manifest truncated: %w", ErrTampered)
+	}
+	body := data[:len(data)-sha256.Size]
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), data[len(body):]) {
+		return nil, fmt.Errorf("manifest authentication failed: %w", ErrTampered)
+	}
+	version := body[0]
+	if version < 1 || version > manifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version: %d", version)
+	}
+	entryLen := 8 + sha256.Size
+	if version >= 2 {
+		entryLen += 8
+	}
+
+	m := &manifest{
+		generation: binary.BigEndian.Uint64(body[1:9]),
+		entries:    make(map[string]manifestEntry),
+	}
+	count := binary.BigEndian.Uint32(body[9:13])
+	rest := body[13:]
+	for i := uint32(0); i < count; i++ {
+		if len(rest) < 2 {
+			return nil, fmt.Errorf("invalid manifest format")
+		}
+		pathLen := int(binary.BigEndian.Uint16(rest))
+		if len(rest) < 2+pathLen+entryLen {
+			return nil, fmt.Errorf("invalid manifest format")
+		}
+		path := string(rest[2 : 2+pathLen])
+		rest = rest[2+pathLen:]
+		var entry manifestEntry
+		entry.revision = binary.BigEndian.Uint64(rest)
+		rest = rest[8:]
+		if version >= 2 {
+			entry.modTime = int64(binary.BigEndian.Uint64(rest))
+			rest = rest[8:]
+		}
+		copy(entry.hash[:], rest[:sha256.Size])
+		rest = rest[sha256.Size:]
+		m.entries[path] = entry
+	}
+	if version >= 3 {
+		if len(rest) < 1 {
+			return nil, fmt.Errorf("invalid manifest format")
+		}
+		m.throttled = rest[0] == 1
+		rest = rest[1:]
+	}
+	if version >= 4 {
+		if len(rest) < 8 {
+			return nil, fmt.Errorf("invalid manifest format")
+		}
+		m.inboxTime = int64(binary.BigEndian.Uint64(rest))
+	}
+	return m, nil
+}
+
+// readManifest reads and authenticates the store's manifest.  The
+// caller must hold the transaction lock.
+func (s *Store) readManifest() (*manifest, error) {
+	data, err := os.ReadFile(s.manifestFile)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("manifest missing: %w", ErrTampered)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	key, err := s.manifestKey()
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(key)
+
+	m, err := unmarshalManifest(data, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.seeGeneration(m.generation); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// writeManifest bumps the manifest generation and atomically replaces
+// the on-disk manifest.  The caller must hold the exclusive
+// transaction lock.
+func (s *Store) writeManifest(m *manifest) error {
+	key, err := s.manifestKey()
+	if err != nil {
+		return err
+	}
+	defer Wipe(key)
+
+	m.generation++
+	if err := s.writeManifestFile(s.manifestFile, m, key); err != nil {
+		return err
+	}
+	return s.seeGeneration(m.generation)
+}
+
+// writeManifestFile atomically writes m, MAC'd with key, to path.
+func (s *Store) writeManifestFile(path string, m *manifest, key []byte) error {
+	tmpPath := path + ".tmp"
+	if err := s.syncWrite(tmpPath, m.marshal(key)); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// updateManifest applies fn to the manifest and writes it back.  The
+// caller must hold the exclusive transaction lock.
+func (s *Store) updateManifest(fn func(m *manifest)) error {
+	m, err := s.readManifest()
+	if err != nil {
+		return err
+	}
+	fn(m)
+	return s.writeManifest(m)
+}
+
+// set records new encrypted data for the secret at rel, saved now.
+func (m *manifest) set(rel string, encryptedData []byte) {
+	m.rewrite(rel, encryptedData)
+	entry := m.entries[rel]
+	entry.modTime = time.Now().UnixNano()
+	m.entries[rel] = entry
+}
+
+// rewrite records new encrypted data for the secret at rel without
+// changing when it was saved, as when it is re-encrypted.
+func (m *manifest) rewrite(rel string, encryptedData []byte) {
+	entry := m.entries[rel]
+	entry.revision++
+	entry.hash = sha256.Sum256(encryptedData)
+	m.entries[rel] = entry
+}
+
+// modTime returns when the secret at fullPath was last saved, as
+// recorded in the manifest, so re-encrypting it under a new key does
+// not count.  Secrets the manifest has no time for fall back to the
+// modification time of their data file.
+func (s *Store) modTime(fullPath string) (time.Time, error) {
+	lk, err := s.rLock(s.txLockFile)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error locking %s: %w", s.txLockFile, err)
+	}
+	defer lk.unlock()
+	m, err := s.readManifest()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if entry := m.entries[s.relPath(fullPath)]; entry.modTime != 0 {
+		return time.Unix(0, entry.modTime), nil
+	}
+	stat, err := os.Stat(fullPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return stat.ModTime(), nil
+}
+
+// initManifest creates a manifest listing every data file currently in
+// the store, if the store does not have one yet.  Stores created before
+// manifests existed are trusted as they are on first open.  The caller
+// must hold the exclusive transaction lock.
+func (s *Store) initManifest() error {
+	if _, err := os.Stat(s.manifestFile); err == nil {
+		return nil
+	}
+	files, err := s.listDataFiles()
+	if err != nil {
+		return fmt.Errorf("failed to list data files: %w", err)
+	}
+	m := &manifest{entries: make(map[string]manifestEntry)}
+	for _, file := range files {
+		encryptedData, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		m.rewrite(s.relPath(file), encryptedData)
+	}
+	return s.writeManifest(m)
+}
+
+// relPath returns the path of a data file relative to the store
+// directory, as used in the manifest.
+func (s *Store) relPath(fullPath string) string {
+	if abs, err := filepath.Abs(fullPath); err == nil {
+		fullPath = abs
+	}
+	rel, err := filepath.Rel(s.dir, fullPath)
+	if err != nil {
+		return fullPath
+	}
+	return filepath.ToSlash(rel)
+}
+
+// checkManifest verifies encryptedData read from fullPath against the
+// manifest.  A nil encryptedData means the file does not exist.  The
+// caller must hold the transaction lock.
+func (s *Store) checkManifest(fullPath string, encryptedData []byte) error {
+	m, err := s.readManifest()
+	if err != nil {
+		return err
+	}
+	return s.checkManifestEntry(m, fullPath, encryptedData)
+}
+
+// checkManifestEntry is checkManifest against an already read manifest.
+func (s *Store) checkManifestEntry(m *manifest, fullPath string, encryptedData []byte) error {
+	rel := s.relPath(fullPath)
+	entry, ok := m.entries[rel]
+	switch {
+	case !ok && encryptedData == nil:
+		return nil
+	case !ok:
+		return fmt.Errorf("secret %s not in manifest: %w", rel, ErrTampered)
+	case encryptedData == nil:
+		return fmt.Errorf("secret %s deleted: %w", rel, ErrTampered)
+	}
+	if sha256.Sum256(encryptedData) == entry.hash {
+		return nil
+	}
+	// The file differs from the manifest.  If it still decrypts, it
+	// is a genuine old version of this or another secret.
+	data, err := s.decryptData(encryptedData)
+	if err != nil {
+		return fmt.Errorf("secret %s modified: %w", rel, ErrTampered)
+	}
+	Wipe(data)
+	return fmt.Errorf("secret %s is not revision %d: %w", rel, entry.revision, ErrRollback)
+}
+
+// CheckIntegrity compares every data file in the store against the
+// manifest and returns an error wrapping ErrTampered or ErrRollback for
+// each secret that was modified, added, deleted or rolled back.  It
+// returns nil if the store is intact.
+//
+// The manifest cannot detect the whole store, manifest included, being
+// restored from an older backup, other than by a Store that had already
+// seen a newer manifest.
+func (s *Store) CheckIntegrity() error {
+	if s == nil {
+		return fmt.Errorf("no store")
+	}
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	lk, err := s.rLock(s.txLockFile)
+	if err != nil {
+		return fmt.Errorf("error locking %s: %w", s.txLockFile, err)
+	}
+	defer lk.unlock()
+
+	m, err := s.readManifest()
+	if err != nil {
+		return err
+	}
+	files, err := s.listDataFiles()
+	if err != nil {
+		return fmt.Errorf("failed to list data files: %w", err)
+	}
+
+	var errs []error
+	seen := make(map[string]bool)
+	for _, file := range files {
+		seen[s.relPath(file)] = true
+		encryptedData, err := os.ReadFile(file)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to read %s: %w", file, err))
+			continue
+		}
+		if err := s.checkManifestEntry(m, file, encryptedData); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for rel := range m.entries {
+		if !seen[rel] {
+			errs = append(errs, fmt.Errorf("secret %s deleted: %w", rel, ErrTampered))
+		}
+	}
+	return errors.Join(errs...)
+}
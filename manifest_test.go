@@ -0,0 +1,149 @@
+package darkstore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_manifest(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := filepath.Join(testStoreDir, "manifest_test")
+	defer os.RemoveAll(dir) //nolint: errcheck
+
+	store, err := newTestStore(dir)
+	assert.NoError(err)
+	defer store.Close()
+
+	assert.NoError(store.Save("a", []byte("alpha")))
+	assert.NoError(store.Save("b", []byte("bravo")))
+	assert.NoError(store.CheckIntegrity())
+
+	// Test case 1: Rolled-back secret
+	t.Run("Rollback", func(t *testing.T) {
+		oldData, err := os.ReadFile(filepath.Join(store.dir, "a"))
+		assert.NoError(err)
+		assert.NoError(store.Save("a", []byte("alpha v2")))
+		assert.NoError(os.WriteFile(filepath.Join(store.dir, "a"), oldData, 0600))
+
+		_, err = store.Load("a")
+		assert.True(errors.Is(err, ErrRollback), "got %v", err)
+		assert.True(errors.Is(store.CheckIntegrity(), ErrRollback))
+
+		assert.NoError(store.Save("a", []byte("alpha v3")))
+		assert.NoError(store.CheckIntegrity())
+	})
+
+	// Test case 2: Swapped secret
+	t.Run("Swapped", func(t *testing.T) {
+		bData, err := os.ReadFile(filepath.Join(store.dir, "b"))
+		assert.NoError(err)
+		aData, err := os.ReadFile(filepath.Join(store.dir, "a"))
+		assert.NoError(err)
+		assert.NoError(os.WriteFile(filepath.Join(store.dir, "a"), bData, 0600))
+
+		_, err = store.Load("a")
+		assert.True(errors.Is(err, ErrRollback), "got %v", err)
+		assert.NoError(os.WriteFile(filepath.Join(store.dir, "a"), aData, 0600))
+	})
+
+	// Test case 3: Deleted secret
+	t.Run("Deleted", func(t *testing.T) {
+		bData, err := os.ReadFile(filepath.Join(store.dir, "b"))
+		assert.NoError(err)
+		assert.NoError(os.Remove(filepath.Join(store.dir, "b")))
+
+		_, err = store.Load("b")
+		assert.True(errors.Is(err, ErrTampered), "got %v", err)
+		assert.True(errors.Is(store.CheckIntegrity(), ErrTampered))
+		assert.NoError(os.WriteFile(filepath.Join(store.dir, "b"), bData, 0600))
+	})
+
+	// Test case 4: Added secret
+	t.Run("Added", func(t *testing.T) {
+		bData, err := os.ReadFile(filepath.Join(store.dir, "b"))
+		assert.NoError(err)
+		assert.NoError(os.WriteFile(filepath.Join(store.dir, "c"), bData, 0600))
+
+		_, err = store.Load("c")
+		assert.True(errors.Is(err, ErrTampered), "got %v", err)
+		assert.True(errors.Is(store.CheckIntegrity(), ErrTampered))
+		assert.NoError(os.Remove(filepath.Join(store.dir, "c")))
+	})
+
+	// Test case 5: Modified secret
+	t.Run("Modified", func(t *testing.T) {
+		path := filepath.Join(store.dir, "b")
+		bData, err := os.ReadFile(path)
+		assert.NoError(err)
+		modified := append([]byte{}, bData...)
+		modified[len(modified)-1] ^= 0xff
+		assert.NoError(os.WriteFile(path, modified, 0600))
+
+		_, err = store.Load("b")
+		assert.True(errors.Is(err, ErrTampered), "got %v", err)
+		assert.NoError(os.WriteFile(path, bData, 0600))
+	})
+
+	// Test case 6: Forged or rolled-back manifest
+	t.Run("Manifest", func(t *testing.T) {
+		oldManifest, err := os.ReadFile(store.manifestFile)
+		assert.NoError(err)
+
+		forged := append([]byte{}, oldManifest...)
+		forged[1] ^= 0xff
+		assert.NoError(os.WriteFile(store.manifestFile, forged, 0600))
+		_, err = store.Load("a")
+		assert.True(errors.Is(err, ErrTampered), "got %v", err)
+
+		assert.NoError(os.WriteFile(store.manifestFile, oldManifest, 0600))
+		assert.NoError(store.Delete("b"))
+		assert.NoError(os.WriteFile(store.manifestFile, oldManifest, 0600))
+		_, err = store.Load("a")
+		assert.True(errors.Is(err, ErrRollback), "got %v", err)
+	})
+}
+
+func TestManifest_marshal(t *testing.T) {
+	assert := assert.New(t)
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	m := &manifest{generation: 7, entries: make(map[string]manifestEntry), throttled: true, inboxTime: 42}
+	m.set("x/y", []byte("one"))
+	m.set("z", []byte("two"))
+	m.set("z", []byte("three"))
+
+	got, err := unmarshalManifest(m.marshal(key), key)
+	assert.NoError(err)
+	assert.Equal(m, got)
+	assert.Equal(uint64(2), got.entries["z"].revision)
+
+	_, err = unmarshalManifest(m.marshal(key), []byte("wrong key wrong key wrong key!!!"))
+	assert.True(errors.Is(err, ErrTampered))
+
+	_, err = unmarshalManifest([]byte{1, 2, 3}, key)
+	assert.True(errors.Is(err, ErrTampered))
+
+	// Version 1 manifests, without modification times, still load.
+	hash := m.entries["z"].hash
+	v1 := []byte{1}
+	v1 = binary.BigEndian.AppendUint64(v1, 7)
+	v1 = binary.BigEndian.AppendUint32(v1, 1)
+	v1 = binary.BigEndian.AppendUint16(v1, 1)
+	v1 = append(v1, 'z')
+	v1 = binary.BigEndian.AppendUint64(v1, 2)
+	v1 = append(v1, hash[:]...)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(v1)
+	got, err = unmarshalManifest(mac.Sum(v1), key)
+	assert.NoError(err)
+	assert.Equal(hash, got.entries["z"].hash)
+	assert.Zero(got.entries["z"].modTime)
+}
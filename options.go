@@ -0,0 +1,30 @@
+package darkstore
+
+import (
+	"time"
+)
+
+// Option configures a Store opened or created by NewStore.
+type Option func(*options)
+
+// options holds the settings selected by Options.
+type options struct {
+	recoveryKey    *[]byte         // Receives the recovery key of a new store.
+	wrapper        KeyWrapper      // Wraps the data keys instead of the master key.
+	harden         bool            // Disable core dumps and ptrace while open.
+	idleTimeout    time.Duration   // Lock the store after this long unused.
+	passwordPolicy *PasswordPolicy // Checks new passwords.
+	fips           bool            // Create or require a FIPS store.
+	watch          watchOptions    // Settings of the key watcher.
+}
+
+// WithRecoveryKey has NewStore generate a recovery key when it creates
+// a new store and return it in *out.  The recovery key unlocks its own
+// key slot and can be used with RecoverWithKey to reset the password
+// if it is lost.  Print it or write it down, then Wipe it.  When an
+// existing store is opened, *out is set to nil.
+func WithRecoveryKey(out *[]byte) Option {
+	return func(o *options) {
+		o.recoveryKey = out
+	}
+}
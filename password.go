@@ -0,0 +1,303 @@
+package darkstore
+
+import (
+	"bytes"
+	_ "embed" // For the list of common passwords.
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// commonPasswordList holds common passwords, most common first.
+//
+//go:embed common_passwords.txt
+var commonPasswordList string
+
+// commonPasswords maps each common password to its rank.
+var commonPasswords = sync.OnceValue(func() map[string]int {
+	ranks := make(map[string]int)
+	for i, pw := range strings.Split(commonPasswordList, "\n") {
+		if pw != "" {
+			ranks[pw] = i + 1
+		}
+	}
+	return ranks
+})
+
+// PasswordRule names the rule of a PasswordPolicy that a password
+// broke.
+type PasswordRule string
+
+const (
+	RuleMinLength PasswordRule = "min-length" // Shorter than MinLength.
+	RuleEntropy   PasswordRule = "entropy"    // Easier to guess than MinEntropy.
+	RuleCommon    PasswordRule = "common"     // A common password.
+	RuleReuse     PasswordRule = "reuse"      // The password being replaced.
+	RuleCustom    PasswordRule = "custom"     // Rejected by PasswordPolicy.Check.
+)
+
+// ErrWeakPassword is returned when a password does not meet the
+// store's PasswordPolicy.  Use errors.As to see which rule it broke.
+type ErrWeakPassword struct {
+	Rule    PasswordRule
+	Reason  string
+	Entropy float64 // Estimated bits of entropy of the password.
+	Err     error   // The error from PasswordPolicy.Check, for RuleCustom.
+}
+
+func (e *ErrWeakPassword) Error() string {
+	return "weak password: " + e.Reason
+}
+
+func (e *ErrWeakPassword) Unwrap() error {
+	return e.Err
+}
+
+// PasswordPolicy is what NewStore requires of the password of a new
+// store, and Passwd of a new password, when the store is opened
+// WithPasswordPolicy.  Zero fields are not checked.
+type PasswordPolicy struct {
+	// MinLength is the least number of characters.
+	MinLength int
+	// MinEntropy is the least estimated entropy, in bits.  The estimate
+	// counts repeated characters, sequences, keyboard runs and common
+	// passwords as the few guesses they take, in the manner of zxcvbn.
+	MinEntropy float64
+	// DenyCommon rejects passwords from darkstore's list of common
+	// passwords, ignoring case and l33t substitutions.
+	DenyCommon bool
+	// DenyReuse has Passwd reject the password it would replace.
+	DenyReuse bool
+	// Check, if set, is called last, and rejects the password if it
+	// returns an error.
+	Check func(password []byte) error
+}
+
+// DefaultPasswordPolicy returns a PasswordPolicy requiring 12
+// characters and 50 bits of entropy, and denying common and reused
+// passwords.
+func DefaultPasswordPolicy() *PasswordPolicy {
+	return &PasswordPolicy{
+		MinLength:  12,
+		MinEntropy: 50,
+		DenyCommon: true,
+		DenyReuse:  true,
+	}
+}
+
+// WithPasswordPolicy has NewStore and Passwd reject passwords that do
+// not meet p with an *ErrWeakPassword.
+func WithPasswordPolicy(p *PasswordPolicy) Option {
+	return func(o *options) {
+		o.passwordPolicy = p
+	}
+}
+
+// CheckPassword returns an *ErrWeakPassword if password does not meet
+// p.  It does not check reuse, which needs the store.
+func (p *PasswordPolicy) CheckPassword(password []byte) error {
+	if p == nil {
+		return nil
+	}
+	entropy := estimateEntropy(password)
+	if n := utf8.RuneCount(password); n < p.MinLength {
+		return &ErrWeakPassword{
+			Rule:    RuleMinLength,
+			Reason:  fmt.Sprintf("%d characters, at least %d needed", n, p.MinLength),
+			Entropy: entropy,
+		}
+	}
+	if p.DenyCommon && isCommonPassword(password) {
+		return &ErrWeakPassword{
+			Rule:    RuleCommon,
+			Reason:  "a commonly used password",
+			Entropy: entropy,
+		}
+	}
+	if entropy < p.MinEntropy {
+		return &ErrWeakPassword{
+			Rule:    RuleEntropy,
+			Reason:  fmt.Sprintf("about %.0f bits of entropy, at least %.0f needed", entropy, p.MinEntropy),
+			Entropy: entropy,
+		}
+	}
+	if p.Check != nil {
+		if err := p.Check(password); err != nil {
+			return &ErrWeakPassword{
+				Rule:    RuleCustom,
+				Reason:  err.Error(),
+				Entropy: entropy,
+				Err:     err,
+			}
+		}
+	}
+	return nil
+}
+
+// checkReuse returns an *ErrWeakPassword if the policy denies reuse and
+// password unlocks ks.
+func (p *PasswordPolicy) checkReuse(password []byte, ks *keySlot) error {
+	if p == nil || !p.DenyReuse || ks == nil {
+		return nil
+	}
+	key, err := ks.unwrap(password)
+	if err != nil {
+		return nil
+	}
+	Wipe(key)
+	return &ErrWeakPassword{
+		Rule:    RuleReuse,
+		Reason:  "the same as the current password",
+		Entropy: estimateEntropy(password),
+	}
+}
+
+// Passwords are only ever copied into byte slices, which are wiped, and
+// never into strings.  Indexing a map with string(b) does not copy b.
+
+// isCommonPassword reports whether password is on the list of common
+// passwords, ignoring case and l33t substitutions.
+func isCommonPassword(password []byte) bool {
+	lower := bytes.ToLower(password)
+	defer Wipe(lower)
+	if _, ok := commonPasswords()[string(lower)]; ok {
+		return true
+	}
+	unleet(lower)
+	_, ok := commonPasswords()[string(lower)]
+	return ok
+}
+
+// leet maps common l33t substitutions back to letters.
+var leet = map[byte]byte{
+	'@': 'a', '4': 'a', '3': 'e', '1': 'i', '!': 'i',
+	'0': 'o', '$': 's', '5': 's', '7': 't',
+}
+
+// unleet undoes common l33t substitutions in b.
+func unleet(b []byte) {
+	for i, c := range b {
+		if l, ok := leet[c]; ok {
+			b[i] = l
+		}
+	}
+}
+
+// keyboardRows are runs of adjacent keys that count as sequences.
+var keyboardRows = []string{
+	"`1234567890-=", "qwertyuiop[]", "asdfghjkl;'", "zxcvbnm,./",
+}
+
+// estimateEntropy returns a rough estimate, in bits, of how hard
+// password is to guess.  Like zxcvbn, it splits the password into
+// patterns: a common password costs the log of its rank, a run of
+// repeated characters, of sequential characters, or of adjacent keys
+// costs about as much as its first character, and any other character
+// costs the log of the size of the character classes used.
+func estimateEntropy(password []byte) float64 {
+	lower := bytes.ToLower(password)
+	defer Wipe(lower)
+	if rank, ok := commonPasswords()[string(lower)]; ok {
+		return math.Log2(float64(rank) + 1)
+	}
+	charBits := math.Log2(float64(charsetSize(password)))
+	bits := 0.0
+	for i := 0; i < len(lower); {
+		if n, rank := commonPrefix(lower[i:]); n > 0 {
+			bits += math.Log2(float64(rank)+1) + 1
+			i += n
+			continue
+		}
+		if n := patternLen(lower[i:]); n >= 3 {
+			bits += charBits + math.Log2(float64(n))
+			i += n
+			continue
+		}
+		_, size := utf8.DecodeRune(lower[i:])
+		bits += charBits
+		i += size
+	}
+	return bits
+}
+
+// charsetSize returns the number of characters in the classes of the
+// characters in password.
+func charsetSize(password []byte) int {
+	var lower, upper, digit, symbol, other bool
+	for i := 0; i < len(password); {
+		r, size := utf8.DecodeRune(password[i:])
+		i += size
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < utf8.RuneSelf:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	size := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.used {
+			size += class.size
+		}
+	}
+	return max(size, 2)
+}
+
+// commonPrefix returns the length and rank of the longest common
+// password of at least four characters that s starts with.
+func commonPrefix(s []byte) (int, int) {
+	best, bestRank := 0, 0
+	for n := 4; n <= len(s); n++ {
+		if rank, ok := commonPasswords()[string(s[:n])]; ok {
+			best, bestRank = n, rank
+		}
+	}
+	return best, bestRank
+}
+
+// patternLen returns the length of the run of repeated characters,
+// sequential characters, or adjacent keys that s starts with.
+func patternLen(s []byte) int {
+	best := 1
+	for _, step := range []int{0, 1, -1} {
+		n := 1
+		for n < len(s) && int(s[n])-int(s[n-1]) == step {
+			n++
+		}
+		best = max(best, n)
+	}
+	for _, row := range keyboardRows {
+		for _, r := range []string{row, reverse(row)} {
+			i := strings.IndexByte(r, s[0])
+			if i < 0 {
+				continue
+			}
+			n := 1
+			for n < len(s) && i+n < len(r) && s[n] == r[i+n] {
+				n++
+			}
+			best = max(best, n)
+		}
+	}
+	return best
+}
+
+// reverse returns s, which is ASCII, backwards.
+func reverse(s string) string {
+	b := []byte(s)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
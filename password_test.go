@@ -0,0 +1,132 @@
+package darkstore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	assert := assert.New(t)
+	policy := DefaultPasswordPolicy()
+
+	rule := func(password string) PasswordRule {
+		var weak *ErrWeakPassword
+		if errors.As(policy.CheckPassword([]byte(password)), &weak) {
+			return weak.Rule
+		}
+		return ""
+	}
+
+	// Test case 1: Each rule rejects what it should
+	t.Run("Rules", func(t *testing.T) {
+		assert.Equal(RuleMinLength, rule("short"))
+		assert.Equal(RuleEntropy, rule("qwerty123456"))
+		assert.Equal(RuleEntropy, rule("aaaaaaaaaaaaaaaa"))
+		assert.Equal(RuleEntropy, rule("abcdefghijklmnop"))
+		assert.Equal(RuleEntropy, rule("qwertyuiopasdfgh"))
+		assert.Equal(RuleEntropy, rule("password12345678"))
+		assert.Equal(PasswordRule(""), rule("correct horse battery staple"))
+		assert.Equal(PasswordRule(""), rule("T7#kq9!vLz2@wMx4"))
+	})
+
+	// Test case 2: Common passwords are found whatever their case or l33t
+	t.Run("Common", func(t *testing.T) {
+		common := &PasswordPolicy{DenyCommon: true}
+		assert.Error(common.CheckPassword([]byte("password")))
+		assert.Error(common.CheckPassword([]byte("PassWord")))
+		assert.Error(common.CheckPassword([]byte("P@$$w0rd")))
+		assert.NoError(common.CheckPassword([]byte("Tr0ub4dor&3")))
+	})
+
+	// Test case 3: The entropy estimate sees through patterns
+	t.Run("Entropy", func(t *testing.T) {
+		assert.Less(estimateEntropy([]byte("password")), 2.0)
+		assert.Less(estimateEntropy([]byte("1111111111")), 20.0)
+		assert.Less(estimateEntropy([]byte("9876543210")), 20.0)
+		assert.Less(estimateEntropy([]byte("zyxwvutsrq")), 20.0)
+		assert.Greater(estimateEntropy([]byte("T7#kq9!vLz2@wMx4")), 90.0)
+	})
+
+	// Test case 4: A custom check is wrapped in ErrWeakPassword
+	t.Run("Custom", func(t *testing.T) {
+		errNoSpace := errors.New("must not contain spaces")
+		custom := &PasswordPolicy{Check: func(pw []byte) error {
+			for _, c := range pw {
+				if c == ' ' {
+					return errNoSpace
+				}
+			}
+			return nil
+		}}
+		err := custom.CheckPassword([]byte("a b"))
+		var weak *ErrWeakPassword
+		assert.True(errors.As(err, &weak))
+		assert.Equal(RuleCustom, weak.Rule)
+		assert.ErrorIs(err, errNoSpace)
+		assert.ErrorContains(err, "weak password: must not contain spaces")
+		assert.NoError(custom.CheckPassword([]byte("ab")))
+	})
+
+	// Test case 5: A nil policy allows anything
+	t.Run("Nil", func(t *testing.T) {
+		var none *PasswordPolicy
+		assert.NoError(none.CheckPassword([]byte("1")))
+	})
+}
+
+func TestStore_PasswordPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := filepath.Join(testStoreDir, "password_policy")
+	defer os.RemoveAll(dir) //nolint: errcheck
+
+	strong := []byte("T7#kq9!vLz2@wMx4")
+	policy := WithPasswordPolicy(DefaultPasswordPolicy())
+
+	// Test case 1: A new store needs a strong password
+	t.Run("Create", func(t *testing.T) {
+		_, err := NewStore(dir, []byte("letmein"), policy)
+		var weak *ErrWeakPassword
+		assert.True(errors.As(err, &weak))
+		assert.Equal(RuleMinLength, weak.Rule)
+		_, err = os.Stat(dir)
+		assert.True(os.IsNotExist(err))
+
+		store, err := NewStore(dir, strong, policy)
+		assert.NoError(err)
+		store.Close()
+	})
+
+	// Test case 2: The policy is not applied to opening a store
+	t.Run("Open", func(t *testing.T) {
+		store, err := NewStore(dir, strong, WithPasswordPolicy(&PasswordPolicy{MinLength: 100}))
+		assert.NoError(err)
+		store.Close()
+	})
+
+	// Test case 3: Passwd rejects weak and reused passwords
+	t.Run("Passwd", func(t *testing.T) {
+		store, err := NewStore(dir, strong, policy)
+		assert.NoError(err)
+		defer store.Close()
+
+		var weak *ErrWeakPassword
+		assert.True(errors.As(store.Passwd([]byte("password")), &weak))
+		assert.Equal(RuleMinLength, weak.Rule)
+		assert.True(errors.As(store.Passwd([]byte("aaaaaaaaaaaaaaaaaaaa")), &weak))
+		assert.Equal(RuleEntropy, weak.Rule)
+		assert.True(errors.As(store.Passwd(append([]byte{}, strong...)), &weak))
+		assert.Equal(RuleReuse, weak.Rule)
+
+		newpw := []byte("Zr8$mQ2!xPw5&nLk")
+		assert.NoError(store.Passwd(append([]byte{}, newpw...)))
+		store.Close()
+		store, err = NewStore(dir, newpw)
+		assert.NoError(err)
+		store.Close()
+	})
+}
@@ -0,0 +1,270 @@
+package darkstore
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+)
+
+const (
+	recoverySlotName   = "recovery"
+	recoveryKeyLen     = 20 // Bytes of entropy == 160 bits
+	recoveryGroupLen   = 4  // Characters per group
+	recoveryAlphabet   = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	recoveryGroups     = recoveryKeyLen * 8 / 5 / recoveryGroupLen
+	recoveryCheckWords = 2 // One byte of checksum each
+	recoveryWordLen    = 4
+	recoveryGroupSep   = '-'
+	recoveryKeyLength  = recoveryGroups*(recoveryGroupLen+1) +
+		recoveryCheckWords*(recoveryWordLen+1) - 1
+)
+
+// recoveryWords are the checksum words of recovery keys, one for each
+// byte value.  They are all recoveryWordLen letters long.
+var recoveryWords = strings.Fields(`
+	able acid aged area army away back bake band bank barn bath bead beam bear beef
+	belt bend best bird blue body bold bolt book boot born both bowl burn busy cake
+	camp card cart case cash cell chat chef city clay club coal coat coin cold cook
+	cope copy core corn cost crop cube dark data dawn dear deck deep desk dial diet
+	dish dock dose dove draw drum duck dust duty each east easy epic even exit fact
+	fair fast fern file find fire fish flag flat foam fold folk foot fork form four
+	free fuel full fund game gate gift girl glad glue goal goat golf good grid grow
+	gulf half hall harp hawk head helm herb hero hint home hook hope horn hour huge
+	idea inch iron jazz join joke jury keen kelp kind king knee knot lake lamp land
+	last lava lawn lens lift lime line lion loaf lock loft long loom lord loud luck
+	mail main mane mark mask meal menu mild mill mint mode mood moon moth much mule
+	name navy neck nest news nice nine noon nose note oboe okra open oven palm path
+	peak pear pink pipe plum poem pond pool port post quiz rain rare reed reef ride
+	ring robe rock roof rope rose ruby safe sage salt sand seal ship shoe silk sink
+	site skin slow snow sock soft song soup star step swan tail tank taxi tent tide
+	tile toad tree twin vase veil view vine void wave wind wood wool yard zero zinc
+`)
+
+// newRecoveryKey generates a random recovery key and returns both its
+// raw bytes, which the recovery slot is derived from, and its printable
+// form.
+func newRecoveryKey() ([]byte, []byte, error) {
+	raw := make([]byte, recoveryKeyLen)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate recovery key: %w", err)
+	}
+	return raw, formatRecoveryKey(raw), nil
+}
+
+// formatRecoveryKey encodes raw in Crockford base32, split into groups
+// of four characters, and follows it with checksum words taken from a
+// hash of raw, so that a mistyped key is reported as such rather than
+// just failing to unlock the store.
+func formatRecoveryKey(raw []byte) []byte {
+	values := make([]byte, 0, len(raw)*8/5)
+	var acc uint
+	bits := 0
+	for _, b := range raw {
+		acc = acc<<8 | uint(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			values = append(values, byte(acc>>bits)&31)
+		}
+	}
+
+	out := make([]byte, 0, recoveryKeyLength)
+	for g := 0; g < recoveryGroups; g++ {
+		if g > 0 {
+			out = append(out, recoveryGroupSep)
+		}
+		for _, v := range values[g*recoveryGroupLen : (g+1)*recoveryGroupLen] {
+			out = append(out, recoveryAlphabet[v])
+		}
+	}
+	Wipe(values)
+	for _, b := range recoveryChecksum(raw) {
+		out = append(out, recoveryGroupSep)
+		out = append(out, recoveryWords[b]...)
+	}
+	return out
+}
+
+// parseRecoveryKey decodes a recovery key written by formatRecoveryKey.
+// Case, spaces, separators and the letters commonly confused with
+// digits are forgiven.
+func parseRecoveryKey(key []byte) ([]byte, error) {
+	chars := make([]byte, 0, recoveryKeyLength)
+	defer func() { Wipe(chars) }()
+	for _, c := range key {
+		switch c {
+		case ' ', '\t', '\n', '\r', recoveryGroupSep:
+			continue
+		}
+		chars = append(chars, c)
+	}
+	dataLen := recoveryGroups * recoveryGroupLen
+	if len(chars) != dataLen+recoveryCheckWords*recoveryWordLen {
+		return nil, fmt.Errorf("recovery key has the wrong length")
+	}
+
+	raw := make([]byte, 0, recoveryKeyLen)
+	var acc uint
+	bits := 0
+	for _, c := range chars[:dataLen] {
+		switch c {
+		case 'O', 'o':
+			c = '0'
+		case 'I', 'i', 'L', 'l':
+			c = '1'
+		}
+		v := strings.IndexByte(recoveryAlphabet, upper(c))
+		if v < 0 {
+			Wipe(raw)
+			return nil, fmt.Errorf("invalid character in recovery key")
+		}
+		acc = acc<<5 | uint(v)
+		bits += 5
+		if bits >= 8 {
+			bits -= 8
+			raw = append(raw, byte(acc>>bits))
+		}
+	}
+
+	sum := recoveryChecksum(raw)
+	for i := range sum {
+		word := chars[dataLen+i*recoveryWordLen : dataLen+(i+1)*recoveryWordLen]
+		if !strings.EqualFold(string(word), recoveryWords[sum[i]]) {
+			Wipe(raw)
+			if recoveryWordIndex(word) < 0 {
+				return nil, fmt.Errorf("recovery key checksum word %d is not a recovery word", i+1)
+			}
+			return nil, fmt.Errorf("recovery key is mistyped")
+		}
+	}
+	return raw, nil
+}
+
+// recoveryChecksum returns the bytes the checksum words of raw encode.
+func recoveryChecksum(raw []byte) []byte {
+	sum := sha256.Sum256(raw)
+	return sum[:recoveryCheckWords]
+}
+
+// recoveryWordIndex returns the index of word in recoveryWords, or -1.
+func recoveryWordIndex(word []byte) int {
+	for i, w := range recoveryWords {
+		if strings.EqualFold(string(word), w) {
+			return i
+		}
+	}
+	return -1
+}
+
+func upper(c byte) byte {
+	if c >= 'a' && c <= 'z' {
+		return c - 'a' + 'A'
+	}
+	return c
+}
+
+// newRecoverySlot generates a recovery key and wraps master in a
+// recovery slot under it.  It returns the slot and the printable
+// recovery key.
+func newRecoverySlot(master []byte, kdf uint8) (*keySlot, []byte, error) {
+	raw, printable, err := newRecoveryKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer Wipe(raw)
+	ks, err := newDerivedSlot(recoverySlotName, slotTypeRecovery, raw, master, kdf)
+	if err != nil {
+		Wipe(printable)
+		return nil, nil, err
+	}
+	return ks, printable, nil
+}
+
+// createRecoverySlot generates a recovery key, wraps the master key in
+// the recovery slot under it, and returns the printable recovery key.
+func (s *Store) createRecoverySlot() ([]byte, error) {
+	ks, printable, err := newRecoverySlot(s.primaryKey, s.slotKDF())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.writeSlot(s.keyDir, ks); err != nil {
+		Wipe(printable)
+		return nil, err
+	}
+	return printable, nil
+}
+
+// AddRecoverySlot gives a store without a recovery slot one, as
+// WithRecoveryKey does for a new store, and returns the recovery key.
+// To replace a recovery key, remove the recovery slot with
+// RemoveKeySlot first.
+func (s *Store) AddRecoverySlot() ([]byte, error) {
+	if s == nil {
+		return nil, fmt.Errorf("no store")
+	}
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	if err := s.checkMaster(); err != nil {
+		return nil, err
+	}
+	masterBuf := s.master()
+	defer masterBuf.Destroy()
+	ks, printable, err := newRecoverySlot(masterBuf.Bytes(), s.slotKDF())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.addSlot(ks); err != nil {
+		Wipe(printable)
+		return nil, err
+	}
+	return printable, nil
+}
+
+// RecoverWithKey unlocks the store at dir with a recovery key from
+// WithRecoveryKey and sets the password of its default key slot to
+// newPassword, creating the slot if it was removed.  The change is made
+// with the same atomic swap of the keys directory as Passwd, and, as
+// with Passwd, newPassword is wiped.  The store's other slots, the
+// recovery slot included, keep working.  opts are the store's options;
+// with WithPasswordPolicy, a weak newPassword is rejected with
+// *ErrWeakPassword before the store is unlocked.
+func RecoverWithKey(dir string, recoveryKey []byte, newPassword []byte, opts ...Option) error {
+	if len(newPassword) == 0 {
+		return fmt.Errorf("password must not be empty")
+	}
+	raw, err := parseRecoveryKey(recoveryKey)
+	if err != nil {
+		return err
+	}
+	defer Wipe(raw)
+
+	s, err := newStoreHandle(dir, opts...)
+	if err != nil {
+		return err
+	}
+	if err := s.opts.passwordPolicy.CheckPassword(newPassword); err != nil {
+		return err
+	}
+	isNewStore, err := s.checkNewStore()
+	if err != nil {
+		return err
+	}
+	if isNewStore {
+		return fmt.Errorf("no store at %s", s.dir)
+	}
+	defer s.Close()
+
+	err = s.openExistingStore(func() error {
+		return s.unlockSlotsOfKind(slotTypeRecovery, raw)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to unlock %s with recovery key: %w", s.dir, err)
+	}
+
+	s.mu.Lock()
+	s.slotName = defaultSlotName
+	s.mu.Unlock()
+	return s.Passwd(newPassword)
+}
@@ -0,0 +1,163 @@
+package darkstore
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecoveryKeyFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	raw := []byte("0123456789abcdefghij")
+	key := formatRecoveryKey(raw)
+	assert.Len(key, recoveryKeyLength)
+
+	// Test case 1: Round trip, forgiving case and look-alike letters
+	t.Run("Round trip", func(t *testing.T) {
+		parsed, err := parseRecoveryKey(key)
+		assert.NoError(err)
+		assert.Equal(raw, parsed)
+
+		sloppy := bytes.ToLower(bytes.ReplaceAll(key, []byte("-"), []byte(" ")))
+		sloppy = bytes.ReplaceAll(sloppy, []byte("0"), []byte("o"))
+		parsed, err = parseRecoveryKey(sloppy)
+		assert.NoError(err)
+		assert.Equal(raw, parsed)
+	})
+
+	// Test case 2: Typos are caught by the checksum words
+	t.Run("Typos", func(t *testing.T) {
+		typo := append([]byte{}, key...)
+		i := 5 // First character of the second group
+		if typo[i] == '2' {
+			typo[i] = '3'
+		} else {
+			typo[i] = '2'
+		}
+		_, err := parseRecoveryKey(typo)
+		assert.Error(err)
+		assert.Contains(err.Error(), "mistyped")
+
+		swapped := append([]byte{}, key...)
+		copy(swapped[0:4], key[5:9])
+		copy(swapped[5:9], key[0:4])
+		if !bytes.Equal(swapped, key) {
+			_, err = parseRecoveryKey(swapped)
+			assert.Error(err)
+		}
+
+		badWord := append([]byte{}, key...)
+		copy(badWord[len(badWord)-recoveryWordLen:], "qqqq")
+		_, err = parseRecoveryKey(badWord)
+		assert.Error(err)
+		assert.Contains(err.Error(), "checksum word 2")
+
+		_, err = parseRecoveryKey(key[:len(key)-1])
+		assert.Error(err)
+		_, err = parseRecoveryKey([]byte("not a recovery key!"))
+		assert.Error(err)
+	})
+
+	// Test case 3: One checksum word for each byte value
+	t.Run("Words", func(t *testing.T) {
+		assert.Len(recoveryWords, 256)
+		seen := make(map[string]bool)
+		for _, w := range recoveryWords {
+			assert.Len(w, recoveryWordLen)
+			assert.False(seen[w], w)
+			seen[w] = true
+		}
+	})
+}
+
+func TestRecoverWithKey(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := filepath.Join(testStoreDir, "recover_with_key")
+	defer os.RemoveAll(dir) //nolint: errcheck
+
+	var recoveryKey []byte
+	store, err := NewStore(dir, testPassword, WithRecoveryKey(&recoveryKey))
+	assert.NoError(err)
+	assert.Len(recoveryKey, recoveryKeyLength)
+	assert.NoError(store.Save("secret", []byte("precious")))
+	store.Close()
+
+	// Test case 1: Reopening does not hand out a recovery key
+	t.Run("Existing store", func(t *testing.T) {
+		var again []byte
+		store, err := NewStore(dir, testPassword, WithRecoveryKey(&again))
+		assert.NoError(err)
+		assert.Nil(again)
+		slots, err := store.ListKeySlots()
+		assert.NoError(err)
+		assert.Len(slots, 2)
+		assert.Equal("recovery", slots[1].Type)
+		store.Close()
+
+		_, err = NewStore(dir, recoveryKey)
+		assert.True(errors.Is(err, ErrNoMatchingSlot), "recovery key is not a password")
+	})
+
+	// Test case 2: Reset a lost password
+	t.Run("Recover", func(t *testing.T) {
+		assert.NoError(RecoverWithKey(dir, recoveryKey, []byte("brand-new-password")))
+		assert.False(checkDirExists(filepath.Join(dir, newPwDirName)))
+		assert.False(checkDirExists(filepath.Join(dir, oldPwDirName)))
+
+		_, err := NewStore(dir, testPassword)
+		assert.Error(err)
+		store, err := NewStore(dir, []byte("brand-new-password"))
+		assert.NoError(err)
+		data, err := store.Load("secret")
+		assert.NoError(err)
+		assert.Equal([]byte("precious"), data)
+		store.Close()
+	})
+
+	// Test case 3: Bad recovery keys and stores
+	t.Run("Failures", func(t *testing.T) {
+		other := formatRecoveryKey(make([]byte, recoveryKeyLen))
+		err := RecoverWithKey(dir, other, []byte("password"))
+		assert.True(errors.Is(err, ErrNoMatchingSlot), "got %v", err)
+		assert.Error(RecoverWithKey(dir, recoveryKey, nil))
+		var weak *ErrWeakPassword
+		err = RecoverWithKey(dir, recoveryKey, []byte("password"),
+			WithPasswordPolicy(DefaultPasswordPolicy()))
+		assert.True(errors.As(err, &weak), "got %v", err)
+
+		noRecovery := filepath.Join(testStoreDir, "recover_without_key")
+		defer os.RemoveAll(noRecovery) //nolint: errcheck
+		store, err := NewStore(noRecovery, testPassword)
+		assert.NoError(err)
+		store.Close()
+		assert.Error(RecoverWithKey(noRecovery, recoveryKey, []byte("password")))
+
+		empty := filepath.Join(testStoreDir, "recover_no_store")
+		defer os.RemoveAll(empty) //nolint: errcheck
+		assert.Error(RecoverWithKey(empty, recoveryKey, []byte("password")))
+	})
+
+	// Test case 4: A recovery slot can be added to an existing store
+	t.Run("Add recovery slot", func(t *testing.T) {
+		later := filepath.Join(testStoreDir, "recover_added_later")
+		defer os.RemoveAll(later) //nolint: errcheck
+		store, err := NewStore(later, testPassword)
+		assert.NoError(err)
+		key, err := store.AddRecoverySlot()
+		assert.NoError(err)
+		_, err = store.AddRecoverySlot()
+		assert.Error(err, "only one recovery slot")
+		store.Close()
+
+		assert.NoError(RecoverWithKey(later, key, []byte("password")))
+		store, err = NewStore(later, []byte("password"))
+		assert.NoError(err)
+		store.Close()
+	})
+}
@@ -0,0 +1,274 @@
+package darkstore
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrUnrewrappable is returned by RewrapKeys when the store has key
+// slots it cannot rewrap and RemoveUnrewrappable is not set.
+var ErrUnrewrappable = errors.New("key slots cannot be rewrapped")
+
+// RewrapOptions controls RewrapKeys.
+type RewrapOptions struct {
+	// RemoveUnrewrappable removes the slots that wrap the master key
+	// under a credential the store does not hold, such as other
+	// passwords, key files, Shamir shares and KMS keys.  Otherwise
+	// RewrapKeys fails with ErrUnrewrappable if there are any.
+	RemoveUnrewrappable bool
+}
+
+// RewrapKeys replaces the store's master key with a new random one, for
+// when key files or key slots may have leaked.  The key files, the
+// write key, the manifest and the ThrottlePolicy are wrapped or MAC'd
+// under the new master key, and
+// the password slot the store was unlocked with gets a fresh salt under
+// the same password, which must be given again.  Recipient and SSH
+// slots are rewrapped to their public keys.  If the store has a
+// recovery slot, it gets a new recovery key, which is returned and
+// replaces the old one.  Every other slot wraps the master key under a
+// credential the store does not hold, so RewrapKeys fails, naming
+// them, unless opts.RemoveUnrewrappable is set.  Then they are removed
+// and their names returned; add them again with the new master key.
+// The data keys themselves do not change, so Rotate too if they may be
+// known.
+//
+// Like Passwd, it works on a copy of the keys directory and swaps it in,
+// so an interruption leaves the store usable with the old or the new
+// master key, and writes zeroes over the old key files and slots.
+// Other processes with the store open must reopen it.
+func (s *Store) RewrapKeys(password []byte, opts RewrapOptions) (removed []string, recoveryKey []byte, err error) {
+	if s == nil {
+		return nil, nil, fmt.Errorf("no store")
+	}
+	if err := s.checkOpen(); err != nil {
+		return nil, nil, err
+	}
+	if err := s.checkMaster(); err != nil {
+		return nil, nil, err
+	}
+	if len(password) == 0 {
+		return nil, nil, fmt.Errorf("password must not be empty")
+	}
+
+	lk, err := s.lockNB(s.lockFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("store at %s is being modified: %w", s.dir, err)
+	}
+	defer lk.unlock()
+	txLk, err := s.lock(s.txLockFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error locking %s: %w", s.txLockFile, err)
+	}
+	defer txLk.unlock()
+
+	keys, err := filepath.Glob(filepath.Join(s.keyDir, "key*"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read keys directory: %w", err)
+	}
+	if len(keys) > 1 {
+		return nil, nil, fmt.Errorf("key rotation in progress, try again when it is done")
+	}
+	if !s.hasSlots() {
+		return nil, nil, fmt.Errorf("store at %s has no key slots, reopen it to upgrade", s.dir)
+	}
+
+	// The password must be the one the store was unlocked with.
+	masterBuf := s.master()
+	defer masterBuf.Destroy()
+	master := masterBuf.Bytes()
+	unlocked, err := s.readSlot(s.unlockedSlot())
+	if err != nil {
+		return nil, nil, err
+	}
+	if unlocked.kind != slotTypePassword {
+		return nil, nil, fmt.Errorf("store was not unlocked with a password")
+	}
+	unwrapped, err := unlocked.unwrap(password)
+	if err != nil {
+		return nil, nil, ErrNoMatchingSlot
+	}
+	same := subtle.ConstantTimeCompare(unwrapped, master) == 1
+	Wipe(unwrapped)
+	if !same {
+		return nil, nil, ErrNoMatchingSlot
+	}
+
+	if !opts.RemoveUnrewrappable {
+		if names, err := s.unrewrappableSlots(); err != nil {
+			return nil, nil, err
+		} else if len(names) > 0 {
+			return nil, nil, fmt.Errorf("%w: %s", ErrUnrewrappable, strings.Join(names, ", "))
+		}
+	}
+
+	newMaster := make([]byte, masterKeyLen)
+	if _, err := rand.Read(newMaster); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate master key: %w", err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			Wipe(newMaster)
+		}
+	}()
+
+	newdir, err := s.copyKeyDir()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer passwdCleanup(newdir)
+
+	if s.wrapper() == nil {
+		err = s.rewrapKeyFiles(newdir, masterKeyWrapper{master}, masterKeyWrapper{newMaster})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := s.rewrapWriteKey(newdir, newMaster); err != nil {
+		return nil, nil, err
+	}
+	if err := s.rewrapThrottle(newdir, newMaster); err != nil {
+		return nil, nil, err
+	}
+	removed, recoveryKey, err = s.rewrapSlots(newdir, password, newMaster)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if !committed {
+			Wipe(recoveryKey)
+		}
+	}()
+	err = os.Remove(filepath.Join(newdir, primarySaltFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("failed to remove old salt: %w", err)
+	}
+
+	m, err := s.readManifest()
+	if err != nil {
+		return nil, nil, err
+	}
+	manifestKey, err := deriveManifestKey(newMaster, s.fips)
+	if err != nil {
+		return nil, nil, err
+	}
+	m.generation++
+	err = s.writeManifestFile(filepath.Join(newdir, manifestFileName), m, manifestKey)
+	Wipe(manifestKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The watcher reloads the keys as soon as the new directory is in
+	// place, so switch master keys first.
+	slotName := s.unlockedSlot()
+	s.setMaster(newMaster, slotName)
+	if err := s.replaceKeyDir(newdir); err != nil {
+		s.setMaster(master, slotName)
+		return nil, nil, err
+	}
+	committed = true
+	_ = s.seeGeneration(m.generation) // Newer than any seen before.
+	return removed, recoveryKey, nil
+}
+
+// rewrapWriteKey wraps the write key in dir, if there is one, under
+// newMaster.
+func (s *Store) rewrapWriteKey(dir string, newMaster []byte) error {
+	path := filepath.Join(dir, writeKeyFile)
+	data, err := s.readFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read write key: %w", err)
+	}
+	masterBuf := s.master()
+	defer masterBuf.Destroy()
+	master := masterBuf.Bytes()
+	priv, err := decryptKey(data, master)
+	if err != nil {
+		return fmt.Errorf("failed to unwrap write key: %w", err)
+	}
+	defer Wipe(priv)
+	wrapped, err := encryptKey(priv, newMaster)
+	if err != nil {
+		return err
+	}
+	return s.writeFile(path, wrapped)
+}
+
+// canRewrap reports whether RewrapKeys can wrap a new master key in ks
+// when the store was unlocked with the slot called slotName.
+func canRewrap(ks *keySlot, slotName string) bool {
+	switch ks.kind {
+	case slotTypeX25519, slotTypeSSH, slotTypeRecovery:
+		return true
+	}
+	return ks.name == slotName
+}
+
+// unrewrappableSlots returns the names of the slots RewrapKeys would
+// have to remove.
+func (s *Store) unrewrappableSlots() ([]string, error) {
+	slots, err := s.readSlots()
+	if err != nil {
+		return nil, err
+	}
+	slotName := s.unlockedSlot()
+	var names []string
+	for _, ks := range slots {
+		if !canRewrap(ks, slotName) {
+			names = append(names, ks.name)
+		}
+	}
+	return names, nil
+}
+
+// rewrapSlots wraps newMaster in the slots in dir that can be rewrapped
+// and removes the others, returning their names and the new recovery
+// key, if there is a recovery slot.
+func (s *Store) rewrapSlots(dir string, password, newMaster []byte) ([]string, []byte, error) {
+	slots, err := s.readSlots()
+	if err != nil {
+		return nil, nil, err
+	}
+	slotName := s.unlockedSlot()
+	var removed []string
+	var recoveryKey []byte
+	for _, ks := range slots {
+		var newSlot *keySlot
+		switch {
+		case !canRewrap(ks, slotName):
+			path := filepath.Join(dir, slotsDirName, ks.name)
+			if err := os.Remove(path); err != nil {
+				Wipe(recoveryKey)
+				return nil, nil, fmt.Errorf("failed to remove key slot %s: %w", ks.name, err)
+			}
+			removed = append(removed, ks.name)
+			continue
+		case ks.name == slotName:
+			newSlot, err = newPasswordSlot(ks.name, password, newMaster, s.slotKDF())
+		case ks.kind == slotTypeX25519:
+			newSlot = &keySlot{name: ks.name, kind: ks.kind, kdf: ks.kdf, salt: ks.salt}
+			newSlot.wrapped, err = sealTo(ks.salt, newMaster, x25519SlotInfo)
+		case ks.kind == slotTypeSSH:
+			newSlot, err = newSSHSlot(ks.name, ks.salt, newMaster)
+		default:
+			newSlot, recoveryKey, err = newRecoverySlot(newMaster, s.slotKDF())
+		}
+		if err == nil {
+			err = s.writeSlot(dir, newSlot)
+		}
+		if err != nil {
+			Wipe(recoveryKey)
+			return nil, nil, fmt.Errorf("failed to rewrap key slot %s: %w", ks.name, err)
+		}
+	}
+	return removed, recoveryKey, nil
+}
@@ -0,0 +1,123 @@
+package darkstore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_RewrapKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := filepath.Join(testStoreDir, "rewrap_keys")
+	keyPath := filepath.Join(testStoreDir, "rewrap_keys.key")
+	defer os.RemoveAll(dir)     //nolint: errcheck
+	defer os.RemoveAll(keyPath) //nolint: errcheck
+
+	var oldRecoveryKey, recoveryKey []byte
+	store, err := NewStore(dir, testPassword, WithRecoveryKey(&oldRecoveryKey))
+	assert.NoError(err)
+	assert.NoError(store.Save("secret", []byte("still here")))
+	pub, priv, err := GenerateIdentity()
+	assert.NoError(err)
+	assert.NoError(store.AddRecipient("alice", pub))
+	assert.NoError(GenerateKeyFile(keyPath))
+	key, err := os.ReadFile(keyPath)
+	assert.NoError(err)
+	assert.NoError(store.AddKeyFileSlot("ci", key))
+	writeKey, err := store.WriteKey()
+	assert.NoError(err)
+
+	keyFile := filepath.Join(dir, keyDirName, "key0")
+	oldKeyFile, err := os.ReadFile(keyFile)
+	assert.NoError(err)
+	oldSlot, err := os.ReadFile(filepath.Join(dir, keyDirName, slotsDirName, defaultSlotName))
+	assert.NoError(err)
+	oldMaster := append([]byte{}, store.primaryKey...)
+
+	// Test case 1: The password must be the one the store was opened with
+	t.Run("Wrong password", func(t *testing.T) {
+		_, _, err := store.RewrapKeys([]byte("wrong password"), RewrapOptions{})
+		assert.True(errors.Is(err, ErrNoMatchingSlot), "got %v", err)
+		_, _, err = store.RewrapKeys(nil, RewrapOptions{})
+		assert.Error(err)
+	})
+
+	// Test case 2: Everything is rewrapped under a new master key
+	t.Run("Rewrap", func(t *testing.T) {
+		// The key file slot is only removed when asked for.
+		_, _, err := store.RewrapKeys(testPassword, RewrapOptions{})
+		assert.True(errors.Is(err, ErrUnrewrappable), "got %v", err)
+		assert.ErrorContains(err, "ci")
+		assert.Equal(oldMaster, store.primaryKey)
+		_, err = os.Stat(filepath.Join(dir, keyDirName, slotsDirName, "ci"))
+		assert.NoError(err)
+
+		var removed []string
+		removed, recoveryKey, err = store.RewrapKeys(testPassword, RewrapOptions{RemoveUnrewrappable: true})
+		assert.NoError(err)
+		assert.Equal([]string{"ci"}, removed)
+		assert.Len(recoveryKey, recoveryKeyLength)
+		assert.NotEqual(oldRecoveryKey, recoveryKey)
+		assert.NotEqual(oldMaster, store.primaryKey)
+
+		newKeyFile, err := os.ReadFile(keyFile)
+		assert.NoError(err)
+		assert.NotEqual(oldKeyFile, newKeyFile)
+		newSlot, err := os.ReadFile(filepath.Join(dir, keyDirName, slotsDirName, defaultSlotName))
+		assert.NoError(err)
+		assert.NotEqual(oldSlot, newSlot, "fresh salt")
+		_, err = os.Stat(filepath.Join(dir, oldPwDirName))
+		assert.True(os.IsNotExist(err))
+
+		data, err := store.Load("secret")
+		assert.NoError(err)
+		assert.Equal([]byte("still here"), data)
+		assert.NoError(store.Save("after", []byte("rewrap")))
+		store.Close()
+	})
+
+	// Test case 3: The same password and the recipient still open the
+	// store, the key file slot does not
+	t.Run("Reopen", func(t *testing.T) {
+		for _, u := range []Unlocker{Password(testPassword), Identity(priv)} {
+			store, err := Open(dir, u)
+			if !assert.NoError(err) {
+				continue
+			}
+			data, err := store.Load("after")
+			assert.NoError(err)
+			assert.Equal([]byte("rewrap"), data)
+			store.Close()
+		}
+		_, err := Open(dir, KeyFile(keyPath))
+		assert.True(errors.Is(err, ErrNoMatchingSlot), "got %v", err)
+
+		w, err := OpenWriteOnly(dir, writeKey)
+		assert.NoError(err)
+		assert.NoError(w.Save("inbox", []byte("same write key")))
+		w.Close()
+		store, err := NewStore(dir, testPassword)
+		assert.NoError(err)
+		data, err := store.Load("inbox")
+		assert.NoError(err)
+		assert.Equal([]byte("same write key"), data)
+		store.Close()
+	})
+
+	// Test case 4: Only the new recovery key recovers the store
+	t.Run("Recovery key", func(t *testing.T) {
+		err := RecoverWithKey(dir, oldRecoveryKey, []byte("recovered password"))
+		assert.True(errors.Is(err, ErrNoMatchingSlot), "got %v", err)
+		assert.NoError(RecoverWithKey(dir, recoveryKey, []byte("recovered password")))
+		store, err := NewStore(dir, []byte("recovered password"))
+		assert.NoError(err)
+		data, err := store.Load("secret")
+		assert.NoError(err)
+		assert.Equal([]byte("still here"), data)
+		store.Close()
+	})
+}
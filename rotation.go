@@ -1,16 +1,18 @@
 package darkstore
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
-
-	"github.com/fsnotify/fsnotify"
 )
 
 // Rotate generates a new encryption key and re-encrypts all data
 func (s *Store) Rotate() error {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
 	lk, err := s.lock(s.lockFile)
 	if err != nil {
 		return fmt.Errorf("key rotation currently in process; cannot start a new one")
@@ -18,7 +20,7 @@ func (s *Store) Rotate() error {
 	defer lk.unlock()
 
 	// Calculate new key index (roll over to 0 if at 255)
-	newKeyIndex := s.currentKeyIndex + 1
+	newKeyIndex := s.keyIndex() + 1
 
 	newKeyFilePath := filepath.Join(s.keyDir, fmt.Sprintf("key%d", newKeyIndex))
 	_, err = os.Stat(newKeyFilePath)
@@ -33,14 +35,14 @@ func (s *Store) Rotate() error {
 	}
 
 	// Set current key
-	s.currentKey = newKey
-	s.currentKeyIndex = newKeyIndex
+	s.setCurrentKey(newKey, newKeyIndex)
 	err = s.saveCurrentKeyIndex()
 	if err != nil {
 		return fmt.Errorf("failed to save key index file: %w", err)
 	}
+	s.emit(Rotated)
 
-	go s.updateFiles(0)
+	s.goBackground(func() { s.updateFiles(0) })
 	return nil
 }
 
@@ -52,6 +54,10 @@ func (s *Store) updateFiles(calls int) {
 		// TODO: Write unit test for this case.
 		return
 	}
+	// Close stops the update; the next open finishes it.
+	if s.stopping() {
+		return
+	}
 	err := os.MkdirAll(s.tempDir, s.dirPerm)
 	if err != nil {
 		// Could not create temporary directory.
@@ -65,11 +71,14 @@ func (s *Store) updateFiles(calls int) {
 		return
 	}
 	for _, file := range files {
+		if s.stopping() {
+			return
+		}
 		s.reencryptFile(file)
 	}
 
 	// Clean up old keys if this successfully updated all files.
-	newKeyIndex := s.currentKeyIndex
+	newKeyIndex := s.keyIndex()
 	// Get list of all files again, just to make sure there weren't new ones.
 	files, err = s.listDataFiles()
 	if err != nil {
@@ -87,13 +96,18 @@ func (s *Store) updateFiles(calls int) {
 		return
 	}
 	// Don't defer the unlock until after knowing if recursive call will be made
-	if s.currentKeyIndex != newKeyIndex {
+	if s.keyIndex() != newKeyIndex {
 		// A rotation happened while checking, can't delete old keys.  Redo.
 		lk.unlock()
 		s.updateFiles(calls + 1)
 		return
 	}
 	defer lk.unlock()
+	if _, err = os.Stat(s.journalDir); err == nil {
+		// A pending transaction may still reference an old key.  The
+		// next open will replay it and finish the cleanup.
+		return
+	}
 	curKeyPath := filepath.Join(s.keyDir, fmt.Sprintf("key%d", newKeyIndex))
 	allKeys, err := filepath.Glob(filepath.Join(s.keyDir, "key*"))
 	if err != nil {
@@ -133,6 +147,19 @@ func (s *Store) listDataFiles() ([]string, error) {
 
 // reencryptFile re-encrypts a single file with the new key
 func (s *Store) reencryptFile(path string) {
+	// The data file and the manifest must change together.
+	txLk, err := s.lock(s.txLockFile)
+	if err != nil {
+		s.debug("failed to acquire lock for %s", s.txLockFile)
+		return
+	}
+	defer txLk.unlock()
+	m, err := s.readManifest()
+	if err != nil {
+		s.debug("failed to read manifest: %s", err.Error())
+		return
+	}
+
 	lk, err := s.lock(path)
 	if err != nil {
 		s.debug("failed to acquire lock for %s", path)
@@ -143,33 +170,46 @@ func (s *Store) reencryptFile(path string) {
 	// Read and decrypt with old key
 	encryptedData, err := os.ReadFile(path)
 	if err != nil {
-		// Failed to read file.  Delete it.
+		// Failed to read file.  It may be readable later, so leave it.
 		s.debug("failed to read %s: %s", path, err.Error())
-		_ = os.Remove(path)
 		return
 	}
 
 	if len(encryptedData) < 1 {
 		// Invalid file format, so no useful data.  Delete this file.
 		s.debug("zero length file: %s", path)
-		_ = os.Remove(path)
+		s.removeDataFile(m, path)
 		return
 	}
 
 	oldKeyIndex := encryptedData[0]
 
-	if oldKeyIndex == s.currentKeyIndex {
+	if oldKeyIndex == s.keyIndex() {
 		// Already updated, no need to re-encrypt.
 		return
 	}
 
+	// Never re-encrypt a file the manifest doesn't vouch for; doing so
+	// would launder a rolled-back or planted secret.
+	if err = s.checkManifestEntry(m, path, encryptedData); err != nil {
+		s.debug("not re-encrypting %s: %s", path, err.Error())
+		return
+	}
+
 	data, err := s.decryptData(encryptedData)
-	if err != nil {
+	if err != nil && !errors.Is(err, errUndecryptable) {
+		// The key could not be had, for example because Close or the
+		// idle lock wiped it or a KeyWrapper failed.  The data may be
+		// fine, so leave it for the next rotation.
+		s.debug("not re-encrypting %s: %s", path, err.Error())
+		return
+	} else if err != nil {
 		// Failed to decrypt, so this data is useless.  Delete this file.
 		s.debug("failed to decrypt %s: %s", path, err.Error())
-		_ = os.Remove(path)
+		s.removeDataFile(m, path)
 		return
 	}
+	defer Wipe(data)
 
 	// Encrypt with new key
 	newEncryptedData, err := s.encryptData(data)
@@ -209,54 +249,21 @@ func (s *Store) reencryptFile(path string) {
 		s.debug("failed to move temp file %s: %s", path, err.Error())
 		return
 	}
-}
 
-// startRotateWatch initializes an fsnotify watch on the keys directory
-// to see if any other process has done a key rotation.
-func (s *Store) startRotateWatch() error {
-	w, err := fsnotify.NewWatcher()
-	if err != nil {
-		return err
-	}
-	err = w.Add(s.keyDir)
-	if err != nil {
-		return err
+	m.rewrite(s.relPath(path), newEncryptedData)
+	if err = s.writeManifest(m); err != nil {
+		s.debug("failed to update manifest for %s: %s", path, err.Error())
 	}
-	go s.rotateWatch(w)
-	return nil
 }
 
-// rotateWatch is the goroutine that handles fsnotify messages from the
-// keys directory to see if any other process has done a key rotation.
-func (s *Store) rotateWatch(watcher *fsnotify.Watcher) {
-	defer watcher.Close() //nolint: errcheck
-	for {
-		select {
-		case <-s.stopChan:
-			// Stop signal received, exit gracefully
-			return
-		case event, ok := <-watcher.Events:
-			if !ok {
-				return
-			}
-			if event.Has(fsnotify.Write) && event.Name == s.curKeyIdxFile {
-				lk, err := s.rLock(s.lockFile)
-				if err != nil {
-					return
-				}
-				err = s.loadCurrentKey()
-				lk.unlock()
-				if err != nil {
-					return
-				}
-			}
-		case err, ok := <-watcher.Errors:
-			if !ok {
-				return
-			}
-			if err != nil {
-				return
-			}
-		}
+// removeDataFile deletes an unusable data file and its manifest entry.
+func (s *Store) removeDataFile(m *manifest, path string) {
+	_ = os.Remove(path)
+	if _, ok := m.entries[s.relPath(path)]; !ok {
+		return
+	}
+	delete(m.entries, s.relPath(path))
+	if err := s.writeManifest(m); err != nil {
+		s.debug("failed to update manifest for %s: %s", path, err.Error())
 	}
 }
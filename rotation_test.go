@@ -6,7 +6,6 @@ import (
 	"path/filepath"
 	"sort"
 	"testing"
-	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -31,17 +30,17 @@ func TestStore_Rotate(t *testing.T) {
 	data2 := []byte("sensitive info 2")
 	assert.NoError(store.Save(secretPath2, data2))
 
-	initialKeyIndex := store.currentKeyIndex
+	initialKeyIndex := store.keyIndex()
 
 	// Test case 1: Successful key rotation
 	t.Run("Successful rotation", func(t *testing.T) {
 		err = store.Rotate()
 		assert.NoError(err)
 		// New key index should be incremented
-		assert.Equal(initialKeyIndex+1, store.currentKeyIndex)
+		assert.Equal(initialKeyIndex+1, store.keyIndex())
 
-		// Allow time for goroutine (updateFiles) to complete
-		time.Sleep(20 * time.Millisecond)
+		// Wait for the goroutine (updateFiles) to complete
+		waitForRotation(t, store)
 
 		// Verify all files are re-encrypted with the new key
 		loadedData1, err := store.Load(secretPath1)
@@ -58,16 +57,16 @@ func TestStore_Rotate(t *testing.T) {
 		assert.True(os.IsNotExist(err), "Old key file should be deleted")
 
 		// Verify new key file exists
-		newKeyFilePath := filepath.Join(store.keyDir, fmt.Sprintf("key%d", store.currentKeyIndex))
+		newKeyFilePath := filepath.Join(store.keyDir, fmt.Sprintf("key%d", store.keyIndex()))
 		_, err = os.Stat(newKeyFilePath)
 		assert.NoError(err, "New key file should exist")
 	})
 
 	// Test case 2: Max key index rollover (simulate by setting currentKeyIndex to 255)
 	t.Run("Key index rollover", func(t *testing.T) {
-		store.currentKey, err = store.newKey(255)
+		key, err := store.newKey(255)
 		assert.NoError(err)
-		store.currentKeyIndex = 255       // Set to max
+		store.setCurrentKey(key, 255)     // Set to max
 		err = store.saveCurrentKeyIndex() // Save to disk
 		assert.NoError(err)
 
@@ -84,10 +83,10 @@ func TestStore_Rotate(t *testing.T) {
 		assert.NoError(err)
 
 		// New key index should roll over to 0
-		assert.Equal(uint8(0), store.currentKeyIndex)
+		assert.Equal(uint8(0), store.keyIndex())
 
-		// Allow time for goroutine (updateFiles) to complete
-		time.Sleep(20 * time.Millisecond)
+		// Wait for the goroutine (updateFiles) to complete
+		waitForRotation(t, store)
 
 		// Verify data is still loadable
 		loadedData3, err := store.Load(secretPath3)
@@ -174,8 +173,7 @@ func TestStore_reencryptFile(t *testing.T) {
 	assert.NoError(err)
 
 	// Set current key
-	store.currentKey = newKey
-	store.currentKeyIndex = 1
+	store.setCurrentKey(newKey, 1)
 	err = store.saveCurrentKeyIndex()
 	assert.NoError(err)
 
@@ -184,13 +182,13 @@ func TestStore_reencryptFile(t *testing.T) {
 		// Before re-encryption, the file should still be encrypted with the old key
 		origKeyIndex, err := store.getKeyIndex(fullPath)
 		assert.NoError(err)
-		assert.NotEqual(store.currentKeyIndex, origKeyIndex)
+		assert.NotEqual(store.keyIndex(), origKeyIndex)
 		store.reencryptFile(fullPath)
 
 		// After re-encryption, the file should be encrypted with the current key
 		newKeyIndex, err := store.getKeyIndex(fullPath)
 		assert.NoError(err)
-		assert.Equal(store.currentKeyIndex, newKeyIndex)
+		assert.Equal(store.keyIndex(), newKeyIndex)
 
 		loadedData, err := store.Load(secretPath)
 		assert.NoError(err)
@@ -237,4 +235,22 @@ func TestStore_reencryptFile(t *testing.T) {
 		_, err := os.Stat(invalidDataPath)
 		assert.NoError(err)
 	})
+
+	// Test case 5: Keep files when the store locks during re-encryption
+	t.Run("Store locked", func(t *testing.T) {
+		newKey, err := store.newKey(2)
+		assert.NoError(err)
+		store.setCurrentKey(newKey, 2)
+		assert.NoError(store.saveCurrentKeyIndex())
+		store.lockIdle()
+
+		store.reencryptFile(fullPath)
+		_, err = os.Stat(fullPath)
+		assert.NoError(err, "locking the store must not delete secrets")
+
+		assert.NoError(store.Unlock(Password(testPassword)))
+		loadedData, err := store.Load(secretPath)
+		assert.NoError(err)
+		assert.Equal(originalData, loadedData)
+	})
 }
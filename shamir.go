@@ -0,0 +1,332 @@
+package darkstore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"fmt"
+)
+
+const (
+	shamirSlotName  = "shamir"
+	shareVersion    = 1
+	shareSetIDLen   = 8
+	shareChecksum   = 4
+	sharePrefix     = "darkstore-share-"
+	shareKeyLen     = 32
+	sharePayloadLen = 1 + shareSetIDLen + 2 + shareKeyLen
+)
+
+var shareEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// share is one point on the polynomials that split a key.
+type share struct {
+	setID     []byte // Identifies the split the share belongs to.
+	threshold uint8
+	x         uint8
+	y         []byte
+}
+
+// gfMul multiplies a and b in GF(2^8) with the AES polynomial.  It runs
+// in constant time, unlike the usual log table lookup.
+func gfMul(a, b byte) byte {
+	var p byte
+	for i := 0; i < 8; i++ {
+		p ^= -(b & 1) & a
+		hi := a >> 7
+		a = a<<1 ^ (0x1b & -hi)
+		b >>= 1
+	}
+	return p
+}
+
+// gfInv returns the multiplicative inverse of a in GF(2^8) as a^254.
+func gfInv(a byte) byte {
+	result := byte(1)
+	for i := 0; i < 7; i++ {
+		a = gfMul(a, a)
+		result = gfMul(result, a)
+	}
+	return result
+}
+
+// splitSecret splits secret into count shares, any threshold of which
+// reconstruct it.  Each byte of secret is the constant term of its own
+// random polynomial of degree threshold-1, and share i is the value of
+// every polynomial at x = i.
+func splitSecret(secret []byte, threshold, count int) ([]*share, error) {
+	if threshold < 2 || threshold > count || count > 255 {
+		return nil, fmt.Errorf("invalid threshold %d of %d shares", threshold, count)
+	}
+	setID := make([]byte, shareSetIDLen)
+	if _, err := rand.Read(setID); err != nil {
+		return nil, fmt.Errorf("failed to generate share set ID: %w", err)
+	}
+	shares := make([]*share, count)
+	for i := range shares {
+		shares[i] = &share{setID: setID, threshold: uint8(threshold), x: uint8(i + 1), y: make([]byte, len(secret))}
+	}
+
+	coeffs := make([]byte, threshold)
+	defer Wipe(coeffs)
+	for b, secretByte := range secret {
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, fmt.Errorf("failed to generate shares: %w", err)
+		}
+		coeffs[0] = secretByte
+		for _, sh := range shares {
+			// Horner's method, highest coefficient first.
+			var y byte
+			for c := threshold - 1; c >= 0; c-- {
+				y = gfMul(y, sh.x) ^ coeffs[c]
+			}
+			sh.y[b] = y
+		}
+	}
+	return shares, nil
+}
+
+// combineShares reconstructs a secret from at least threshold shares of
+// the same split by Lagrange interpolation at x = 0.
+func combineShares(shares []*share) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, fmt.Errorf("no shares")
+	}
+	first := shares[0]
+	if first.threshold < 2 {
+		return nil, fmt.Errorf("invalid share threshold %d", first.threshold)
+	}
+	if len(shares) < int(first.threshold) {
+		return nil, fmt.Errorf("need %d shares, have %d", first.threshold, len(shares))
+	}
+	shares = shares[:first.threshold]
+	seen := make(map[uint8]bool)
+	for _, sh := range shares {
+		if subtle.ConstantTimeCompare(sh.setID, first.setID) != 1 || sh.threshold != first.threshold {
+			return nil, fmt.Errorf("shares are from different splits")
+		}
+		if len(sh.y) != len(first.y) || sh.x == 0 || seen[sh.x] {
+			return nil, fmt.Errorf("invalid or duplicate share")
+		}
+		seen[sh.x] = true
+	}
+
+	secret := make([]byte, len(first.y))
+	for j, sj := range shares {
+		// Lagrange basis polynomial for share j evaluated at 0.
+		basis := byte(1)
+		for k, sk := range shares {
+			if k != j {
+				basis = gfMul(basis, gfMul(sk.x, gfInv(sk.x^sj.x)))
+			}
+		}
+		for b := range secret {
+			secret[b] ^= gfMul(basis, sj.y[b])
+		}
+	}
+	return secret, nil
+}
+
+// encode returns the printable form of the share: a prefix, then the
+// version, set ID, threshold, x and y, and a truncated SHA-256 checksum
+// to catch typos, in base32.
+func (sh *share) encode() []byte {
+	payload := make([]byte, 0, sharePayloadLen+shareChecksum)
+	payload = append(payload, shareVersion)
+	payload = append(payload, sh.setID...)
+	payload = append(payload, sh.threshold, sh.x)
+	payload = append(payload, sh.y...)
+	sum := sha256.Sum256(payload)
+	payload = append(payload, sum[:shareChecksum]...)
+	defer Wipe(payload)
+
+	out := make([]byte, len(sharePrefix)+shareEncoding.EncodedLen(len(payload)))
+	copy(out, sharePrefix)
+	shareEncoding.Encode(out[len(sharePrefix):], payload)
+	return out
+}
+
+// parseShare decodes a share written by encode.
+func parseShare(data []byte) (*share, error) {
+	text := bytes.TrimSpace(data)
+	if !bytes.HasPrefix(text, []byte(sharePrefix)) {
+		return nil, fmt.Errorf("not a darkstore share")
+	}
+	encoded := bytes.ToUpper(text[len(sharePrefix):])
+	defer Wipe(encoded)
+	payload := make([]byte, shareEncoding.DecodedLen(len(encoded)))
+	defer Wipe(payload)
+	n, err := shareEncoding.Decode(payload, encoded)
+	if err != nil || n != sharePayloadLen+shareChecksum {
+		return nil, fmt.Errorf("share is malformed")
+	}
+	sum := sha256.Sum256(payload[:sharePayloadLen])
+	if subtle.ConstantTimeCompare(sum[:shareChecksum], payload[sharePayloadLen:]) != 1 {
+		return nil, fmt.Errorf("share checksum does not match, check for typos")
+	}
+	if payload[0] != shareVersion {
+		return nil, fmt.Errorf("unsupported share version: %d", payload[0])
+	}
+	p := payload[1:]
+	return &share{
+		setID:     append([]byte{}, p[:shareSetIDLen]...),
+		threshold: p[shareSetIDLen],
+		x:         p[shareSetIDLen+1],
+		y:         append([]byte{}, p[shareSetIDLen+2:shareSetIDLen+2+shareKeyLen]...),
+	}, nil
+}
+
+// SplitOptions controls SplitKey.
+type SplitOptions struct {
+	// RemoveOtherSlots zeroes and removes every key slot other than the
+	// Shamir slot, the recovery slot included, so that the store can
+	// only be opened with threshold shares.  Otherwise anyone holding
+	// the password or another slot's credential can still open it on
+	// their own.
+	RemoveOtherSlots bool
+}
+
+// SplitKey replaces the store's Shamir key slot with a new one and
+// returns count shares, any threshold of which unlock the store with
+// Shares.  The shares split a random key that wraps the master key in
+// the "shamir" slot, so calling SplitKey again invalidates every
+// earlier share without changing the master key or any data key.
+// Hand each share to a different person and Wipe them.
+//
+// The store's other key slots keep working unless opts.RemoveOtherSlots
+// is set.
+func (s *Store) SplitKey(threshold, count int, opts SplitOptions) ([][]byte, error) {
+	if s == nil {
+		return nil, fmt.Errorf("no store")
+	}
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	if err := s.checkApproved("Shamir secret sharing"); err != nil {
+		return nil, err
+	}
+	if err := s.checkMaster(); err != nil {
+		return nil, err
+	}
+	masterBuf := s.master()
+	defer masterBuf.Destroy()
+	master := masterBuf.Bytes()
+	shareKey := make([]byte, shareKeyLen)
+	if _, err := rand.Read(shareKey); err != nil {
+		return nil, fmt.Errorf("failed to generate share key: %w", err)
+	}
+	defer Wipe(shareKey)
+	shares, err := splitSecret(shareKey, threshold, count)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, sh := range shares {
+			Wipe(sh.y)
+		}
+	}()
+
+	wrapped, err := encryptKey(master, shareKey)
+	if err != nil {
+		return nil, err
+	}
+	ks := &keySlot{
+		name:    shamirSlotName,
+		kind:    slotTypeShamir,
+		kdf:     kdfNone,
+		salt:    append(append([]byte{}, shares[0].setID...), uint8(threshold), uint8(count)),
+		wrapped: wrapped,
+	}
+
+	lk, err := s.lock(s.lockFile)
+	if err != nil {
+		return nil, fmt.Errorf("error locking %s: %w", s.lockFile, err)
+	}
+	defer lk.unlock()
+	if !s.hasSlots() {
+		return nil, fmt.Errorf("store at %s has no key slots, reopen it to upgrade", s.dir)
+	}
+	if err := s.writeSlot(s.keyDir, ks); err != nil {
+		return nil, err
+	}
+	if opts.RemoveOtherSlots {
+		if err := s.removeOtherSlots(shamirSlotName); err != nil {
+			return nil, err
+		}
+	}
+
+	encoded := make([][]byte, len(shares))
+	for i, sh := range shares {
+		encoded[i] = sh.encode()
+	}
+	return encoded, nil
+}
+
+// Reshare is the ceremony for replacing a store's shares: it unlocks
+// the store at dir with at least threshold of the current shares and
+// returns a new set of count shares with the given threshold.  Every
+// old share stops working; the master key, data keys and the store's
+// other key slots are unchanged.
+func Reshare(dir string, shares [][]byte, threshold, count int) ([][]byte, error) {
+	s, err := Open(dir, Shares(shares...))
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	return s.SplitKey(threshold, count, SplitOptions{})
+}
+
+// sharesUnlocker unlocks the Shamir key slot.
+type sharesUnlocker struct {
+	shares [][]byte
+}
+
+// Shares returns an Unlocker that reconstructs the key of the store's
+// Shamir slot from shares returned by SplitKey or Reshare.  At least
+// the threshold number of shares must be given.
+func Shares(shares ...[]byte) Unlocker {
+	return &sharesUnlocker{shares: shares}
+}
+
+func (u *sharesUnlocker) unlockStore(s *Store) error {
+	var parsed []*share
+	defer func() {
+		for _, sh := range parsed {
+			Wipe(sh.y)
+		}
+	}()
+	for i, data := range u.shares {
+		sh, err := parseShare(data)
+		if err != nil {
+			return fmt.Errorf("share %d: %w", i+1, err)
+		}
+		parsed = append(parsed, sh)
+	}
+	shareKey, err := combineShares(parsed)
+	if err != nil {
+		return err
+	}
+	defer Wipe(shareKey)
+
+	slots, err := s.readSlots()
+	if err != nil {
+		return err
+	}
+	for _, ks := range slots {
+		if ks.kind != slotTypeShamir || len(ks.salt) < shareSetIDLen+2 {
+			continue
+		}
+		if subtle.ConstantTimeCompare(ks.salt[:shareSetIDLen], parsed[0].setID) != 1 {
+			continue
+		}
+		masterKey, err := decryptKey(ks.wrapped, shareKey)
+		if err != nil {
+			return fmt.Errorf("%w: shares do not reconstruct the key", ErrNoMatchingSlot)
+		}
+		s.setMaster(masterKey, ks.name)
+		return nil
+	}
+	return fmt.Errorf("%w: shares are from an old or unknown split", ErrNoMatchingSlot)
+}
@@ -0,0 +1,173 @@
+package darkstore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShamir(t *testing.T) {
+	assert := assert.New(t)
+
+	// Test case 1: Field arithmetic
+	t.Run("GF(256)", func(t *testing.T) {
+		for a := 1; a < 256; a++ {
+			assert.Equal(byte(1), gfMul(byte(a), gfInv(byte(a))), "inverse of %d", a)
+		}
+		assert.Equal(byte(0xc1), gfMul(0x57, 0x83)) // FIPS-197 example
+	})
+
+	// Test case 2: Any threshold subset reconstructs the secret
+	t.Run("Split and combine", func(t *testing.T) {
+		secret := []byte("0123456789abcdef0123456789abcdef")
+		shares, err := splitSecret(secret, 3, 5)
+		assert.NoError(err)
+		assert.Len(shares, 5)
+
+		for _, subset := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+			var picked []*share
+			for _, i := range subset {
+				picked = append(picked, shares[i])
+			}
+			combined, err := combineShares(picked)
+			assert.NoError(err)
+			assert.Equal(secret, combined, "subset %v", subset)
+		}
+
+		_, err = combineShares(shares[:2])
+		assert.Error(err)
+		_, err = combineShares([]*share{shares[0], shares[0], shares[1]})
+		assert.Error(err)
+		_, err = splitSecret(secret, 1, 5)
+		assert.Error(err)
+		_, err = splitSecret(secret, 6, 5)
+		assert.Error(err)
+	})
+
+	// Test case 3: Encoding
+	t.Run("Encoding", func(t *testing.T) {
+		shares, err := splitSecret(make([]byte, shareKeyLen), 2, 2)
+		assert.NoError(err)
+		encoded := shares[0].encode()
+		parsed, err := parseShare(encoded)
+		assert.NoError(err)
+		assert.Equal(shares[0], parsed)
+
+		typo := append([]byte{}, encoded...)
+		last := len(typo) - 5
+		if typo[last] == 'A' {
+			typo[last] = 'B'
+		} else {
+			typo[last] = 'A'
+		}
+		_, err = parseShare(typo)
+		assert.Error(err)
+		_, err = parseShare([]byte("something else"))
+		assert.Error(err)
+	})
+}
+
+func TestStore_SplitKey(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := filepath.Join(testStoreDir, "split_key")
+	defer os.RemoveAll(dir) //nolint: errcheck
+
+	store, err := NewStore(dir, testPassword)
+	assert.NoError(err)
+	assert.NoError(store.Save("root", []byte("crown jewels")))
+	shares, err := store.SplitKey(3, 5, SplitOptions{})
+	assert.NoError(err)
+	assert.Len(shares, 5)
+	slots, err := store.ListKeySlots()
+	assert.NoError(err)
+	assert.Equal("shamir", slots[1].Type)
+	assert.Equal(3, slots[1].Threshold)
+	assert.Equal(5, slots[1].Shares)
+	store.Close()
+
+	// Test case 1: Any three shares open the store
+	t.Run("Open", func(t *testing.T) {
+		store, err := Open(dir, Shares(shares[4], shares[0], shares[2]))
+		assert.NoError(err)
+		data, err := store.Load("root")
+		assert.NoError(err)
+		assert.Equal([]byte("crown jewels"), data)
+
+		err = store.Passwd([]byte("not for shares"))
+		assert.Error(err)
+		store.Close()
+
+		_, err = Open(dir, Shares(shares[0], shares[1]))
+		assert.Error(err)
+	})
+
+	// Test case 2: Resharing invalidates the old shares
+	t.Run("Reshare", func(t *testing.T) {
+		newShares, err := Reshare(dir, [][]byte{shares[1], shares[2], shares[3]}, 2, 3)
+		assert.NoError(err)
+		assert.Len(newShares, 3)
+
+		_, err = Open(dir, Shares(shares[0], shares[1], shares[2]))
+		assert.True(errors.Is(err, ErrNoMatchingSlot), "got %v", err)
+
+		store, err := Open(dir, Shares(newShares[2], newShares[0]))
+		assert.NoError(err)
+		data, err := store.Load("root")
+		assert.NoError(err)
+		assert.Equal([]byte("crown jewels"), data)
+		store.Close()
+
+		store, err = Open(dir, Password(testPassword))
+		assert.NoError(err)
+		store.Close()
+	})
+
+	// Test case 3: A malformed Shamir slot is rejected, not sliced
+	t.Run("Malformed slot", func(t *testing.T) {
+		path := filepath.Join(dir, keyDirName, slotsDirName, shamirSlotName)
+		data, err := os.ReadFile(path)
+		assert.NoError(err)
+		defer os.WriteFile(path, data, 0600) //nolint: errcheck
+		short := append([]byte{}, data...)
+		short[12] = 2 // Salt length
+		assert.NoError(os.WriteFile(path, short, 0600))
+		assert.NotPanics(func() {
+			_, err = Open(dir, Shares(shares[0], shares[1], shares[2]))
+		})
+		assert.ErrorContains(err, "invalid key slot")
+
+		assert.NotPanics(func() {
+			info := (&keySlot{kind: slotTypeShamir, salt: []byte{1, 2}}).info()
+			assert.Equal("shamir", info.Type)
+		})
+	})
+
+	// Test case 4: The shares can be made the only way in
+	t.Run("Remove other slots", func(t *testing.T) {
+		store, err := NewStore(dir, testPassword)
+		assert.NoError(err)
+		_, err = store.AddRecoverySlot()
+		assert.NoError(err)
+		shares, err := store.SplitKey(2, 3, SplitOptions{RemoveOtherSlots: true})
+		assert.NoError(err)
+		slots, err := store.ListKeySlots()
+		assert.NoError(err)
+		if assert.Len(slots, 1) {
+			assert.Equal("shamir", slots[0].Type)
+		}
+		store.Close()
+
+		_, err = Open(dir, Password(testPassword))
+		assert.True(errors.Is(err, ErrNoMatchingSlot), "got %v", err)
+		store, err = Open(dir, Shares(shares[0], shares[2]))
+		assert.NoError(err)
+		data, err := store.Load("root")
+		assert.NoError(err)
+		assert.Equal([]byte("crown jewels"), data)
+		store.Close()
+	})
+}
@@ -0,0 +1,168 @@
+package darkstore
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const sshSlotInfo = "darkstore ssh-ed25519 slot v1"
+
+// curve25519P is the field prime 2^255 - 19.
+var curve25519P = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// parseSSHAuthorizedKey returns the Ed25519 public key on an
+// authorized_keys line, or false if line is not an authorized_keys
+// line at all.
+func parseSSHAuthorizedKey(line []byte) (ed25519.PublicKey, bool, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(line)
+	if err != nil {
+		return nil, false, nil
+	}
+	if pub.Type() != ssh.KeyAlgoED25519 {
+		return nil, true, fmt.Errorf("unsupported SSH key type %s, only %s keys can unlock a store",
+			pub.Type(), ssh.KeyAlgoED25519)
+	}
+	cryptoPub, ok := pub.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, true, fmt.Errorf("unsupported SSH key")
+	}
+	edPub, ok := cryptoPub.CryptoPublicKey().(ed25519.PublicKey)
+	if !ok {
+		return nil, true, fmt.Errorf("unsupported SSH key")
+	}
+	return edPub, true, nil
+}
+
+// ed25519PublicToX25519 converts an Ed25519 public key to the X25519
+// public key of the same secret, mapping the Edwards y coordinate to the
+// Montgomery u = (1 + y) / (1 - y).  Public keys are not secret, so
+// math/big is fine here.
+func ed25519PublicToX25519(pub ed25519.PublicKey) ([]byte, error) {
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid Ed25519 public key")
+	}
+	le := make([]byte, len(pub))
+	for i, b := range pub {
+		le[len(pub)-1-i] = b
+	}
+	le[0] &= 0x7f // Drop the sign of x.
+	y := new(big.Int).SetBytes(le)
+	if y.Cmp(curve25519P) >= 0 || y.Cmp(big.NewInt(1)) == 0 {
+		return nil, fmt.Errorf("invalid Ed25519 public key")
+	}
+
+	num := new(big.Int).Add(big.NewInt(1), y)
+	den := new(big.Int).Sub(big.NewInt(1), y)
+	den.Mod(den, curve25519P)
+	den.ModInverse(den, curve25519P)
+	u := num.Mul(num, den)
+	u.Mod(u, curve25519P)
+
+	out := make([]byte, x25519KeyLen)
+	u.FillBytes(out)
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out, nil
+}
+
+// ed25519PrivateToX25519 returns the X25519 private key of an Ed25519
+// private key: the first half of the SHA-512 of its seed, which is the
+// scalar Ed25519 signs with.
+func ed25519PrivateToX25519(priv ed25519.PrivateKey) []byte {
+	seed := priv.Seed()
+	defer Wipe(seed)
+	h := sha512.Sum512(seed)
+	defer Wipe(h[:])
+	return append([]byte{}, h[:x25519KeyLen]...)
+}
+
+// newSSHSlot returns a key slot that wraps masterKey to an SSH Ed25519
+// public key.
+func newSSHSlot(name string, pub ed25519.PublicKey, masterKey []byte) (*keySlot, error) {
+	xPub, err := ed25519PublicToX25519(pub)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := sealTo(xPub, masterKey, sshSlotInfo)
+	if err != nil {
+		return nil, err
+	}
+	return &keySlot{name: name, kind: slotTypeSSH, kdf: kdfX25519, salt: pub, wrapped: wrapped}, nil
+}
+
+// sshUnlocker unlocks SSH key slots with an OpenSSH private key.
+type sshUnlocker struct {
+	source     Source
+	passphrase Source
+}
+
+// SSHKeyFile returns an Unlocker that reads an Ed25519 SSH private key,
+// such as ~/.ssh/id_ed25519, from the file at path and opens the slot
+// added for its public key with AddKeySlot.  If the key is protected,
+// its passphrase is read from passphrase, which may be nil for keys
+// without one.
+func SSHKeyFile(path string, passphrase Source) Unlocker {
+	return &sshUnlocker{source: FromFile(path), passphrase: passphrase}
+}
+
+// SSHKeyFrom is SSHKeyFile with the private key read from src.
+func SSHKeyFrom(src, passphrase Source) Unlocker {
+	return &sshUnlocker{source: src, passphrase: passphrase}
+}
+
+func (u *sshUnlocker) unlockStore(s *Store) error {
+	pemBytes, err := u.source()
+	if err != nil {
+		return err
+	}
+	defer Wipe(pemBytes)
+
+	raw, err := ssh.ParseRawPrivateKey(pemBytes)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if u.passphrase == nil {
+			return fmt.Errorf("SSH private key is protected by a passphrase")
+		}
+		passphrase, perr := u.passphrase()
+		if perr != nil {
+			return perr
+		}
+		raw, err = ssh.ParseRawPrivateKeyWithPassphrase(pemBytes, passphrase)
+		Wipe(passphrase)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse SSH private key: %w", err)
+	}
+	edPriv, ok := raw.(*ed25519.PrivateKey)
+	if !ok {
+		return fmt.Errorf("unsupported SSH private key, only Ed25519 keys can unlock a store")
+	}
+	defer Wipe(*edPriv)
+	pub := edPriv.Public().(ed25519.PublicKey)
+	xPriv := ed25519PrivateToX25519(*edPriv)
+	defer Wipe(xPriv)
+
+	slots, err := s.readSlots()
+	if err != nil {
+		return err
+	}
+	for _, ks := range slots {
+		if ks.kind != slotTypeSSH || !bytes.Equal(ks.salt, pub) {
+			continue
+		}
+		masterKey, err := openFrom(xPriv, ks.wrapped, sshSlotInfo)
+		if err != nil {
+			continue
+		}
+		s.setMaster(masterKey, ks.name)
+		return nil
+	}
+	return ErrNoMatchingSlot
+}
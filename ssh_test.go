@@ -0,0 +1,114 @@
+package darkstore
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestEd25519ToX25519(t *testing.T) {
+	assert := assert.New(t)
+
+	for i := 0; i < 16; i++ {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		assert.NoError(err)
+		xPub, err := ed25519PublicToX25519(pub)
+		assert.NoError(err)
+		want, err := curve25519.X25519(ed25519PrivateToX25519(priv), curve25519.Basepoint)
+		assert.NoError(err)
+		assert.Equal(want, xPub)
+	}
+	_, err := ed25519PublicToX25519(make([]byte, 31))
+	assert.Error(err)
+}
+
+func TestStore_SSHKeySlot(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := filepath.Join(testStoreDir, "ssh_slot")
+	keyPath := filepath.Join(testStoreDir, "ssh_slot_id_ed25519")
+	defer os.RemoveAll(dir)     //nolint: errcheck
+	defer os.RemoveAll(keyPath) //nolint: errcheck
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(err)
+	sshPub, err := ssh.NewPublicKey(pub)
+	assert.NoError(err)
+	block, err := ssh.MarshalPrivateKey(priv, "alice@laptop")
+	assert.NoError(err)
+	assert.NoError(os.WriteFile(keyPath, pem.EncodeToMemory(block), 0600))
+	block, err = ssh.MarshalPrivateKeyWithPassphrase(priv, "alice@laptop", []byte("hunter2"))
+	assert.NoError(err)
+	protected := pem.EncodeToMemory(block)
+
+	store, err := NewStore(dir, testPassword)
+	assert.NoError(err)
+	assert.NoError(store.Save("secret", []byte("for engineers")))
+	line := append([]byte(`no-pty `), ssh.MarshalAuthorizedKey(sshPub)...)
+	assert.NoError(store.AddKeySlot("alice", line))
+	slots, err := store.ListKeySlots()
+	assert.NoError(err)
+	assert.Equal("ssh", slots[0].Type)
+	assert.Equal(ssh.FingerprintSHA256(sshPub), slots[0].Fingerprint)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(err)
+	rsaPub, err := ssh.NewPublicKey(&rsaKey.PublicKey)
+	assert.NoError(err)
+	err = store.AddKeySlot("rsa", ssh.MarshalAuthorizedKey(rsaPub))
+	assert.Error(err)
+	assert.Contains(err.Error(), "ssh-ed25519")
+	store.Close()
+
+	check := func(u Unlocker) {
+		store, err := Open(dir, u)
+		if !assert.NoError(err) {
+			return
+		}
+		defer store.Close()
+		data, err := store.Load("secret")
+		assert.NoError(err)
+		assert.Equal([]byte("for engineers"), data)
+	}
+
+	// Test case 1: An unprotected private key file
+	t.Run("Key file", func(t *testing.T) {
+		check(SSHKeyFile(keyPath, nil))
+	})
+
+	// Test case 2: A passphrase-protected key
+	t.Run("Passphrase", func(t *testing.T) {
+		src := func() ([]byte, error) { return append([]byte{}, protected...), nil }
+		check(SSHKeyFrom(src, func() ([]byte, error) { return []byte("hunter2"), nil }))
+
+		_, err := Open(dir, SSHKeyFrom(src, nil))
+		assert.Error(err)
+		assert.Contains(err.Error(), "passphrase")
+		_, err = Open(dir, SSHKeyFrom(src, func() ([]byte, error) { return []byte("wrong"), nil }))
+		assert.Error(err)
+	})
+
+	// Test case 3: Other keys do not unlock the store
+	t.Run("Wrong key", func(t *testing.T) {
+		_, other, err := ed25519.GenerateKey(rand.Reader)
+		assert.NoError(err)
+		block, err := ssh.MarshalPrivateKey(other, "")
+		assert.NoError(err)
+		_, err = Open(dir, SSHKeyFrom(func() ([]byte, error) { return pem.EncodeToMemory(block), nil }, nil))
+		assert.True(errors.Is(err, ErrNoMatchingSlot), "got %v", err)
+
+		block, err = ssh.MarshalPrivateKey(rsaKey, "")
+		assert.NoError(err)
+		_, err = Open(dir, SSHKeyFrom(func() ([]byte, error) { return pem.EncodeToMemory(block), nil }, nil))
+		assert.Error(err)
+	})
+}
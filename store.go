@@ -4,14 +4,20 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 
 	"golang.org/x/crypto/argon2"
 )
 
+// ErrClosed is returned by the methods of a Store after Close.
+var ErrClosed = errors.New("store is closed")
+
 const (
 	// Algorithm constants
 	algorithmAES256GCM = 0
@@ -22,6 +28,8 @@ const (
 	curKeyIdxFile   = "currentkey"
 	lockFileName    = ".keylock"
 	tempDirName     = "tempfiles"
+	txLockFileName  = ".txlock"
+	journalDirName  = "journal"
 	newPwDirName    = ".darkstorekeys.newpw"
 	oldPwDirName    = ".darkstorekeys.oldpw"
 
@@ -42,12 +50,38 @@ type Store struct {
 	curKeyIdxFile   string
 	lockFile        string
 	tempDir         string
-	primaryKey      []byte
+	txLockFile      string
+	journalDir      string
+	manifestFile    string
+	manifestGen     uint64 // Newest manifest generation seen.
+	slotsDir        string
+	slotName        string // Key slot the store was unlocked with.
+	opts            options
+	primaryKey      []byte // Master key, wraps every key file.
+	primaryBuf      *LockedBuffer
+	writeOnly       []byte // Write public key, if opened with OpenWriteOnly.
 	currentKey      []byte
+	currentBuf      *LockedBuffer
 	currentKeyIndex uint8
 	dirPerm         os.FileMode
 	filePerm        os.FileMode
-	stopChan        chan struct{}
+	stopChan        chan struct{}  // Closed by Close to stop background work.
+	background      sync.WaitGroup // Background goroutines, joined by Close.
+	mu              sync.RWMutex   // Guards the keys and closed.
+	closed          bool
+	locked          bool            // Locked after being idle, see Unlock.
+	lastUse         atomic.Int64    // When the store was last used, in UnixNano.
+	hardened        bool            // Counted in hardenCount.
+	keyState        keyFileState    // Key files as rotateWatch last saw them.
+	seenFailures    uint32          // Failed unlocks rotateWatch has reported.
+	throttle        *ThrottlePolicy // Last verified with the master key, under mu.
+	fips            bool            // A FIPS store, see WithFIPS.
+	healthMu        sync.Mutex
+	health          Health
+	events          chan Event // Closed by Close, see Events.
+	eventsMu        sync.Mutex // Guards sending on events and closing it.
+	eventsClosed    bool
+	reauth          atomic.Bool // Keys were changed by another process.
 	doDebug         bool
 }
 
@@ -71,97 +105,191 @@ func (s *Store) debug(format string, args ...interface{}) {
 	}
 }
 
-// TODO: Ensure keys cannot be written to swap or core files.
-
 // NewStore creates a new Store object, either opening an existing
-// on-disk store at dirpath, or creating a new store at dirpath.
-func NewStore(dirpath string, password []byte) (*Store, error) {
+// on-disk store at dirpath, or creating a new store at dirpath.  A new
+// store's password must meet the PasswordPolicy, if one is given.
+func NewStore(dirpath string, password []byte, opts ...Option) (*Store, error) {
 	if len(password) == 0 {
 		return nil, fmt.Errorf("password must not be empty")
 	}
 
-	storePath, err := filepath.Abs(dirpath)
+	store, err := newStoreHandle(dirpath, opts...)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing directory %s: %w", dirpath, err)
-	}
-
-	store := &Store{
-		dir:           storePath,
-		keyDir:        filepath.Join(storePath, keyDirName),
-		saltFile:      filepath.Join(storePath, keyDirName, primarySaltFile),
-		curKeyIdxFile: filepath.Join(storePath, keyDirName, curKeyIdxFile),
-		lockFile:      filepath.Join(storePath, keyDirName, lockFileName),
-		tempDir:       filepath.Join(storePath, keyDirName, tempDirName),
-		stopChan:      make(chan struct{}),
-		doDebug:       true,
+		return nil, err
 	}
 
 	isNewStore, err := store.checkNewStore()
 	if err != nil {
 		return nil, err
 	}
+	if isNewStore {
+		if err = store.opts.passwordPolicy.CheckPassword(password); err != nil {
+			return nil, err
+		}
+	}
+	if err = store.harden(); err != nil {
+		return nil, err
+	}
 
 	if isNewStore {
 		err = store.createNewStore(password) // password needed to set salt.
+		if err == nil {
+			err = store.start()
+		}
 	} else {
-		err = store.openExistingStore(password) // password needed for primary key.
+		err = store.open(Password(password)) // password needed for primary key.
 	}
 	if err != nil {
+		store.unharden()
 		return nil, err
 	}
 
+	return store, nil
+}
+
+// start finishes recovery from any crash and starts the background
+// work of an unlocked store.
+func (s *Store) start() error {
+	// Finish or discard any transaction interrupted by a crash.
+	if err := s.recoverJournal(); err != nil {
+		return err
+	}
+
 	// Start recovery process if needed
-	if err = store.checkForOldKeys(); err != nil {
-		return nil, err
+	if err := s.checkForOldKeys(); err != nil {
+		return err
+	}
+
+	// Take in secrets saved by write-only stores.
+	if err := s.ingestInbox(); err != nil {
+		s.debug("failed to empty inbox: %v", err)
 	}
 
 	// Start watcher for key rotation done by other processes
-	err = store.startRotateWatch()
+	s.startRotateWatch()
+	s.startIdleWatch()
+	return nil
+}
+
+// newStoreHandle returns a Store for dirpath with its paths filled in
+// and opts applied, before anything on disk is looked at.
+func newStoreHandle(dirpath string, opts ...Option) (*Store, error) {
+	storePath, err := filepath.Abs(dirpath)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("error parsing directory %s: %w", dirpath, err)
 	}
 
+	store := &Store{
+		dir:           storePath,
+		keyDir:        filepath.Join(storePath, keyDirName),
+		saltFile:      filepath.Join(storePath, keyDirName, primarySaltFile),
+		curKeyIdxFile: filepath.Join(storePath, keyDirName, curKeyIdxFile),
+		lockFile:      filepath.Join(storePath, keyDirName, lockFileName),
+		tempDir:       filepath.Join(storePath, keyDirName, tempDirName),
+		txLockFile:    filepath.Join(storePath, keyDirName, txLockFileName),
+		journalDir:    filepath.Join(storePath, keyDirName, journalDirName),
+		manifestFile:  filepath.Join(storePath, keyDirName, manifestFileName),
+		slotsDir:      filepath.Join(storePath, keyDirName, slotsDirName),
+		stopChan:      make(chan struct{}),
+		events:        make(chan Event, eventBufferSize),
+		doDebug:       true,
+	}
+	store.opts.watch = defaultWatchOptions()
+	for _, opt := range opts {
+		opt(&store.opts)
+	}
+	if store.opts.recoveryKey != nil {
+		*store.opts.recoveryKey = nil
+	}
 	return store, nil
 }
 
-// Close closes the store and cleans up resources
+// Close closes the store and cleans up resources.  It stops and waits
+// for the store's background goroutines, closes the channel from
+// Events and wipes the keys.  Afterwards every method returns
+// ErrClosed.
 func (s *Store) Close() {
 	if s == nil {
 		return
 	}
-	// Send stop signal to rotateWatch goroutine
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	// Stop rotateWatch and any re-encryption, and wait for them.
 	if s.stopChan != nil {
-		select {
-		case <-s.stopChan:
-			// Channel already closed, do nothing
-		default:
-			close(s.stopChan)
-		}
+		close(s.stopChan)
+	}
+	s.background.Wait()
+	s.eventsMu.Lock()
+	s.eventsClosed = true
+	if s.events != nil {
+		close(s.events)
 	}
+	s.eventsMu.Unlock()
 
 	// Clear sensitive data from memory
-	Wipe(s.primaryKey)
-	Wipe(s.currentKey)
-
-	// Ensure future references fail:
-	s.dir = ""
-	s.keyDir = ""
-	s.saltFile = ""
-	s.curKeyIdxFile = ""
-}
-
-// Passwd re-encrypts the decryption key on-disk with a new password.
-// It will write zeroes over the old on-disk key before writing the new
-// key, just to ensure that the old password can no longer be used to
-// decrypt the key to this store.
-//
-// WARNING:  If multiple processes are accessing the same Store, processes
-// other than the one that called this function will lose access to the
-// store until they re-open it with the new password.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.wipeKeys()
+	s.unharden()
+}
+
+// goBackground runs fn in a goroutine that Close waits for, unless the
+// store is closed.
+func (s *Store) goBackground(fn func()) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		fn()
+	}()
+}
+
+// stopping reports whether Close was called.
+func (s *Store) stopping() bool {
+	select {
+	case <-s.stopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// checkClosed returns ErrClosed after Close.
+func (s *Store) checkClosed() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Passwd changes the password of the key slot the store was unlocked
+// with.  The store's other key slots, and the master key that the key
+// files are wrapped under, are not changed.  It will write zeroes over
+// the old on-disk slot, just to ensure that the old password can no
+// longer be used to decrypt the key to this store.  With a
+// PasswordPolicy, a weak newpassword is rejected with *ErrWeakPassword.
 func (s *Store) Passwd(newpassword []byte) error {
 	if len(newpassword) == 0 {
 		return fmt.Errorf("password must not be empty")
 	}
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	if err := s.opts.passwordPolicy.CheckPassword(newpassword); err != nil {
+		return err
+	}
 
 	lk, err := s.lockNB(s.lockFile)
 	if err != nil {
@@ -169,8 +297,15 @@ func (s *Store) Passwd(newpassword []byte) error {
 	}
 	defer lk.unlock()
 
+	// Hold off writers so the manifest copied below stays current.
+	txLk, err := s.lock(s.txLockFile)
+	if err != nil {
+		return fmt.Errorf("error locking %s: %w", s.txLockFile, err)
+	}
+	defer txLk.unlock()
+
 	// This first copies the `.darkstorekeys` directory into a new
-	// directory, `.darkstorekeys.newpw`.  Then it updates all the keys in
+	// directory, `.darkstorekeys.newpw`.  Then it updates the key slot in
 	// the new directory with the new password, then renames the current
 	// `.darkstorekeys` directory to `.darkstorekeys.oldpw`, renames
 	// `.darkstorekeys.newpw` to `.darkstorekeys`, then deletes
@@ -178,52 +313,71 @@ func (s *Store) Passwd(newpassword []byte) error {
 	// is interrupted at any point, the store will still be accessible
 	// from either the old password or new password.
 
-	// Copy `.darkstorekeys` to `.darkstorekeys.newpw`.
-	newdir := filepath.Join(s.dir, newPwDirName)
-	cmd := exec.Command("/bin/cp", "-pr", s.keyDir, newdir)
-	out, err := cmd.CombinedOutput()
+	newdir, err := s.copyKeyDir()
 	if err != nil {
-		return fmt.Errorf("failed to create new keys directory with %s: %w",
-			out, err)
+		return err
 	}
 	defer passwdCleanup(newdir) // Deletes .newpw directory if failure happens.
 	// On success, the .newpw directory won't exist any more, so this is safe.
 
-	// Generate salt, then get new primaryKey with Argon2id
-	salt, err := generateSalt()
-	if err != nil {
-		return fmt.Errorf("failed to generate random salt: %w", err)
+	slotName := s.unlockedSlot()
+	if slotName == "" {
+		// Not yet migrated to key slots.
+		slotName = defaultSlotName
 	}
-	err = s.writeFile(filepath.Join(newdir, primarySaltFile), salt)
-	if err != nil {
-		return fmt.Errorf("failed to write salt for new primary key: %w", err)
+	if old, err := s.readSlot(slotName); err == nil {
+		if old.kind != slotTypePassword {
+			return fmt.Errorf("store was not unlocked with a password, use AddKeySlot")
+		}
+		if err = s.opts.passwordPolicy.checkReuse(newpassword, old); err != nil {
+			return err
+		}
 	}
-	newPrimaryKey, err := deriveKeyFromPassword(newpassword, salt)
+	masterBuf := s.master()
+	defer masterBuf.Destroy()
+	master := masterBuf.Bytes()
+	ks, err := newPasswordSlot(slotName, newpassword, master, s.slotKDF())
 	Wipe(newpassword)
 	if err != nil {
-		return fmt.Errorf("failed to generate new primary key: %w", err)
+		return fmt.Errorf("failed to create new key slot: %w", err)
+	}
+	if err = s.writeSlot(newdir, ks); err != nil {
+		return err
+	}
+	// The salt of the old password-derived primary key is not needed
+	// once the store has a slot.
+	err = os.Remove(filepath.Join(newdir, primarySaltFile))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove old salt: %w", err)
 	}
 
-	keys, err := filepath.Glob(filepath.Join(newdir, "key*"))
-	if err != nil {
-		return fmt.Errorf("failed to read keys directory: %w", err)
+	if err = s.replaceKeyDir(newdir); err != nil {
+		return err
 	}
-	for _, keyPath := range keys {
-		rawKey, err := s.loadKeyFromPath(keyPath)
-		if err != nil {
-			return fmt.Errorf("failed to read key %s: %w", keyPath, err)
-		}
-		encKey, err := encryptKey(rawKey, newPrimaryKey)
-		if err != nil {
-			return fmt.Errorf("failed to encrypt %s: %w", keyPath, err)
-		}
-		err = s.writeFile(keyPath, encKey)
-		if err != nil {
-			return fmt.Errorf("failed to write key %s: %w", keyPath, err)
-		}
+	s.mu.Lock()
+	s.slotName = slotName
+	s.mu.Unlock()
+	return nil
+}
+
+// copyKeyDir copies `.darkstorekeys` to `.darkstorekeys.newpw` and
+// returns the copy's path.
+func (s *Store) copyKeyDir() (string, error) {
+	newdir := filepath.Join(s.dir, newPwDirName)
+	cmd := exec.Command("/bin/cp", "-pr", s.keyDir, newdir)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to create new keys directory with %s: %w",
+			out, err)
 	}
+	return newdir, nil
+}
+
+// replaceKeyDir moves `.darkstorekeys` to `.darkstorekeys.oldpw`, moves
+// newdir into its place, and zeroes the old keys.
+func (s *Store) replaceKeyDir(newdir string) error {
 	oldDir := filepath.Join(s.dir, oldPwDirName)
-	err = os.Rename(s.keyDir, oldDir)
+	err := os.Rename(s.keyDir, oldDir)
 	if err != nil {
 		return fmt.Errorf("failed to move keys dir to .oldpw: %w", err)
 	}
@@ -236,10 +390,8 @@ func (s *Store) Passwd(newpassword []byte) error {
 		return fmt.Errorf("failed to move new keys dir: %w", err)
 	}
 
-	// New key dir is in place.  Start using new password.
-	s.primaryKey = newPrimaryKey
+	// New key dir is in place.
 	zeroOldKeys(oldDir)
-
 	return nil
 }
 
@@ -279,11 +431,11 @@ func (s *Store) checkNewStore() (bool, error) {
 		}
 	}
 
-	// Check that the primary key salt, currentkeyindex, and keyN files
-	// are all there.
+	// Check that the key slots (or, for older stores, the primary key
+	// salt), currentkeyindex, and keyN files are all there.
 	_, err = os.Stat(s.saltFile)
-	if err != nil {
-		return false, fmt.Errorf("%s is not a valid store, no salt file", s.dir)
+	if err != nil && !s.hasSlots() {
+		return false, fmt.Errorf("%s is not a valid store, no salt file or key slots", s.dir)
 	}
 	data, err := os.ReadFile(s.curKeyIdxFile)
 	if err != nil || len(data) != 1 {
@@ -352,8 +504,32 @@ func (s *Store) createNewStore(password []byte) error {
 	}
 	defer lk.unlock()
 
-	if err := s.createPrimaryKey(password); err != nil {
-		return fmt.Errorf("failed to extract primary key from password")
+	if err := s.touchFile(s.txLockFile); err != nil {
+		return fmt.Errorf("failed to create transaction lock: %w", err)
+	}
+
+	if s.opts.fipsRequested() {
+		s.fips = true
+		if err := s.writeFIPS(); err != nil {
+			return err
+		}
+	}
+
+	if err := s.createMasterKey(password); err != nil {
+		return fmt.Errorf("failed to create master key: %w", err)
+	}
+	if s.opts.recoveryKey != nil {
+		recoveryKey, err := s.createRecoverySlot()
+		if err != nil {
+			return fmt.Errorf("failed to create recovery key: %w", err)
+		}
+		*s.opts.recoveryKey = recoveryKey
+	}
+
+	if s.opts.wrapper != nil {
+		if err := s.writeKeyWrapperID(s.keyDir, s.opts.wrapper); err != nil {
+			return err
+		}
 	}
 
 	// Generate initial key
@@ -363,28 +539,39 @@ func (s *Store) createNewStore(password []byte) error {
 	}
 
 	// Set current key
-	s.currentKey = key
-	s.currentKeyIndex = 0
+	s.setCurrentKey(key, 0)
 
 	// Save current key index
 	if err := s.saveCurrentKeyIndex(); err != nil {
 		return fmt.Errorf("failed to initialize store: %w", err)
 	}
 
+	if err := s.initManifest(); err != nil {
+		return fmt.Errorf("failed to initialize store: %w", err)
+	}
+
 	return nil
 }
 
-func (s *Store) openExistingStore(password []byte) error {
+// openExistingStore opens the store, calling unlock to set the master
+// key while the keys directory is locked.
+func (s *Store) openExistingStore(unlock func() error) error {
 	lk, err := s.rLock(s.lockFile)
 	if err != nil {
 		return fmt.Errorf("error locking %s: %w", s.keyDir, err)
 	}
 	defer lk.unlock()
 
-	err = s.getPrimaryKey(password) // password needed to retrieve salt.
+	if err = s.loadFIPS(); err != nil {
+		return err
+	}
+	err = unlock()
 	if err != nil {
 		return err
 	}
+	if err = s.checkKeyWrapper(); err != nil {
+		return err
+	}
 	err = s.loadCurrentKey()
 	if err != nil {
 		return err
@@ -400,36 +587,45 @@ func (s *Store) openExistingStore(password []byte) error {
 	// any existing new password directory.
 	_ = os.RemoveAll(filepath.Join(s.dir, newPwDirName))
 
-	return nil
-}
+	// Stores created before transactions existed have no lock file.
+	if err = s.touchFile(s.txLockFile); err != nil {
+		return fmt.Errorf("failed to create transaction lock: %w", err)
+	}
 
-func (s *Store) createPrimaryKey(password []byte) error {
-	// Generate salt, save it, and then get primaryKey with Argon2
-	salt, err := generateSalt()
+	// Nor do stores created before manifests existed have a manifest.
+	txLk, err := s.lock(s.txLockFile)
 	if err != nil {
-		return fmt.Errorf("failed to generate random salt: %w", err)
+		return fmt.Errorf("error locking %s: %w", s.txLockFile, err)
 	}
-	err = s.writeFile(s.saltFile, salt)
-	if err != nil {
-		return fmt.Errorf("failed to write salt for key: %w", err)
+	defer txLk.unlock()
+	if err = s.initManifest(); err != nil {
+		return fmt.Errorf("failed to create manifest: %w", err)
 	}
-	s.primaryKey, err = deriveKeyFromPassword(password, salt)
+	// Remember the current generation so rollbacks can be noticed.
+	m, err := s.readManifest()
 	if err != nil {
-		return fmt.Errorf("failed to generate key: %w", err)
+		return err
 	}
-	return nil
+	return s.checkThrottle(m)
 }
 
+// getPrimaryKey unlocks the master key from the key slots or, for
+// stores that predate key slots, derives it from password.
 func (s *Store) getPrimaryKey(password []byte) error {
+	if s.hasSlots() {
+		return s.unlockSlots(password)
+	}
+
 	// Read salt, then get primaryKey with Argon2
 	salt, err := s.readFile(s.saltFile)
 	if err != nil {
 		return fmt.Errorf("failed to read primary key salt: %w", err)
 	}
-	s.primaryKey, err = deriveKeyFromPassword(password, salt)
+	key, err := deriveKeyFromPassword(password, salt)
 	if err != nil {
 		return fmt.Errorf("failed to generate key: %w", err)
 	}
+	s.setMaster(key, "")
 	return nil
 }
 
@@ -445,21 +641,19 @@ func (s *Store) loadCurrentKey() error {
 		return fmt.Errorf("invalid current key file format")
 	}
 
-	s.currentKeyIndex = data[0]
-
 	// Load the key
-	key, err := s.loadKey(s.currentKeyIndex)
+	key, err := s.loadKey(data[0])
 	if err != nil {
-		return fmt.Errorf("failed to load key %d: %w", s.currentKeyIndex, err)
+		return fmt.Errorf("failed to load key %d: %w", data[0], err)
 	}
 
-	s.currentKey = key
+	s.setCurrentKey(key, data[0])
 	return nil
 }
 
 // saveCurrentKeyIndex saves the current key index
 func (s *Store) saveCurrentKeyIndex() error {
-	return s.writeFile(s.curKeyIdxFile, []byte{s.currentKeyIndex})
+	return s.writeFile(s.curKeyIdxFile, []byte{s.keyIndex()})
 }
 
 // newKey generates, encrypts, and saves a key
@@ -472,9 +666,12 @@ func (s *Store) newKey(index uint8) ([]byte, error) {
 		return nil, fmt.Errorf("failed to generate key: %w", err)
 	}
 
-	encKey, err := encryptKey(key, s.primaryKey)
+	w, done := s.keyWrapper()
+	defer done()
+	encKey, err := w.Wrap(key)
 	if err != nil {
-		return nil, err
+		Wipe(key)
+		return nil, fmt.Errorf("failed to wrap key: %w", err)
 	}
 	err = s.writeFile(keyPath, encKey)
 	if err != nil {
@@ -490,27 +687,21 @@ func encryptKey(rawKey []byte, encKey []byte) ([]byte, error) {
 		return nil, fmt.Errorf("failed to create cipher: %w", err)
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	gcm, err := cipher.NewGCMWithRandomNonce(block)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create GCM: %w", err)
 	}
 
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := rand.Read(nonce); err != nil {
-		return nil, fmt.Errorf("failed to generate nonce: %w", err)
-	}
-
-	// Create key data structure
+	// Create key data structure.  Seal prepends the random nonce.
 	keyData := &KeyData{
 		Algorithm:    algorithmAES256GCM,
-		EncryptedKey: gcm.Seal(nil, nonce, rawKey, nil),
+		EncryptedKey: gcm.Seal(nil, nil, rawKey, nil),
 	}
 
 	// Serialize key data
-	data := make([]byte, 1+len(keyData.EncryptedKey)+len(nonce))
+	data := make([]byte, 1+len(keyData.EncryptedKey))
 	data[0] = keyData.Algorithm
-	copy(data[1:], nonce)
-	copy(data[1+len(nonce):], keyData.EncryptedKey)
+	copy(data[1:], keyData.EncryptedKey)
 
 	return data, nil
 }
@@ -529,6 +720,17 @@ func (s *Store) loadKeyFromPath(path string) ([]byte, error) {
 		return nil, fmt.Errorf("failed to read key file: %w", err)
 	}
 
+	w, done := s.keyWrapper()
+	defer done()
+	key, err := w.Unwrap(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap key: %w", err)
+	}
+	return key, nil
+}
+
+// decryptKey decrypts a key encrypted by encryptKey.
+func decryptKey(data []byte, encKey []byte) ([]byte, error) {
 	if len(data) < 1 {
 		return nil, fmt.Errorf("invalid key file format")
 	}
@@ -538,25 +740,21 @@ func (s *Store) loadKeyFromPath(path string) ([]byte, error) {
 		return nil, fmt.Errorf("unsupported algorithm: %d", algorithm)
 	}
 
-	block, err := aes.NewCipher(s.primaryKey[:32])
+	block, err := aes.NewCipher(encKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create cipher: %w", err)
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	gcm, err := cipher.NewGCMWithRandomNonce(block)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create GCM: %w", err)
 	}
 
-	nonceSize := gcm.NonceSize()
-	if len(data) < 1+nonceSize {
+	if len(data) < 1+gcm.Overhead() {
 		return nil, fmt.Errorf("invalid key file format")
 	}
 
-	nonce := data[1 : 1+nonceSize]
-	encryptedKey := data[1+nonceSize:]
-
-	key, err := gcm.Open(nil, nonce, encryptedKey, nil)
+	key, err := gcm.Open(nil, nil, data[1:], nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decrypt key: %w", err)
 	}
@@ -577,7 +775,7 @@ func (s *Store) checkForOldKeys() error {
 		return fmt.Errorf("failed to read keys directory: %w", err)
 	}
 	if len(keys) > 1 {
-		go s.updateFiles(0)
+		s.goBackground(func() { s.updateFiles(0) })
 	}
 	return nil
 }
@@ -587,7 +785,8 @@ func passwdCleanup(dir string) {
 	_ = os.RemoveAll(dir)
 }
 
-// zeroOldKeys writes zeroes over top of all old key files.
+// zeroOldKeys writes zeroes over top of all old key files and key
+// slots, then removes dir.
 func zeroOldKeys(dir string) {
 	defer os.RemoveAll(dir) //nolint: errcheck
 
@@ -596,25 +795,35 @@ func zeroOldKeys(dir string) {
 		// Nothing we can do to zero the keys.
 		return
 	}
+	slots, _ := filepath.Glob(filepath.Join(dir, slotsDirName, "*"))
+	keys = append(keys, slots...)
+	keys = append(keys, filepath.Join(dir, primarySaltFile), filepath.Join(dir, writeKeyFile))
 	for _, keyPath := range keys {
-		st, err := os.Stat(keyPath)
-		if err != nil {
-			continue
-		}
-		f, err := os.OpenFile(keyPath, os.O_WRONLY, 0600)
-		if err != nil {
-			continue
-		}
-		if st.Size() > 256*1024 {
-			// Key files should be MUCH less than 256k, so to make
-			// sure zeroes doesn't get too huge, make this check.
-			continue
-		}
-		zeroes := make([]byte, st.Size())
-		_, _ = f.WriteAt(zeroes, 0)
+		zeroFile(keyPath)
 	}
 }
 
+// zeroFile writes zeroes over the contents of the file at path.
+func zeroFile(path string) {
+	st, err := os.Stat(path)
+	if err != nil || !st.Mode().IsRegular() {
+		return
+	}
+	if st.Size() > 256*1024 {
+		// Key files should be MUCH less than 256k, so to make
+		// sure zeroes doesn't get too huge, make this check.
+		return
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close() //nolint: errcheck
+	zeroes := make([]byte, st.Size())
+	_, _ = f.WriteAt(zeroes, 0)
+	_ = f.Sync()
+}
+
 // deriveKeyFromPassword derives a key from a password using Argon2id
 // Argon2id is the recommended password hashing function by OWASP and provides
 // strong resistance against both side-channel and timing attacks.
@@ -630,6 +839,19 @@ func deriveKeyFromPassword(password []byte, salt []byte) ([]byte, error) {
 	return key, nil
 }
 
+// deriveKeyWithParams derives a key from a password using Argon2id with
+// parameters read from disk.  Parameters are bounded so that a crafted
+// file cannot make the derivation exhaust memory or run forever.
+func deriveKeyWithParams(password, salt []byte, time, memory uint32, threads uint8) ([]byte, error) {
+	if len(salt) < saltLength {
+		return nil, fmt.Errorf("salt must be at least %d bytes", saltLength)
+	}
+	if time == 0 || time > 16 || memory < 8*uint32(threads) || memory > 1024*1024 || threads == 0 {
+		return nil, fmt.Errorf("invalid key derivation parameters")
+	}
+	return argon2.IDKey(password, salt, time, memory, threads, argon2KeyLen), nil
+}
+
 // generateSalt generates a random salt for key derivation
 func generateSalt() ([]byte, error) {
 	salt := make([]byte, saltLength)
@@ -2,6 +2,8 @@ package darkstore
 
 import (
 	"crypto/rand"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
@@ -100,24 +102,61 @@ func TestStore_Close(t *testing.T) {
 	assert.NotNil(store)
 
 	// Save some data to ensure primaryKey and currentKey are populated
-	store.primaryKey = []byte("some-primary-key-data-1234567890123")
-	store.currentKey = []byte("some-current-key-data-1234567890123")
+	primaryKey := []byte("some-primary-key-data-1234567890123")
+	currentKey := []byte("some-current-key-data-1234567890123")
+	store.primaryKey = primaryKey
+	store.currentKey = currentKey
 
 	store.Close()
 
-	// Verify keys are wiped (all zeros)
-	for _, b := range store.primaryKey {
+	// Verify keys are wiped (all zeros) and released
+	for _, b := range primaryKey {
 		assert.Equal(byte(0), b, "primaryKey should be zeroed")
 	}
-	for _, b := range store.currentKey {
+	for _, b := range currentKey {
 		assert.Equal(byte(0), b, "currentKey should be zeroed")
 	}
+	assert.Nil(store.primaryKey)
+	assert.Nil(store.currentKey)
+
+	// Verify every method fails after Close
+	assert.True(errors.Is(store.Save("secret", []byte("data")), ErrClosed))
+	_, err = store.Load("secret")
+	assert.True(errors.Is(err, ErrClosed))
+	assert.True(errors.Is(store.Delete("secret"), ErrClosed))
+	assert.True(errors.Is(store.Rotate(), ErrClosed))
+	assert.True(errors.Is(store.Passwd([]byte("new")), ErrClosed))
+	assert.True(errors.Is(store.AddKeySlot("backup", []byte("pw")), ErrClosed))
+	_, err = store.ListKeySlots()
+	assert.True(errors.Is(err, ErrClosed))
+	assert.False(store.Health().Running)
+	store.Close()
+}
+
+func TestStore_CloseDuringRotation(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := filepath.Join(testStoreDir, "close_rotation")
+	defer os.RemoveAll(dir) //nolint: errcheck
+
+	store, err := NewStore(dir, testPassword)
+	assert.NoError(err)
+	for i := 0; i < 50; i++ {
+		assert.NoError(store.Save(fmt.Sprintf("secret%d", i), []byte("data")))
+	}
+
+	// Close stops the re-encryption instead of going on with wiped keys.
+	assert.NoError(store.Rotate())
+	store.Close()
 
-	// Verify store fields are cleared
-	assert.Equal("", store.dir)
-	assert.Equal("", store.keyDir)
-	assert.Equal("", store.saltFile)
-	assert.Equal("", store.curKeyIdxFile)
+	store, err = NewStore(dir, testPassword)
+	assert.NoError(err)
+	defer store.Close()
+	for i := 0; i < 50; i++ {
+		data, err := store.Load(fmt.Sprintf("secret%d", i))
+		assert.NoError(err)
+		assert.Equal([]byte("data"), data)
+	}
 }
 
 func TestStore_Passwd(t *testing.T) {
@@ -128,6 +167,7 @@ func TestStore_Passwd(t *testing.T) {
 
 	store, err := newTestStore(dir)
 	assert.NoError(err)
+	defer store.Close()
 	newPwDirPath := filepath.Join(dir, newPwDirName)
 
 	// Test case 1: Successful passwd
@@ -190,8 +230,9 @@ func TestStore_checkNewStore(t *testing.T) {
 		dir := filepath.Join(testStoreDir, "check_new_store_existing")
 		defer os.RemoveAll(dir) //nolint: errcheck
 
-		_, err := newTestStore(dir)
+		existing, err := newTestStore(dir)
 		assert.NoError(err)
+		defer existing.Close()
 
 		store := &Store{
 			dir:           dir,
@@ -0,0 +1,217 @@
+package darkstore
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// SyncAction describes what Sync does, or would do, with one secret.
+type SyncAction int
+
+const (
+	// SyncCreate copies a secret that does not exist in the destination.
+	SyncCreate SyncAction = iota
+	// SyncUpdate replaces a different secret in the destination.
+	SyncUpdate
+	// SyncSkip leaves a different secret in the destination alone.
+	SyncSkip
+	// SyncUnchanged means both stores already hold the same secret.
+	SyncUnchanged
+	// SyncConflict means the secrets differ and the policy is
+	// ConflictFail.  Only reported by a dry run; otherwise Sync returns
+	// ErrConflict.
+	SyncConflict
+)
+
+func (a SyncAction) String() string {
+	switch a {
+	case SyncCreate:
+		return "create"
+	case SyncUpdate:
+		return "update"
+	case SyncSkip:
+		return "skip"
+	case SyncUnchanged:
+		return "unchanged"
+	case SyncConflict:
+		return "conflict"
+	}
+	return fmt.Sprintf("SyncAction(%d)", int(a))
+}
+
+// SyncOptions controls Sync.
+type SyncOptions struct {
+	// Policy decides what happens to secrets that exist in both stores
+	// with different contents.
+	Policy ConflictPolicy
+	// Prefixes limits Sync to secrets whose paths start with one of
+	// the given prefixes.  Empty means every secret.
+	Prefixes []string
+	// DryRun reports what Sync would do without changing dst.
+	DryRun bool
+}
+
+// SyncChange is the action taken for a single secret.
+type SyncChange struct {
+	Path   string
+	Action SyncAction
+}
+
+// SyncResult lists the action taken for every secret in the source,
+// sorted by path.
+type SyncResult struct {
+	Changes []SyncChange
+}
+
+// Count returns the number of secrets with the given action.
+func (r *SyncResult) Count(action SyncAction) int {
+	n := 0
+	for _, c := range r.Changes {
+		if c.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
+// Sync copies the secrets in src to dst, re-encrypting them under dst's
+// current key.  Secrets that exist only in dst are left alone.  Secrets
+// that exist in both stores are compared, and if they differ
+// opts.Policy decides which one is kept; ConflictNewest compares when
+// each was last saved, as recorded in the stores' manifests, which
+// re-encryption by Rotate does not change.  All of the changes are
+// written to dst in a single transaction.
+//
+// Secrets are only decrypted when needed: a secret missing from dst is
+// not decrypted by a dry run, and neither store's copy is decrypted for
+// comparison under ConflictSkip.
+func Sync(src, dst *Store, opts SyncOptions) (*SyncResult, error) {
+	if src == nil || dst == nil {
+		return nil, fmt.Errorf("no store")
+	}
+	srcDir, err := filepath.Abs(src.dir)
+	if err != nil {
+		return nil, err
+	}
+	dstDir, err := filepath.Abs(dst.dir)
+	if err != nil {
+		return nil, err
+	}
+	if srcDir == dstDir {
+		return nil, fmt.Errorf("source and destination are the same store")
+	}
+
+	files, err := src.listDataFiles()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list data files: %w", err)
+	}
+	sort.Strings(files)
+
+	result := &SyncResult{}
+	err = dst.Update(func(tx *Tx) error {
+		for _, file := range files {
+			rel := src.relPath(file)
+			if !hasAnyPrefix(rel, opts.Prefixes) {
+				continue
+			}
+			action, err := syncSecret(src, tx, file, rel, opts)
+			if err != nil {
+				return err
+			}
+			result.Changes = append(result.Changes, SyncChange{Path: rel, Action: action})
+		}
+		if opts.DryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRun) {
+		return nil, err
+	}
+	return result, nil
+}
+
+// errDryRun aborts the transaction of a dry run.
+var errDryRun = errors.New("dry run")
+
+// syncSecret decides what to do with the source secret at file and,
+// unless this is a dry run, stages the change on tx.
+func syncSecret(src *Store, tx *Tx, file, rel string, opts SyncOptions) (SyncAction, error) {
+	dst := tx.s
+	dstPath, err := dst.secretPath(rel)
+	if err != nil {
+		return 0, err
+	}
+	_, err = os.Stat(dstPath)
+	if os.IsNotExist(err) {
+		if opts.DryRun {
+			return SyncCreate, nil
+		}
+		return SyncCreate, syncSave(src, tx, rel)
+	} else if err != nil {
+		return 0, fmt.Errorf("error checking %s: %w", rel, err)
+	}
+	if opts.Policy == ConflictSkip {
+		return SyncSkip, nil
+	}
+
+	srcData, err := src.Load(rel)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load %s: %w", rel, err)
+	}
+	defer Wipe(srcData)
+	dstData, err := tx.Load(rel)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load %s from destination: %w", rel, err)
+	}
+	same := subtle.ConstantTimeCompare(srcData, dstData) == 1
+	Wipe(dstData)
+	if same {
+		return SyncUnchanged, nil
+	}
+
+	switch opts.Policy {
+	case ConflictOverwrite:
+	case ConflictNewest:
+		srcTime, err := src.modTime(file)
+		if err != nil {
+			return 0, fmt.Errorf("error checking %s: %w", rel, err)
+		}
+		dstTime, err := dst.modTime(dstPath)
+		if err != nil {
+			return 0, fmt.Errorf("error checking %s in destination: %w", rel, err)
+		}
+		if !srcTime.After(dstTime) {
+			return SyncSkip, nil
+		}
+	default:
+		if opts.DryRun {
+			return SyncConflict, nil
+		}
+		return 0, fmt.Errorf("%s: %w", rel, ErrConflict)
+	}
+	if opts.DryRun {
+		return SyncUpdate, nil
+	}
+	if err := tx.Save(rel, srcData); err != nil {
+		return 0, fmt.Errorf("failed to sync %s: %w", rel, err)
+	}
+	return SyncUpdate, nil
+}
+
+// syncSave stages the source secret at rel on tx.
+func syncSave(src *Store, tx *Tx, rel string) error {
+	data, err := src.Load(rel)
+	if err != nil {
+		return fmt.Errorf("failed to load %s: %w", rel, err)
+	}
+	defer Wipe(data)
+	if err := tx.Save(rel, data); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", rel, err)
+	}
+	return nil
+}
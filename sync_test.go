@@ -0,0 +1,111 @@
+package darkstore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSync(t *testing.T) {
+	assert := assert.New(t)
+
+	srcDir := filepath.Join(testStoreDir, "sync_src")
+	dstDir := filepath.Join(testStoreDir, "sync_dst")
+	defer os.RemoveAll(srcDir) //nolint: errcheck
+	defer os.RemoveAll(dstDir) //nolint: errcheck
+
+	src, err := NewStore(srcDir, testPassword)
+	assert.NoError(err)
+	defer src.Close()
+	dst, err := NewStore(dstDir, testPassword)
+	assert.NoError(err)
+	defer dst.Close()
+
+	assert.NoError(src.Save("db/user", []byte("admin")))
+	assert.NoError(src.Save("db/pass", []byte("new pass")))
+	assert.NoError(src.Save("api/key", []byte("abc123")))
+	assert.NoError(dst.Save("db/user", []byte("admin")))
+	assert.NoError(dst.Save("db/pass", []byte("old pass")))
+	assert.NoError(dst.Save("local", []byte("dst only")))
+
+	load := func(s *Store, path string) string {
+		data, err := s.Load(path)
+		assert.NoError(err)
+		return string(data)
+	}
+
+	// Test case 1: Dry run reports the diff and changes nothing
+	t.Run("Dry run", func(t *testing.T) {
+		result, err := Sync(src, dst, SyncOptions{Policy: ConflictFail, DryRun: true})
+		assert.NoError(err)
+		assert.Equal([]SyncChange{
+			{Path: "api/key", Action: SyncCreate},
+			{Path: "db/pass", Action: SyncConflict},
+			{Path: "db/user", Action: SyncUnchanged},
+		}, result.Changes)
+		_, err = dst.Load("api/key")
+		assert.Error(err)
+	})
+
+	// Test case 2: ConflictFail writes nothing
+	t.Run("Fail", func(t *testing.T) {
+		_, err := Sync(src, dst, SyncOptions{Policy: ConflictFail})
+		assert.True(errors.Is(err, ErrConflict), "got %v", err)
+		_, err = dst.Load("api/key")
+		assert.Error(err)
+	})
+
+	// Test case 3: ConflictSkip keeps the destination's secret
+	t.Run("Skip", func(t *testing.T) {
+		result, err := Sync(src, dst, SyncOptions{Policy: ConflictSkip, Prefixes: []string{"db/"}})
+		assert.NoError(err)
+		assert.Equal(2, result.Count(SyncSkip))
+		assert.Equal("old pass", load(dst, "db/pass"))
+		_, err = dst.Load("api/key")
+		assert.Error(err, "outside the prefix")
+	})
+
+	// Test case 4: ConflictNewest compares when secrets were saved
+	t.Run("Newest", func(t *testing.T) {
+		result, err := Sync(src, dst, SyncOptions{Policy: ConflictNewest})
+		assert.NoError(err)
+		assert.Equal(1, result.Count(SyncSkip))
+		assert.Equal(1, result.Count(SyncCreate))
+		assert.Equal("old pass", load(dst, "db/pass"))
+		assert.Equal("abc123", load(dst, "api/key"))
+
+		// Re-encrypting the source's secrets does not make them newer.
+		assert.NoError(src.Rotate())
+		waitForRotation(t, src)
+		result, err = Sync(src, dst, SyncOptions{Policy: ConflictNewest})
+		assert.NoError(err)
+		assert.Equal(1, result.Count(SyncSkip))
+		assert.Equal("old pass", load(dst, "db/pass"))
+
+		assert.NoError(src.Save("db/pass", []byte("new pass")))
+		result, err = Sync(src, dst, SyncOptions{Policy: ConflictNewest})
+		assert.NoError(err)
+		assert.Equal(1, result.Count(SyncUpdate))
+		assert.Equal("new pass", load(dst, "db/pass"))
+	})
+
+	// Test case 5: ConflictOverwrite and invalid arguments
+	t.Run("Overwrite", func(t *testing.T) {
+		assert.NoError(src.Save("db/pass", []byte("newer pass")))
+		result, err := Sync(src, dst, SyncOptions{Policy: ConflictOverwrite})
+		assert.NoError(err)
+		assert.Equal(1, result.Count(SyncUpdate))
+		assert.Equal(2, result.Count(SyncUnchanged))
+		assert.Equal("newer pass", load(dst, "db/pass"))
+		assert.Equal("dst only", load(dst, "local"))
+		assert.NoError(dst.CheckIntegrity())
+
+		_, err = Sync(src, src, SyncOptions{})
+		assert.Error(err)
+		_, err = Sync(nil, dst, SyncOptions{})
+		assert.Error(err)
+	})
+}
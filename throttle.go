@@ -0,0 +1,499 @@
+package darkstore
+
+import (
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	throttleFileName = "throttle"
+	throttleVersion  = 2
+	throttleKeyInfo  = "darkstore throttle v1"
+
+	// throttlePolicyLen is the length of the version and the policy,
+	// which the MAC covers.
+	throttlePolicyLen = 1 + 4 + 8 + 8 + 4
+	throttleV1Len     = throttlePolicyLen + 4 + 8
+	throttleLen       = throttleV1Len + sha256.Size
+)
+
+// ErrStoreWiped is returned by the unlock attempt that reaches a
+// verified ThrottlePolicy's WipeAfter.  The store's key slots have been
+// zeroed and removed, so its secrets can no longer be read.
+var ErrStoreWiped = errors.New("key slots were wiped after too many failed unlocks")
+
+// ThrottlePolicy slows down guessing a store's credentials.  Failed
+// unlocks are counted in the keys directory, so the count is shared by
+// every process that opens the store, and is reset by the next
+// successful unlock.
+//
+// The policy is MAC'd with a key derived from the master key, and the
+// manifest records that one is set, so NewStore and Open refuse a
+// store whose throttle file was removed or whose policy was changed
+// other than by SetThrottle.  The failure count cannot be authenticated,
+// as failed attempts have no key to MAC it with, so anyone able to
+// write to the keys directory can still reset it.
+//
+// For the same reason, a failed attempt cannot check the policy
+// itself.  A process that has verified the policy, by having the store
+// open, follows it.  Any other process allows at most 3 free failures,
+// delays by at least a second, caps the delay at no less than a minute
+// and ignores WipeAfter, so that a planted policy can neither lift the
+// delays nor wipe the store.  The key slots are
+// then wiped by whichever store open with the master key first sees
+// WipeAfter failures counted.
+type ThrottlePolicy struct {
+	// Free is how many consecutive failures are allowed before each
+	// further attempt is delayed.
+	Free int
+	// Delay is how long an attempt waits after the last one once Free
+	// failures were counted.  It doubles with every further failure.
+	Delay time.Duration
+	// MaxDelay caps Delay.  Zero means no cap.
+	MaxDelay time.Duration
+	// WipeAfter, if not zero, is the number of consecutive failures
+	// after which the key slots are zeroed and removed, destroying the
+	// store.
+	WipeAfter int
+}
+
+// unverifiedThrottle is the least strict policy followed by unlock
+// attempts that cannot verify the store's ThrottlePolicy.  Its
+// WipeAfter is not used.  Tests lower it.
+var unverifiedThrottle = ThrottlePolicy{Free: 3, Delay: time.Second, MaxDelay: time.Minute}
+
+// throttleState is the throttle file: the policy, the consecutive
+// failures, when the last attempt began, and the MAC of the policy.
+type throttleState struct {
+	policy      ThrottlePolicy
+	failures    uint32
+	lastAttempt time.Time
+	mac         []byte
+}
+
+// delay returns how long after lastAttempt the next attempt must wait
+// under p.
+func (t *throttleState) delay(p ThrottlePolicy) time.Duration {
+	if int(t.failures) <= p.Free || p.Delay <= 0 {
+		return 0
+	}
+	d := p.Delay
+	for i := int(t.failures) - p.Free - 1; i > 0 && d <= math.MaxInt64/2; i-- {
+		d *= 2
+	}
+	if p.MaxDelay > 0 {
+		d = min(d, p.MaxDelay)
+	}
+	return d
+}
+
+func (t *throttleState) marshal() []byte {
+	data := make([]byte, 0, throttleLen)
+	data = append(data, throttleVersion)
+	data = binary.BigEndian.AppendUint32(data, uint32(t.policy.Free))
+	data = binary.BigEndian.AppendUint64(data, uint64(t.policy.Delay))
+	data = binary.BigEndian.AppendUint64(data, uint64(t.policy.MaxDelay))
+	data = binary.BigEndian.AppendUint32(data, uint32(t.policy.WipeAfter))
+	data = binary.BigEndian.AppendUint32(data, t.failures)
+	data = binary.BigEndian.AppendUint64(data, uint64(t.lastAttempt.UnixNano()))
+	data = append(data, t.mac...)
+	return data
+}
+
+// parseThrottle parses a throttle file.  Version 1 files have no MAC.
+func parseThrottle(data []byte) (*throttleState, error) {
+	switch {
+	case len(data) == throttleLen && data[0] == throttleVersion:
+	case len(data) == throttleV1Len && data[0] == 1:
+	default:
+		return nil, fmt.Errorf("invalid throttle file")
+	}
+	t := &throttleState{}
+	t.policy.Free = int(binary.BigEndian.Uint32(data[1:]))
+	t.policy.Delay = time.Duration(binary.BigEndian.Uint64(data[5:]))
+	t.policy.MaxDelay = time.Duration(binary.BigEndian.Uint64(data[13:]))
+	t.policy.WipeAfter = int(binary.BigEndian.Uint32(data[21:]))
+	t.failures = binary.BigEndian.Uint32(data[25:])
+	t.lastAttempt = time.Unix(0, int64(binary.BigEndian.Uint64(data[29:])))
+	if data[0] == throttleVersion {
+		t.mac = append([]byte{}, data[throttleV1Len:]...)
+	}
+	return t, nil
+}
+
+// policyMAC returns the MAC of t's policy under a key derived from
+// master.
+func (t *throttleState) policyMAC(master []byte) ([]byte, error) {
+	key, err := hkdf.Key(sha256.New, master, nil, throttleKeyInfo, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(key)
+	mac := hmac.New(sha256.New, key)
+	mac.Write((&throttleState{policy: t.policy}).marshal()[:throttlePolicyLen])
+	return mac.Sum(nil), nil
+}
+
+// sign sets the MAC of t's policy.  Only a store holding the master
+// key can sign; failed attempts keep the MAC they read, which still
+// covers the policy.
+func (t *throttleState) sign(master []byte) error {
+	mac, err := t.policyMAC(master)
+	if err != nil {
+		return err
+	}
+	t.mac = mac
+	return nil
+}
+
+// verify reports whether t's policy was signed with master.
+func (t *throttleState) verify(master []byte) bool {
+	mac, err := t.policyMAC(master)
+	return err == nil && hmac.Equal(mac, t.mac)
+}
+
+// throttleFile returns the path of the throttle file.
+func (s *Store) throttleFile() string {
+	return filepath.Join(s.keyDir, throttleFileName)
+}
+
+// readThrottle returns the throttle file, or nil if the store has no
+// ThrottlePolicy.
+func (s *Store) readThrottle() (*throttleState, error) {
+	data, err := s.readFile(s.throttleFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read throttle file: %w", err)
+	}
+	return parseThrottle(data)
+}
+
+// writeThrottle writes the throttle file.  The caller must hold the
+// keys lock.
+func (s *Store) writeThrottle(t *throttleState) error {
+	if len(t.mac) != sha256.Size {
+		// Unsigned, as read from a version 1 file; it never verifies.
+		t.mac = make([]byte, sha256.Size)
+	}
+	if err := s.writeFile(s.throttleFile(), t.marshal()); err != nil {
+		return fmt.Errorf("failed to write throttle file: %w", err)
+	}
+	return nil
+}
+
+// SetThrottle sets the ThrottlePolicy applied to unlocking the store,
+// by this and every other process, and resets the failure count.  A
+// nil policy turns throttling off.
+func (s *Store) SetThrottle(p *ThrottlePolicy) error {
+	if s == nil {
+		return fmt.Errorf("no store")
+	}
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	if err := s.checkMaster(); err != nil {
+		return err
+	}
+	if p != nil && (p.Free < 0 || p.Delay < 0 || p.MaxDelay < 0 || p.WipeAfter < 0) {
+		return fmt.Errorf("invalid throttle policy")
+	}
+	lk, err := s.lock(s.lockFile)
+	if err != nil {
+		return fmt.Errorf("error locking %s: %w", s.lockFile, err)
+	}
+	defer lk.unlock()
+	txLk, err := s.lock(s.txLockFile)
+	if err != nil {
+		return fmt.Errorf("error locking %s: %w", s.txLockFile, err)
+	}
+	defer txLk.unlock()
+
+	// The file is written before the manifest records it and removed
+	// after, so an interruption never leaves a recorded policy without
+	// its file.
+	if p == nil {
+		if err := s.updateManifest(func(m *manifest) { m.throttled = false }); err != nil {
+			return err
+		}
+		s.setThrottle(nil)
+		err = os.Remove(s.throttleFile())
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove throttle file: %w", err)
+		}
+		return nil
+	}
+	t := &throttleState{policy: *p}
+	masterBuf := s.master()
+	err = t.sign(masterBuf.Bytes())
+	masterBuf.Destroy()
+	if err != nil {
+		return err
+	}
+	if err := s.writeThrottle(t); err != nil {
+		return err
+	}
+	s.setThrottle(p)
+	return s.updateManifest(func(m *manifest) { m.throttled = true })
+}
+
+// setThrottle records p as the verified ThrottlePolicy.
+func (s *Store) setThrottle(p *ThrottlePolicy) {
+	if p != nil {
+		c := *p
+		p = &c
+	}
+	s.mu.Lock()
+	s.throttle = p
+	s.mu.Unlock()
+}
+
+// attemptPolicy returns the policy an unlock attempt follows when the
+// throttle file holds t: the verified policy if the store has one, or
+// else t's policy made at least as strict as unverifiedThrottle and
+// without WipeAfter.
+func (s *Store) attemptPolicy(t *throttleState) ThrottlePolicy {
+	s.mu.RLock()
+	verified := s.throttle
+	s.mu.RUnlock()
+	if verified != nil {
+		return *verified
+	}
+	p := t.policy
+	p.Free = min(p.Free, unverifiedThrottle.Free)
+	p.Delay = max(p.Delay, unverifiedThrottle.Delay)
+	if p.MaxDelay > 0 {
+		p.MaxDelay = max(p.MaxDelay, unverifiedThrottle.MaxDelay)
+	}
+	p.WipeAfter = 0
+	return p
+}
+
+// checkThrottle returns an error wrapping ErrTampered if m records a
+// ThrottlePolicy and the throttle file is missing or its policy was not
+// set by SetThrottle.  The caller must hold the keys lock.
+func (s *Store) checkThrottle(m *manifest) error {
+	if !m.throttled {
+		return nil
+	}
+	t, err := s.readThrottle()
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return fmt.Errorf("throttle file missing: %w", ErrTampered)
+	}
+	masterBuf := s.master()
+	defer masterBuf.Destroy()
+	if !t.verify(masterBuf.Bytes()) {
+		return fmt.Errorf("throttle policy modified: %w", ErrTampered)
+	}
+	s.setThrottle(&t.policy)
+	return nil
+}
+
+// throttleSigned reports whether the store has a throttle file whose
+// policy verifies, for rebuilding a lost manifest.
+func (s *Store) throttleSigned() bool {
+	t, err := s.readThrottle()
+	if err != nil || t == nil {
+		return false
+	}
+	masterBuf := s.master()
+	defer masterBuf.Destroy()
+	return t.verify(masterBuf.Bytes())
+}
+
+// rewrapThrottle signs the policy of the throttle file in dir, if there
+// is one, with newMaster.
+func (s *Store) rewrapThrottle(dir string, newMaster []byte) error {
+	path := filepath.Join(dir, throttleFileName)
+	data, err := s.readFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read throttle file: %w", err)
+	}
+	t, err := parseThrottle(data)
+	if err != nil {
+		return err
+	}
+	masterBuf := s.master()
+	signed := t.verify(masterBuf.Bytes())
+	masterBuf.Destroy()
+	if !signed {
+		// Only a policy this store set is carried over as authentic.
+		return nil
+	}
+	if err := t.sign(newMaster); err != nil {
+		return err
+	}
+	if err := s.writeFile(path, t.marshal()); err != nil {
+		return fmt.Errorf("failed to write throttle file: %w", err)
+	}
+	return nil
+}
+
+// FailedUnlocks returns the number of consecutive failed attempts to
+// unlock the store, and when the last attempt began.  It is zero if
+// the store has no ThrottlePolicy.
+func (s *Store) FailedUnlocks() (int, time.Time, error) {
+	if s == nil {
+		return 0, time.Time{}, fmt.Errorf("no store")
+	}
+	if err := s.checkClosed(); err != nil {
+		return 0, time.Time{}, err
+	}
+	t, err := s.readThrottle()
+	if err != nil || t == nil {
+		return 0, time.Time{}, err
+	}
+	return int(t.failures), t.lastAttempt, nil
+}
+
+// throttled runs attempt, which unlocks the store, under the store's
+// ThrottlePolicy: it waits out the delay due after earlier failures,
+// counts attempt's failure, or resets the count if it succeeds.
+func (s *Store) throttled(attempt func() error) error {
+	if err := s.waitForAttempt(); err != nil {
+		return err
+	}
+	err := attempt()
+	if rerr := s.recordAttempt(err); errors.Is(rerr, ErrStoreWiped) {
+		return rerr
+	} else if rerr != nil {
+		s.debug("failed to count unlock attempt: %v", rerr)
+	}
+	return err
+}
+
+// waitForAttempt waits until the throttle allows another attempt, and
+// records that one began, so that attempts made at the same time by
+// other processes wait their turn.
+func (s *Store) waitForAttempt() error {
+	for {
+		lk, err := s.lock(s.lockFile)
+		if err != nil {
+			return fmt.Errorf("error locking %s: %w", s.lockFile, err)
+		}
+		t, err := s.readThrottle()
+		if err != nil || t == nil {
+			lk.unlock()
+			return err
+		}
+		wait := time.Until(t.lastAttempt.Add(t.delay(s.attemptPolicy(t))))
+		if wait <= 0 {
+			t.lastAttempt = time.Now()
+			err = s.writeThrottle(t)
+			lk.unlock()
+			return err
+		}
+		lk.unlock()
+		s.debug("waiting %v to unlock after %d failures", wait, t.failures)
+		select {
+		case <-s.stopChan:
+			return ErrClosed
+		case <-time.After(wait):
+		}
+	}
+}
+
+// recordAttempt counts a failure if err shows that the credential did
+// not match, and resets the count if err is nil.  Once WipeAfter
+// failures are counted under a verified policy, it wipes the key slots
+// and returns ErrStoreWiped.
+func (s *Store) recordAttempt(err error) error {
+	if err != nil && !errors.Is(err, ErrNoMatchingSlot) {
+		return nil
+	}
+	lk, lerr := s.lock(s.lockFile)
+	if lerr != nil {
+		return fmt.Errorf("error locking %s: %w", s.lockFile, lerr)
+	}
+	defer lk.unlock()
+	t, rerr := s.readThrottle()
+	if rerr != nil || t == nil {
+		return rerr
+	}
+	if err == nil {
+		if t.failures == 0 {
+			return nil
+		}
+		t.failures = 0
+		return s.writeThrottle(t)
+	}
+	t.failures++
+	s.debug("failed unlock %d of store %s", t.failures, s.dir)
+	if werr := s.writeThrottle(t); werr != nil {
+		return werr
+	}
+	if p := s.attemptPolicy(t); p.WipeAfter > 0 && int(t.failures) >= p.WipeAfter {
+		s.wipeSlots()
+		return ErrStoreWiped
+	}
+	return nil
+}
+
+// wipeSlots zeroes and removes every key slot, and the legacy salt
+// file, so that the master key cannot be recovered.
+func (s *Store) wipeSlots() {
+	entries, _ := os.ReadDir(s.slotsDir)
+	for _, entry := range entries {
+		path := filepath.Join(s.slotsDir, entry.Name())
+		zeroFile(path)
+		_ = os.Remove(path)
+	}
+	zeroFile(s.saltFile)
+	_ = os.Remove(s.saltFile)
+	_ = syncDir(s.slotsDir)
+	_ = syncDir(s.keyDir)
+}
+
+// checkFailedUnlocks emits UnlockFailed for each failure counted since
+// the watcher last looked.  It takes up a new policy set by another
+// process if it verifies, and wipes the key slots once the verified
+// policy's WipeAfter failures are counted, for attempts that could not
+// verify it themselves.
+func (s *Store) checkFailedUnlocks() {
+	t, err := s.readThrottle()
+	if err != nil || t == nil {
+		return
+	}
+	seen := s.seenFailures
+	s.seenFailures = t.failures
+	for n := seen; n < t.failures && n-seen < eventBufferSize; n++ {
+		s.emit(UnlockFailed)
+	}
+
+	if masterBuf := s.master(); masterBuf != nil {
+		if t.verify(masterBuf.Bytes()) {
+			s.setThrottle(&t.policy)
+		}
+		masterBuf.Destroy()
+	}
+	s.mu.RLock()
+	verified := s.throttle
+	s.mu.RUnlock()
+	if verified == nil || verified.WipeAfter <= 0 || int(t.failures) < verified.WipeAfter {
+		return
+	}
+	lk, err := s.lock(s.lockFile)
+	if err != nil {
+		s.debug("error locking %s: %v", s.lockFile, err)
+		return
+	}
+	defer lk.unlock()
+	// Check again, as a successful unlock may have reset the count.
+	if t, err = s.readThrottle(); err == nil && t != nil && int(t.failures) >= verified.WipeAfter {
+		s.debug("wiping key slots of %s after %d failed unlocks", s.dir, t.failures)
+		s.wipeSlots()
+	}
+}
@@ -0,0 +1,197 @@
+package darkstore
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_Throttle(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := filepath.Join(testStoreDir, "throttle")
+	defer os.RemoveAll(dir) //nolint: errcheck
+
+	// Follow the policy itself in the processes that cannot verify it.
+	defer func(old ThrottlePolicy) { unverifiedThrottle = old }(unverifiedThrottle)
+	unverifiedThrottle = ThrottlePolicy{Free: 100}
+
+	store, err := NewStore(dir, testPassword)
+	assert.NoError(err)
+	defer store.Close()
+	assert.NoError(store.Save("secret", []byte("guarded")))
+	assert.Error(store.SetThrottle(&ThrottlePolicy{Delay: -1}))
+	const delay = 200 * time.Millisecond
+	assert.NoError(store.SetThrottle(&ThrottlePolicy{Free: 2, Delay: delay}))
+
+	// Test case 1: Failures are counted, reported, and delayed after Free
+	t.Run("Failures", func(t *testing.T) {
+		var last time.Time
+		for i := 1; i <= 4; i++ {
+			_, err := Open(dir, Password([]byte("wrong")))
+			assert.ErrorIs(err, ErrNoMatchingSlot)
+			assert.Equal(UnlockFailed, waitForEvent(store, Rotated))
+			n, at, err := store.FailedUnlocks()
+			assert.NoError(err)
+			assert.Equal(i, n)
+			if i == 4 { // Waited for one delay after the third failure.
+				assert.GreaterOrEqual(at.Sub(last), delay)
+			}
+			last = at
+		}
+	})
+
+	// Test case 2: Attempts at the same time wait their turn
+	t.Run("Concurrent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		start := time.Now()
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := Open(dir, Password([]byte("wrong")))
+				assert.ErrorIs(err, ErrNoMatchingSlot)
+			}()
+		}
+		wg.Wait()
+		// After 4 failures, the first waits 2*delay from the last attempt
+		// and the second at least 2*delay more.
+		assert.GreaterOrEqual(time.Since(start), 3*delay)
+		n, _, err := store.FailedUnlocks()
+		assert.NoError(err)
+		assert.Equal(6, n)
+	})
+
+	// Test case 3: A successful unlock resets the count
+	t.Run("Reset", func(t *testing.T) {
+		other, err := Open(dir, Password(testPassword))
+		assert.NoError(err)
+		other.Close()
+		n, _, err := store.FailedUnlocks()
+		assert.NoError(err)
+		assert.Equal(0, n)
+	})
+
+	// Test case 4: The policy cannot be changed or removed unnoticed,
+	// while the failure count can be reset
+	t.Run("Tampered", func(t *testing.T) {
+		path := store.throttleFile()
+		data, err := os.ReadFile(path)
+		assert.NoError(err)
+		defer os.WriteFile(path, data, 0600) //nolint: errcheck
+
+		reset := append([]byte{}, data...)
+		copy(reset[throttlePolicyLen:], []byte{0, 0, 0, 0})
+		assert.NoError(os.WriteFile(path, reset, 0600))
+		other, err := Open(dir, Password(testPassword))
+		if assert.NoError(err) {
+			other.Close()
+		}
+
+		lenient := append([]byte{}, data...)
+		lenient[4] = 100 // Free
+		assert.NoError(os.WriteFile(path, lenient, 0600))
+		_, err = Open(dir, Password(testPassword))
+		assert.ErrorIs(err, ErrTampered)
+
+		assert.NoError(os.Remove(path))
+		_, err = Open(dir, Password(testPassword))
+		assert.ErrorIs(err, ErrTampered)
+	})
+
+	// Test case 5: Without a policy nothing is counted
+	t.Run("Off", func(t *testing.T) {
+		assert.NoError(store.SetThrottle(nil))
+		_, err := Open(dir, Password([]byte("wrong")))
+		assert.ErrorIs(err, ErrNoMatchingSlot)
+		n, _, err := store.FailedUnlocks()
+		assert.NoError(err)
+		assert.Equal(0, n)
+	})
+}
+
+func TestStore_ThrottleWipe(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := filepath.Join(testStoreDir, "throttle_wipe")
+	defer os.RemoveAll(dir) //nolint: errcheck
+
+	const delay = 50 * time.Millisecond
+	defer func(old ThrottlePolicy) { unverifiedThrottle = old }(unverifiedThrottle)
+	unverifiedThrottle = ThrottlePolicy{Delay: delay}
+
+	store, err := NewStore(dir, testPassword, WithIdleTimeout(time.Hour))
+	assert.NoError(err)
+	defer store.Close()
+	assert.NoError(store.SetThrottle(&ThrottlePolicy{Free: 5, WipeAfter: 3}))
+
+	// Test case 1: A planted policy neither lifts the delay nor wipes
+	t.Run("Planted", func(t *testing.T) {
+		path := store.throttleFile()
+		data, err := os.ReadFile(path)
+		assert.NoError(err)
+		orig, err := parseThrottle(data)
+		assert.NoError(err)
+		planted := &throttleState{
+			policy:      ThrottlePolicy{Free: 100, WipeAfter: 1},
+			failures:    1,
+			lastAttempt: time.Now(),
+			mac:         orig.mac,
+		}
+		assert.NoError(os.WriteFile(path, planted.marshal(), 0600))
+
+		start := time.Now()
+		_, err = Open(dir, Password([]byte("wrong")))
+		assert.ErrorIs(err, ErrNoMatchingSlot)
+		assert.GreaterOrEqual(time.Since(start), delay)
+		entries, err := os.ReadDir(store.slotsDir)
+		assert.NoError(err)
+		assert.NotEmpty(entries)
+		assert.NoError(os.WriteFile(path, data, 0600))
+	})
+
+	// Test case 2: Unlock failures count too
+	t.Run("Unlock", func(t *testing.T) {
+		store.lockIdle()
+		assert.ErrorIs(store.Unlock(Password([]byte("wrong"))), ErrNoMatchingSlot)
+		n, _, err := store.FailedUnlocks()
+		assert.NoError(err)
+		assert.Equal(1, n)
+	})
+
+	// Test case 3: The key slots are wiped after WipeAfter failures
+	t.Run("Wipe", func(t *testing.T) {
+		assert.ErrorIs(store.Unlock(Password([]byte("wrong"))), ErrNoMatchingSlot)
+		assert.ErrorIs(store.Unlock(Password([]byte("wrong"))), ErrStoreWiped)
+		entries, err := os.ReadDir(store.slotsDir)
+		assert.NoError(err)
+		assert.Empty(entries)
+
+		_, err = Open(dir, Password(testPassword))
+		assert.Error(err)
+		assert.Error(store.Unlock(Password(testPassword)))
+	})
+
+	// Test case 4: An open store wipes the slots for other processes
+	t.Run("Watcher", func(t *testing.T) {
+		dir := filepath.Join(testStoreDir, "throttle_wipe_watcher")
+		defer os.RemoveAll(dir) //nolint: errcheck
+		store, err := NewStore(dir, testPassword)
+		assert.NoError(err)
+		defer store.Close()
+		assert.NoError(store.SetThrottle(&ThrottlePolicy{Free: 5, WipeAfter: 2}))
+
+		for i := 0; i < 2; i++ {
+			_, err := Open(dir, Password([]byte("wrong")))
+			assert.ErrorIs(err, ErrNoMatchingSlot)
+		}
+		assert.Eventually(func() bool {
+			entries, err := os.ReadDir(store.slotsDir)
+			return err == nil && len(entries) == 0
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
@@ -0,0 +1,383 @@
+package darkstore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// Journal operation codes
+	txOpSave   = 0
+	txOpDelete = 1
+
+	journalCommitFile = "commit"
+)
+
+// Tx stages changes to a Store that are committed all-or-nothing by
+// Update.  A Tx must not be used after the function passed to Update
+// returns.
+type Tx struct {
+	s    *Store
+	ops  map[string]*txOp // Keyed by full path of the secret.
+	done bool
+}
+
+// txOp is a single staged change.  A nil data slice with del set
+// means the secret is to be deleted.
+type txOp struct {
+	path string
+	data []byte
+	del  bool
+}
+
+// Update runs fn with a new transaction and, if fn returns nil,
+// commits every change staged on the transaction atomically.  Either
+// all of the changes become visible to readers or none of them do,
+// even if the process crashes part way through the commit.  If fn
+// returns an error, nothing is written and that error is returned.
+func (s *Store) Update(fn func(tx *Tx) error) error {
+	if s == nil {
+		return fmt.Errorf("no store")
+	}
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	tx := &Tx{s: s, ops: make(map[string]*txOp)}
+	defer tx.close()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// Save stages data to be stored at path when the transaction commits.
+// The data is copied, so the caller may wipe it once Save returns.
+func (tx *Tx) Save(path string, data []byte) error {
+	if tx.done {
+		return fmt.Errorf("transaction is closed")
+	}
+	fullPath, err := tx.s.secretPath(path)
+	if err != nil {
+		return err
+	}
+	stat, err := os.Stat(fullPath)
+	if err == nil && stat.IsDir() {
+		return fmt.Errorf("secret %s is a directory", path)
+	}
+	tx.wipeOp(fullPath)
+	tx.ops[fullPath] = &txOp{path: path, data: append([]byte{}, data...)}
+	return nil
+}
+
+// Delete stages removal of the secret at path when the transaction
+// commits.
+func (tx *Tx) Delete(path string) error {
+	if tx.done {
+		return fmt.Errorf("transaction is closed")
+	}
+	fullPath, err := tx.s.secretPath(path)
+	if err != nil {
+		return err
+	}
+	tx.wipeOp(fullPath)
+	tx.ops[fullPath] = &txOp{path: path, del: true}
+	return nil
+}
+
+// Load retrieves the secret at path as it will be once the transaction
+// commits, taking any changes already staged on tx into account.
+func (tx *Tx) Load(path string) ([]byte, error) {
+	if tx.done {
+		return nil, fmt.Errorf("transaction is closed")
+	}
+	fullPath, err := tx.s.secretPath(path)
+	if err != nil {
+		return nil, err
+	}
+	if op, ok := tx.ops[fullPath]; ok {
+		if op.del {
+			return nil, fmt.Errorf("secret not found: %s", path)
+		}
+		return append([]byte{}, op.data...), nil
+	}
+	return tx.s.Load(path)
+}
+
+// wipeOp zeroes the data of any change already staged for fullPath.
+func (tx *Tx) wipeOp(fullPath string) {
+	if op, ok := tx.ops[fullPath]; ok {
+		Wipe(op.data)
+	}
+}
+
+// close wipes all staged data and marks the transaction unusable.
+func (tx *Tx) close() {
+	for _, op := range tx.ops {
+		Wipe(op.data)
+	}
+	tx.ops = nil
+	tx.done = true
+}
+
+// commit writes every staged change to the journal, marks the journal
+// committed, and then applies it to the store.  If the process dies
+// before the commit marker is written, recoverJournal discards the
+// journal; if it dies after, recoverJournal replays it.
+func (tx *Tx) commit() error {
+	s := tx.s
+	if len(tx.ops) == 0 {
+		return nil
+	}
+
+	lk, err := s.lock(s.txLockFile)
+	if err != nil {
+		return fmt.Errorf("error locking %s: %w", s.txLockFile, err)
+	}
+	defer lk.unlock()
+
+	// A committed journal that failed to apply must be finished before
+	// a new one takes its place.
+	if err := s.replayJournal(); err != nil {
+		return err
+	}
+
+	// Apply changes in a stable order so that replay is deterministic.
+	fullPaths := make([]string, 0, len(tx.ops))
+	for fullPath := range tx.ops {
+		fullPaths = append(fullPaths, fullPath)
+	}
+	sort.Strings(fullPaths)
+
+	entries := make([][]byte, 0, len(fullPaths))
+	for _, fullPath := range fullPaths {
+		op := tx.ops[fullPath]
+		rel, _ := filepath.Rel(s.dir, fullPath)
+		if op.del {
+			entries = append(entries, encodeJournalEntry(txOpDelete, rel, nil))
+			continue
+		}
+		encryptedData, err := s.encryptData(op.data)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt %s: %w", op.path, err)
+		}
+		entries = append(entries, encodeJournalEntry(txOpSave, rel, encryptedData))
+	}
+
+	if err := s.writeJournal(entries); err != nil {
+		_ = os.RemoveAll(s.journalDir)
+		return fmt.Errorf("failed to write transaction journal: %w", err)
+	}
+
+	// The transaction is durable from here on.  If applying it fails,
+	// the journal is left in place to be replayed on the next open.
+	if err := s.applyJournal(); err != nil {
+		return fmt.Errorf("failed to apply transaction: %w", err)
+	}
+	return nil
+}
+
+// encodeJournalEntry serializes a journal entry as the op code, a
+// two-byte big-endian path length, the path relative to the store
+// directory, and the encrypted data.
+func encodeJournalEntry(op uint8, rel string, encryptedData []byte) []byte {
+	entry := make([]byte, 3+len(rel)+len(encryptedData))
+	entry[0] = op
+	binary.BigEndian.PutUint16(entry[1:3], uint16(len(rel)))
+	copy(entry[3:], rel)
+	copy(entry[3+len(rel):], encryptedData)
+	return entry
+}
+
+// decodeJournalEntry is the inverse of encodeJournalEntry.
+func decodeJournalEntry(entry []byte) (uint8, string, []byte, error) {
+	if len(entry) < 3 {
+		return 0, "", nil, fmt.Errorf("invalid journal entry")
+	}
+	pathLen := int(binary.BigEndian.Uint16(entry[1:3]))
+	if len(entry) < 3+pathLen {
+		return 0, "", nil, fmt.Errorf("invalid journal entry")
+	}
+	return entry[0], string(entry[3 : 3+pathLen]), entry[3+pathLen:], nil
+}
+
+// writeJournal durably writes the journal entries followed by the
+// commit marker, which records how many entries make up the
+// transaction.  Any earlier journal must already have been replayed.
+func (s *Store) writeJournal(entries [][]byte) error {
+	if err := os.MkdirAll(s.journalDir, s.dirPerm); err != nil {
+		return err
+	}
+	for i, entry := range entries {
+		if err := s.syncWrite(filepath.Join(s.journalDir, fmt.Sprintf("op%d", i)), entry); err != nil {
+			return err
+		}
+	}
+	marker, err := s.journalMarker(entries)
+	if err != nil {
+		return err
+	}
+	if err := s.syncWrite(filepath.Join(s.journalDir, journalCommitFile), marker); err != nil {
+		return err
+	}
+	return syncDir(s.journalDir)
+}
+
+// journalMarker returns the commit marker for entries: the entry count
+// followed by an HMAC of the count and every entry, keyed with the
+// manifest key.  Without the MAC, anyone able to write to the keys
+// directory could use a forged journal to roll secrets back.
+func (s *Store) journalMarker(entries [][]byte) ([]byte, error) {
+	key, err := s.manifestKey()
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(key)
+
+	marker := binary.BigEndian.AppendUint32(nil, uint32(len(entries)))
+	mac := hmac.New(sha256.New, key)
+	mac.Write(marker)
+	for _, entry := range entries {
+		mac.Write(binary.BigEndian.AppendUint32(nil, uint32(len(entry))))
+		mac.Write(entry)
+	}
+	return mac.Sum(marker), nil
+}
+
+// applyJournal applies a committed journal to the store and removes
+// it.  Applying the same journal more than once is harmless, which is
+// what makes replay after a crash safe.  The caller must hold the
+// exclusive transaction lock.
+func (s *Store) applyJournal() error {
+	marker, err := os.ReadFile(filepath.Join(s.journalDir, journalCommitFile))
+	if err != nil || len(marker) != 4+sha256.Size {
+		return fmt.Errorf("invalid journal commit marker")
+	}
+	count := int(binary.BigEndian.Uint32(marker))
+	entries := make([][]byte, count)
+	for i := range entries {
+		entries[i], err = os.ReadFile(filepath.Join(s.journalDir, fmt.Sprintf("op%d", i)))
+		if err != nil {
+			return fmt.Errorf("failed to read journal entry %d: %w", i, err)
+		}
+	}
+	expected, err := s.journalMarker(entries)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(marker, expected) {
+		return fmt.Errorf("journal authentication failed: %w", ErrTampered)
+	}
+
+	m, err := s.readManifest()
+	if err != nil {
+		return err
+	}
+
+	for i, entry := range entries {
+		op, rel, encryptedData, err := decodeJournalEntry(entry)
+		if err != nil {
+			return fmt.Errorf("journal entry %d: %w", i, err)
+		}
+		fullPath := filepath.Join(s.dir, rel)
+		if !strings.HasPrefix(fullPath, s.dir+"/") ||
+			strings.HasPrefix(fullPath, s.keyDir+"/") {
+			return fmt.Errorf("journal entry %d: path outside store hierarchy: %s", i, rel)
+		}
+		switch op {
+		case txOpSave:
+			err = s.replaceFile(fullPath, encryptedData)
+			m.set(s.relPath(fullPath), encryptedData)
+		case txOpDelete:
+			err = os.Remove(fullPath)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+			delete(m.entries, s.relPath(fullPath))
+		default:
+			err = fmt.Errorf("unknown journal op %d", op)
+		}
+		if err != nil {
+			return fmt.Errorf("journal entry %d (%s): %w", i, rel, err)
+		}
+	}
+
+	// The manifest is written once, after every file is in place, so
+	// it never describes a partially applied transaction.
+	if err := s.writeManifest(m); err != nil {
+		return err
+	}
+	return os.RemoveAll(s.journalDir)
+}
+
+// replaceFile atomically replaces the file at fullPath with data by
+// writing a temporary file in the journal directory and renaming it
+// into place.
+func (s *Store) replaceFile(fullPath string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(fullPath), s.dirPerm); err != nil {
+		return err
+	}
+	lk, err := s.lock(fullPath)
+	if err != nil {
+		return err
+	}
+	defer lk.unlock()
+
+	f, err := os.CreateTemp(s.journalDir, "apply")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	defer os.Remove(tmpPath) //nolint: errcheck
+	if err = f.Chmod(s.filePerm); err == nil {
+		_, err = f.Write(data)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, fullPath)
+}
+
+// recoverJournal finishes a transaction whose commit was interrupted.
+// A journal with a commit marker is replayed; one without is
+// discarded, leaving the store as it was before the transaction.
+func (s *Store) recoverJournal() error {
+	if _, err := os.Stat(s.journalDir); os.IsNotExist(err) {
+		return nil
+	}
+	lk, err := s.lock(s.txLockFile)
+	if err != nil {
+		return fmt.Errorf("error locking %s: %w", s.txLockFile, err)
+	}
+	defer lk.unlock()
+	return s.replayJournal()
+}
+
+// replayJournal is recoverJournal for callers that hold the exclusive
+// transaction lock.
+func (s *Store) replayJournal() error {
+	// Someone else may have recovered it while waiting for the lock.
+	if _, err := os.Stat(s.journalDir); os.IsNotExist(err) {
+		return nil
+	}
+	_, err := os.Stat(filepath.Join(s.journalDir, journalCommitFile))
+	if os.IsNotExist(err) {
+		return os.RemoveAll(s.journalDir)
+	}
+	if err := s.applyJournal(); err != nil {
+		return fmt.Errorf("failed to replay transaction journal: %w", err)
+	}
+	return nil
+}
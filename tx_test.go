@@ -0,0 +1,202 @@
+package darkstore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_Update(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := filepath.Join(testStoreDir, "tx_update")
+	defer os.RemoveAll(dir) //nolint: errcheck
+
+	store, err := newTestStore(dir)
+	assert.NoError(err)
+	defer store.Close()
+
+	// Test case 1: Commit several changes together
+	t.Run("Commit", func(t *testing.T) {
+		assert.NoError(store.Save("db/old", []byte("stale")))
+		err := store.Update(func(tx *Tx) error {
+			if err := tx.Save("db/user", []byte("admin")); err != nil {
+				return err
+			}
+			if err := tx.Save("db/pass", []byte("hunter2")); err != nil {
+				return err
+			}
+			return tx.Delete("db/old")
+		})
+		assert.NoError(err)
+
+		user, err := store.Load("db/user")
+		assert.NoError(err)
+		assert.Equal([]byte("admin"), user)
+		pass, err := store.Load("db/pass")
+		assert.NoError(err)
+		assert.Equal([]byte("hunter2"), pass)
+		_, err = store.Load("db/old")
+		assert.Error(err)
+		assert.Contains(err.Error(), "secret not found")
+
+		_, err = os.Stat(store.journalDir)
+		assert.True(os.IsNotExist(err), "journal should be removed after commit")
+	})
+
+	// Test case 2: An error from fn discards all changes
+	t.Run("Rollback", func(t *testing.T) {
+		err := store.Update(func(tx *Tx) error {
+			if err := tx.Save("db/user", []byte("mallory")); err != nil {
+				return err
+			}
+			return fmt.Errorf("changed my mind")
+		})
+		assert.Error(err)
+		assert.Contains(err.Error(), "changed my mind")
+
+		user, err := store.Load("db/user")
+		assert.NoError(err)
+		assert.Equal([]byte("admin"), user)
+	})
+
+	// Test case 3: Load sees staged changes
+	t.Run("Load staged", func(t *testing.T) {
+		err := store.Update(func(tx *Tx) error {
+			assert.NoError(tx.Save("db/user", []byte("root")))
+			data, err := tx.Load("db/user")
+			assert.NoError(err)
+			assert.Equal([]byte("root"), data)
+
+			assert.NoError(tx.Delete("db/pass"))
+			_, err = tx.Load("db/pass")
+			assert.Error(err)
+			return fmt.Errorf("abort")
+		})
+		assert.Error(err)
+		pass, err := store.Load("db/pass")
+		assert.NoError(err)
+		assert.Equal([]byte("hunter2"), pass)
+	})
+
+	// Test case 4: Invalid paths and use after Update returns
+	t.Run("Invalid use", func(t *testing.T) {
+		var saved *Tx
+		err := store.Update(func(tx *Tx) error {
+			saved = tx
+			assert.Error(tx.Save("", []byte("x")))
+			assert.Error(tx.Save("../escape", []byte("x")))
+			assert.Error(tx.Delete("../escape"))
+			return nil
+		})
+		assert.NoError(err)
+		err = saved.Save("late", []byte("x"))
+		assert.Error(err)
+		assert.Contains(err.Error(), "transaction is closed")
+	})
+}
+
+func TestStore_recoverJournal(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := filepath.Join(testStoreDir, "tx_recover")
+	defer os.RemoveAll(dir) //nolint: errcheck
+
+	store, err := newTestStore(dir)
+	assert.NoError(err)
+	defer store.Close()
+	assert.NoError(store.Save("cert", []byte("old cert")))
+	assert.NoError(store.Save("key", []byte("old key")))
+
+	journal := func() [][]byte {
+		cert, err := store.encryptData([]byte("new cert"))
+		assert.NoError(err)
+		key, err := store.encryptData([]byte("new key"))
+		assert.NoError(err)
+		return [][]byte{
+			encodeJournalEntry(txOpSave, "cert", cert),
+			encodeJournalEntry(txOpSave, "key", key),
+		}
+	}
+
+	// Test case 1: Journal without commit marker is discarded
+	t.Run("Uncommitted journal", func(t *testing.T) {
+		assert.NoError(store.writeJournal(journal()))
+		assert.NoError(os.Remove(filepath.Join(store.journalDir, journalCommitFile)))
+
+		assert.NoError(store.recoverJournal())
+		_, err := os.Stat(store.journalDir)
+		assert.True(os.IsNotExist(err))
+
+		cert, err := store.Load("cert")
+		assert.NoError(err)
+		assert.Equal([]byte("old cert"), cert)
+	})
+
+	// Test case 2: Committed journal is replayed
+	t.Run("Committed journal", func(t *testing.T) {
+		assert.NoError(store.writeJournal(journal()))
+		// Simulate a crash after only the first entry was applied.
+		cert, err := store.encryptData([]byte("new cert"))
+		assert.NoError(err)
+		assert.NoError(store.replaceFile(filepath.Join(store.dir, "cert"), cert))
+
+		assert.NoError(store.recoverJournal())
+		_, err = os.Stat(store.journalDir)
+		assert.True(os.IsNotExist(err))
+
+		data, err := store.Load("cert")
+		assert.NoError(err)
+		assert.Equal([]byte("new cert"), data)
+		data, err = store.Load("key")
+		assert.NoError(err)
+		assert.Equal([]byte("new key"), data)
+	})
+
+	// Test case 3: Journal entries may not escape the store
+	t.Run("Malicious journal", func(t *testing.T) {
+		entry := encodeJournalEntry(txOpDelete, "../outside", nil)
+		assert.NoError(store.writeJournal([][]byte{entry}))
+		err := store.recoverJournal()
+		assert.Error(err)
+		assert.Contains(err.Error(), "outside store hierarchy")
+		assert.NoError(os.RemoveAll(store.journalDir))
+	})
+
+	// Test case 4: Forged journal entries are rejected
+	t.Run("Forged journal", func(t *testing.T) {
+		assert.NoError(store.writeJournal(journal()))
+		op0 := filepath.Join(store.journalDir, "op0")
+		entry, err := os.ReadFile(op0)
+		assert.NoError(err)
+		entry[len(entry)-1] ^= 0xff
+		assert.NoError(os.WriteFile(op0, entry, 0600))
+
+		err = store.recoverJournal()
+		assert.True(errors.Is(err, ErrTampered), "got %v", err)
+		assert.True(errors.Is(store.Update(func(tx *Tx) error {
+			return tx.Save("other", []byte("other"))
+		}), ErrTampered), "a forged journal is not replaced")
+		assert.NoError(os.RemoveAll(store.journalDir))
+	})
+
+	// Test case 5: A journal that failed to apply is replayed first
+	t.Run("Unapplied journal", func(t *testing.T) {
+		assert.NoError(store.Save("cert", []byte("old cert")))
+		assert.NoError(store.writeJournal(journal()))
+
+		assert.NoError(store.Update(func(tx *Tx) error {
+			return tx.Save("other", []byte("other"))
+		}))
+		data, err := store.Load("cert")
+		assert.NoError(err)
+		assert.Equal([]byte("new cert"), data)
+		data, err = store.Load("other")
+		assert.NoError(err)
+		assert.Equal([]byte("other"), data)
+	})
+}
@@ -0,0 +1,245 @@
+package darkstore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// rawKeyLen is the length of the keys taken by key slots.
+const rawKeyLen = 32
+
+// Unlocker supplies the credential that unlocks an existing store's
+// master key from one of its key slots.  Unlockers are made by this
+// package's constructors, such as Password, KeyFile, Identity and
+// Shares; other packages cannot implement it.  To supply a credential
+// in a custom way, such as by prompting the user, pass a Source to
+// PasswordFrom or KeyFrom.
+type Unlocker interface {
+	// unlockStore sets s.primaryKey and s.slotName.  It is called with
+	// the keys directory locked.
+	unlockStore(s *Store) error
+}
+
+// Source supplies a secret, such as a password or key, when a store is
+// opened.  A custom Source can prompt the user or ask an agent.  The
+// returned slice is wiped once the store has been unlocked.
+type Source func() ([]byte, error)
+
+// FromEnv returns a Source that reads the secret from the environment
+// variable name.  The variable is left set.
+func FromEnv(name string) Source {
+	return func() ([]byte, error) {
+		value, ok := os.LookupEnv(name)
+		if !ok || value == "" {
+			return nil, fmt.Errorf("environment variable %s is not set", name)
+		}
+		return []byte(value), nil
+	}
+}
+
+// FromFD returns a Source that reads the secret from the open file
+// descriptor fd, such as one passed in by systemd, up to end of file
+// and without a single trailing newline.  The descriptor is closed.
+func FromFD(fd uintptr) Source {
+	return func() ([]byte, error) {
+		f := os.NewFile(fd, fmt.Sprintf("fd%d", fd))
+		if f == nil {
+			return nil, fmt.Errorf("invalid file descriptor %d", fd)
+		}
+		defer f.Close() //nolint: errcheck
+		return readSecret(f)
+	}
+}
+
+// FromFile returns a Source that reads the secret from the file at
+// path, without a single trailing newline.
+func FromFile(path string) Source {
+	return func() ([]byte, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %w", path, err)
+		}
+		defer f.Close() //nolint: errcheck
+		return readSecret(f)
+	}
+}
+
+// readSecret reads all of r, wiping any buffers it outgrows.
+func readSecret(r io.Reader) ([]byte, error) {
+	buf := make([]byte, 0, 512)
+	for {
+		if len(buf) == cap(buf) {
+			bigger := make([]byte, len(buf), 2*cap(buf))
+			copy(bigger, buf)
+			Wipe(buf)
+			buf = bigger
+		}
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			Wipe(buf)
+			return nil, fmt.Errorf("failed to read secret: %w", err)
+		}
+	}
+	if bytes.HasSuffix(buf, []byte("\n")) {
+		buf[len(buf)-1] = 0
+		buf = buf[:len(buf)-1]
+	}
+	return buf, nil
+}
+
+// passwordUnlocker unlocks a password key slot.
+type passwordUnlocker struct {
+	password []byte
+	source   Source // If set, password is read from it and wiped after.
+}
+
+// Password returns an Unlocker that tries password against every
+// password key slot, as NewStore does.
+func Password(password []byte) Unlocker {
+	return &passwordUnlocker{password: password}
+}
+
+// PasswordFrom returns an Unlocker that reads a password from src and
+// tries it against every password key slot.
+func PasswordFrom(src Source) Unlocker {
+	return &passwordUnlocker{source: src}
+}
+
+func (u *passwordUnlocker) unlockStore(s *Store) error {
+	if u.source != nil {
+		password, err := u.source()
+		if err != nil {
+			return err
+		}
+		u.password = password
+	}
+	if len(u.password) == 0 {
+		return fmt.Errorf("password must not be empty")
+	}
+	return s.getPrimaryKey(u.password)
+}
+
+// done wipes the password if it was read from a Source.
+func (u *passwordUnlocker) done() {
+	if u.source != nil {
+		Wipe(u.password)
+		u.password = nil
+	}
+}
+
+// keyUnlocker unlocks a key slot with a raw key.
+type keyUnlocker struct {
+	source Source
+}
+
+// KeyFile returns an Unlocker that reads a 32-byte key from the file at
+// path and tries it against every key slot added with AddKeyFileSlot.
+// No KDF is run.
+func KeyFile(path string) Unlocker {
+	return &keyUnlocker{source: FromFile(path)}
+}
+
+// KeyFrom returns an Unlocker that reads a key from src, either as 32
+// raw bytes or as 64 hexadecimal digits, and tries it against every key
+// slot added with AddKeyFileSlot.
+func KeyFrom(src Source) Unlocker {
+	return &keyUnlocker{source: src}
+}
+
+func (u *keyUnlocker) unlockStore(s *Store) error {
+	key, err := u.source()
+	if err != nil {
+		return err
+	}
+	// key may be replaced by its decoded form, so wipe whichever it is.
+	defer func() { Wipe(key) }()
+	if len(key) == 2*rawKeyLen {
+		decoded := make([]byte, rawKeyLen)
+		if _, err := hex.Decode(decoded, key); err == nil {
+			Wipe(key)
+			key = decoded
+		} else {
+			Wipe(decoded)
+		}
+	}
+	if len(key) != rawKeyLen {
+		return fmt.Errorf("key must be %d bytes or %d hexadecimal digits", rawKeyLen, 2*rawKeyLen)
+	}
+	return s.unlockSlotsOfKind(slotTypeKey, key)
+}
+
+// GenerateKeyFile writes a new random 32-byte key to a new file at path,
+// readable only by its owner, for use with AddKeyFileSlot and KeyFile.
+func GenerateKeyFile(path string) error {
+	key := make([]byte, rawKeyLen)
+	defer Wipe(key)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0400)
+	if err != nil {
+		return fmt.Errorf("failed to create key file: %w", err)
+	}
+	_, err = f.Write(key)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return fmt.Errorf("failed to write key file: %w", err)
+	}
+	return nil
+}
+
+// Open opens the existing store at dirpath, unlocking it with u.
+// Unlike NewStore, it never creates a store.
+func Open(dirpath string, u Unlocker, opts ...Option) (*Store, error) {
+	store, err := newStoreHandle(dirpath, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	isNewStore, err := store.checkNewStore()
+	if err != nil {
+		return nil, err
+	}
+	if isNewStore {
+		return nil, fmt.Errorf("no store at %s", store.dir)
+	}
+	if err = store.harden(); err != nil {
+		return nil, err
+	}
+	if err = store.open(u); err != nil {
+		store.unharden()
+		return nil, err
+	}
+	return store, nil
+}
+
+// open unlocks an existing store with u and starts it.
+func (s *Store) open(u Unlocker) error {
+	err := s.throttled(func() error {
+		return s.openExistingStore(func() error { return u.unlockStore(s) })
+	})
+	if pw, ok := u.(*passwordUnlocker); ok {
+		defer pw.done()
+		if err == nil {
+			// Stores created before key slots existed get one now.
+			err = s.migrateToSlots(pw.password)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return s.start()
+}
@@ -0,0 +1,100 @@
+package darkstore
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpen(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := filepath.Join(testStoreDir, "open_unlockers")
+	keyPath := filepath.Join(testStoreDir, "open_unlockers.key")
+	defer os.RemoveAll(dir)     //nolint: errcheck
+	defer os.RemoveAll(keyPath) //nolint: errcheck
+
+	store, err := NewStore(dir, testPassword)
+	assert.NoError(err)
+	assert.NoError(store.Save("secret", []byte("automated")))
+	assert.NoError(GenerateKeyFile(keyPath))
+	assert.Error(GenerateKeyFile(keyPath), "never overwrites a key file")
+	key, err := os.ReadFile(keyPath)
+	assert.NoError(err)
+	assert.NoError(store.AddKeyFileSlot("ci", key))
+	assert.Error(store.AddKeyFileSlot("short", key[:16]))
+	methods, err := store.UnlockMethods()
+	assert.NoError(err)
+	assert.Equal([]string{"key", "password"}, methods)
+	store.Close()
+
+	check := func(u Unlocker) {
+		store, err := Open(dir, u)
+		if !assert.NoError(err) {
+			return
+		}
+		defer store.Close()
+		data, err := store.Load("secret")
+		assert.NoError(err)
+		assert.Equal([]byte("automated"), data)
+	}
+
+	// Test case 1: Key file and key from the environment
+	t.Run("Keys", func(t *testing.T) {
+		check(KeyFile(keyPath))
+		t.Setenv("DARKSTORE_TEST_KEY", hex.EncodeToString(key))
+		check(KeyFrom(FromEnv("DARKSTORE_TEST_KEY")))
+
+		_, err := Open(dir, KeyFrom(func() ([]byte, error) { return make([]byte, rawKeyLen), nil }))
+		assert.True(errors.Is(err, ErrNoMatchingSlot), "got %v", err)
+		_, err = Open(dir, KeyFrom(FromEnv("DARKSTORE_TEST_UNSET")))
+		assert.Error(err)
+	})
+
+	// Test case 2: Passwords from the environment, a descriptor and a callback
+	t.Run("Password sources", func(t *testing.T) {
+		t.Setenv("DARKSTORE_TEST_PASSWORD", string(testPassword))
+		check(PasswordFrom(FromEnv("DARKSTORE_TEST_PASSWORD")))
+
+		r, w, err := os.Pipe()
+		assert.NoError(err)
+		_, err = w.Write(append(append([]byte{}, testPassword...), '\n'))
+		assert.NoError(err)
+		assert.NoError(w.Close())
+		check(PasswordFrom(FromFD(r.Fd())))
+
+		prompted := false
+		check(PasswordFrom(func() ([]byte, error) {
+			prompted = true
+			return append([]byte{}, testPassword...), nil
+		}))
+		assert.True(prompted)
+
+		_, err = Open(dir, PasswordFrom(func() ([]byte, error) { return nil, errors.New("cancelled") }))
+		assert.Error(err)
+		assert.Contains(err.Error(), "cancelled")
+	})
+
+	// Test case 3: A store unlocked only by a key file
+	t.Run("Key only", func(t *testing.T) {
+		store, err := Open(dir, KeyFile(keyPath))
+		assert.NoError(err)
+		assert.Error(store.Passwd([]byte("password")), "key slots have no password")
+		assert.NoError(store.RemoveKeySlot(defaultSlotName))
+		err = store.RemoveKeySlot("ci")
+		assert.Error(err)
+		assert.Contains(err.Error(), "last key slot")
+		store.Close()
+
+		_, err = Open(dir, Password(testPassword))
+		assert.Error(err)
+		check(KeyFile(keyPath))
+
+		_, err = Open(filepath.Join(testStoreDir, "open_no_store"), KeyFile(keyPath))
+		assert.Error(err)
+	})
+}
@@ -0,0 +1,442 @@
+package darkstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ProblemKind classifies a problem found by Verify.
+type ProblemKind int
+
+const (
+	// ProblemKeyFile is a key<N> file that is unreadable or does not
+	// decrypt with the primary key.
+	ProblemKeyFile ProblemKind = iota
+	// ProblemDataFile is a data file that does not decrypt under any
+	// key present in the store.
+	ProblemDataFile
+	// ProblemCurrentKey is a missing or inconsistent currentkey file.
+	ProblemCurrentKey
+	// ProblemRotation is a key rotation that has not finished
+	// re-encrypting all data.
+	ProblemRotation
+	// ProblemStray is a leftover file or directory from an interrupted
+	// Passwd, rotation, or transaction.
+	ProblemStray
+	// ProblemPermissions is a file or directory that others can write
+	// to, or a key file that others can read.
+	ProblemPermissions
+	// ProblemIntegrity is a secret that does not match the manifest.
+	ProblemIntegrity
+)
+
+// String returns a short name for the problem kind.
+func (k ProblemKind) String() string {
+	switch k {
+	case ProblemKeyFile:
+		return "key file"
+	case ProblemDataFile:
+		return "data file"
+	case ProblemCurrentKey:
+		return "current key"
+	case ProblemRotation:
+		return "rotation"
+	case ProblemStray:
+		return "stray file"
+	case ProblemPermissions:
+		return "permissions"
+	case ProblemIntegrity:
+		return "integrity"
+	}
+	return "unknown"
+}
+
+// Problem is a single problem found by Verify.
+type Problem struct {
+	Kind ProblemKind
+	Path string // File or directory the problem was found in.
+	Err  error
+}
+
+// Error implements the error interface.
+func (p Problem) Error() string {
+	return fmt.Sprintf("%s: %s: %v", p.Kind, p.Path, p.Err)
+}
+
+// Unwrap returns the underlying error.
+func (p Problem) Unwrap() error {
+	return p.Err
+}
+
+// VerifyReport is the result of Verify.
+type VerifyReport struct {
+	Problems []Problem
+}
+
+// OK returns true if no problems were found.
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// Err returns all problems joined into one error, or nil if there are
+// none.
+func (r *VerifyReport) Err() error {
+	errs := make([]error, len(r.Problems))
+	for i, p := range r.Problems {
+		errs[i] = p
+	}
+	return errors.Join(errs...)
+}
+
+func (r *VerifyReport) add(kind ProblemKind, path string, err error) {
+	r.Problems = append(r.Problems, Problem{Kind: kind, Path: path, Err: err})
+}
+
+// RepairOptions selects which potentially destructive steps Repair may
+// take.  The steps that only finish work the store was already doing
+// are always taken.
+type RepairOptions struct {
+	// RestoreOldPassword restores the key directory left behind by an
+	// interrupted Passwd instead of wiping it.  The store will then
+	// require the old password, so this Store must be re-opened.  If
+	// this Store can no longer read the restored keys, the report is
+	// empty.
+	RestoreOldPassword bool
+
+	// RemoveUndecryptable deletes data files that cannot be decrypted
+	// under any key in the store.  Files whose key cannot be loaded,
+	// for example while a KeyWrapper is unavailable, are kept.
+	RemoveUndecryptable bool
+
+	// RebuildManifest accepts every data file that decrypts as it is,
+	// recording it in the manifest.  Use this after a crash between
+	// writing a secret and updating the manifest, once satisfied that
+	// the store was not tampered with.
+	RebuildManifest bool
+
+	// FixPermissions removes write access for others from everything in
+	// the store, and all access for others from the keys directory.
+	FixPermissions bool
+}
+
+// Verify checks the whole store for problems: that every key file
+// decrypts, every data file decrypts under a present key, currentkey
+// is consistent, no leftovers from interrupted operations remain,
+// permissions are sane, and every secret matches the manifest.  An
+// error is returned only if the check itself could not be done.
+func (s *Store) Verify(ctx context.Context) (*VerifyReport, error) {
+	if s == nil {
+		return nil, fmt.Errorf("no store")
+	}
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	lk, err := s.rLock(s.lockFile)
+	if err != nil {
+		return nil, fmt.Errorf("error locking %s: %w", s.keyDir, err)
+	}
+	defer lk.unlock()
+	txLk, err := s.rLock(s.txLockFile)
+	if err != nil {
+		return nil, fmt.Errorf("error locking %s: %w", s.txLockFile, err)
+	}
+	defer txLk.unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r := &VerifyReport{}
+	keys := s.verifyKeys(r)
+	s.verifyStray(r)
+	s.verifyPermissions(r)
+	if err := s.verifyData(ctx, r, keys); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// verifyKeys checks every key file and currentkey, and returns the
+// indexes of the keys that decrypted.
+func (s *Store) verifyKeys(r *VerifyReport) map[uint8]bool {
+	keys := make(map[uint8]bool)
+	keyFiles, err := filepath.Glob(filepath.Join(s.keyDir, "key*"))
+	if err != nil {
+		r.add(ProblemKeyFile, s.keyDir, err)
+		return keys
+	}
+	for _, keyPath := range keyFiles {
+		index, err := strconv.ParseUint(strings.TrimPrefix(filepath.Base(keyPath), "key"), 10, 8)
+		if err != nil {
+			r.add(ProblemStray, keyPath, fmt.Errorf("not a key file"))
+			continue
+		}
+		key, err := s.loadKeyFromPath(keyPath)
+		if err != nil {
+			r.add(ProblemKeyFile, keyPath, err)
+			continue
+		}
+		Wipe(key)
+		keys[uint8(index)] = true
+	}
+
+	if _, err := s.readSlots(); err != nil {
+		r.add(ProblemKeyFile, s.slotsDir, err)
+	}
+
+	data, err := os.ReadFile(s.curKeyIdxFile)
+	switch {
+	case err != nil:
+		r.add(ProblemCurrentKey, s.curKeyIdxFile, err)
+	case len(data) != 1:
+		r.add(ProblemCurrentKey, s.curKeyIdxFile, fmt.Errorf("invalid current key file format"))
+	case !keys[data[0]]:
+		r.add(ProblemCurrentKey, s.curKeyIdxFile, fmt.Errorf("key%d is not usable", data[0]))
+	case data[0] != s.keyIndex():
+		r.add(ProblemCurrentKey, s.curKeyIdxFile,
+			fmt.Errorf("key%d on disk but key%d in use", data[0], s.keyIndex()))
+	}
+	return keys
+}
+
+// verifyStray looks for leftovers of interrupted operations.
+func (s *Store) verifyStray(r *VerifyReport) {
+	stray := []string{
+		filepath.Join(s.dir, newPwDirName),
+		filepath.Join(s.dir, oldPwDirName),
+		s.tempDir,
+		s.journalDir,
+		s.manifestFile + ".tmp",
+	}
+	for _, path := range stray {
+		if _, err := os.Stat(path); err == nil {
+			r.add(ProblemStray, path, fmt.Errorf("left over from an interrupted operation"))
+		}
+	}
+}
+
+// verifyPermissions flags anything in the store others can write to,
+// and anything in the keys directory others can access at all.
+func (s *Store) verifyPermissions(r *VerifyReport) {
+	_ = filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		mode := info.Mode().Perm()
+		if mode&0002 != 0 {
+			r.add(ProblemPermissions, path, fmt.Errorf("writable by others (%#o)", mode))
+		} else if strings.HasPrefix(path, s.keyDir) && mode&0007 != 0 {
+			r.add(ProblemPermissions, path, fmt.Errorf("accessible by others (%#o)", mode))
+		}
+		return nil
+	})
+}
+
+// verifyData checks that every data file decrypts under one of keys
+// and matches the manifest.
+func (s *Store) verifyData(ctx context.Context, r *VerifyReport, keys map[uint8]bool) error {
+	files, err := s.listDataFiles()
+	if err != nil {
+		return fmt.Errorf("failed to list data files: %w", err)
+	}
+	m, err := s.readManifest()
+	if err != nil {
+		r.add(ProblemIntegrity, s.manifestFile, err)
+	}
+
+	seen := make(map[string]bool)
+	rotating := false
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		seen[s.relPath(file)] = true
+		encryptedData, err := os.ReadFile(file)
+		if err != nil {
+			r.add(ProblemDataFile, file, err)
+			continue
+		}
+		if len(encryptedData) < 1 || !keys[encryptedData[0]] {
+			r.add(ProblemDataFile, file, fmt.Errorf("encrypted with a missing key"))
+			continue
+		}
+		data, err := s.decryptData(encryptedData)
+		if err != nil {
+			r.add(ProblemDataFile, file, err)
+			continue
+		}
+		Wipe(data)
+		if encryptedData[0] != s.keyIndex() {
+			rotating = true
+		}
+		if m != nil {
+			if err := s.checkManifestEntry(m, file, encryptedData); err != nil {
+				r.add(ProblemIntegrity, file, err)
+			}
+		}
+	}
+	if m != nil {
+		for rel := range m.entries {
+			if !seen[rel] {
+				r.add(ProblemIntegrity, filepath.Join(s.dir, rel),
+					fmt.Errorf("secret %s deleted: %w", rel, ErrTampered))
+			}
+		}
+	}
+	if rotating || len(keys) > 1 {
+		r.add(ProblemRotation, s.keyDir, fmt.Errorf("key rotation not finished"))
+	}
+	return nil
+}
+
+// Repair fixes what it can of the problems Verify reports, then runs
+// Verify again and returns its report.  It always replays or discards
+// an interrupted transaction, finishes an interrupted key rotation, and
+// removes leftovers of interrupted operations, wiping old keys left by
+// Passwd.  Anything that could lose data requires opts.
+func (s *Store) Repair(ctx context.Context, opts RepairOptions) (*VerifyReport, error) {
+	if s == nil {
+		return nil, fmt.Errorf("no store")
+	}
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	if err := s.recoverJournal(); err != nil {
+		return nil, err
+	}
+
+	// Passwd moves the live keys directory through .oldpw, so it may
+	// only be touched with the keys lock held.
+	lk, err := s.lockNB(s.lockFile)
+	if err != nil {
+		return nil, fmt.Errorf("store at %s is being modified: %w", s.dir, err)
+	}
+	oldDir := filepath.Join(s.dir, oldPwDirName)
+	if _, err := os.Stat(oldDir); err == nil {
+		if opts.RestoreOldPassword {
+			err := s.restoreOldPassword(oldDir)
+			lk.unlock()
+			if err != nil {
+				return nil, err
+			}
+			r, err := s.Verify(ctx)
+			if errors.Is(err, ErrReauthRequired) {
+				// This Store saw its keys replaced, and can no longer
+				// look at them until it is re-opened.
+				return &VerifyReport{}, nil
+			}
+			return r, err
+		}
+		zeroOldKeys(oldDir)
+	}
+	_ = os.RemoveAll(filepath.Join(s.dir, newPwDirName))
+	_ = os.Remove(s.manifestFile + ".tmp")
+	lk.unlock()
+
+	if opts.FixPermissions {
+		s.fixPermissions()
+	}
+	if opts.RemoveUndecryptable || opts.RebuildManifest {
+		if err := s.repairData(opts); err != nil {
+			return nil, err
+		}
+	}
+
+	// Finish any rotation synchronously; this also removes unused keys
+	// and the temporary directory.
+	s.updateFiles(0)
+	_ = os.RemoveAll(s.tempDir)
+
+	return s.Verify(ctx)
+}
+
+// restoreOldPassword swaps the key directory left behind by Passwd back
+// into place.  The current key directory is kept as .newpw until the
+// swap succeeds.  The caller must hold the keys lock.
+func (s *Store) restoreOldPassword(oldDir string) error {
+	newDir := filepath.Join(s.dir, newPwDirName)
+	_ = os.RemoveAll(newDir)
+	if err := os.Rename(s.keyDir, newDir); err != nil {
+		return fmt.Errorf("failed to move keys dir aside: %w", err)
+	}
+	if err := os.Rename(oldDir, s.keyDir); err != nil {
+		_ = os.Rename(newDir, s.keyDir)
+		return fmt.Errorf("failed to restore old keys dir: %w", err)
+	}
+	zeroOldKeys(newDir)
+	return nil
+}
+
+// fixPermissions removes write access for others everywhere in the
+// store and all access for others in the keys directory.
+func (s *Store) fixPermissions() {
+	_ = filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		mode := info.Mode().Perm()
+		newMode := mode &^ 0002
+		if strings.HasPrefix(path, s.keyDir) {
+			newMode &^= 0007
+		}
+		if newMode != mode {
+			_ = os.Chmod(path, newMode)
+		}
+		return nil
+	})
+}
+
+// repairData removes undecryptable data files and rebuilds the
+// manifest from the remaining ones, as selected by opts.
+func (s *Store) repairData(opts RepairOptions) error {
+	lk, err := s.lock(s.txLockFile)
+	if err != nil {
+		return fmt.Errorf("error locking %s: %w", s.txLockFile, err)
+	}
+	defer lk.unlock()
+
+	files, err := s.listDataFiles()
+	if err != nil {
+		return fmt.Errorf("failed to list data files: %w", err)
+	}
+	m, err := s.readManifest()
+	if err != nil {
+		if !opts.RebuildManifest {
+			return err
+		}
+		m = &manifest{generation: s.generation(), entries: make(map[string]manifestEntry)}
+		m.throttled = s.throttleSigned()
+	}
+
+	for _, file := range files {
+		encryptedData, err := os.ReadFile(file)
+		if err == nil {
+			var data []byte
+			data, err = s.decryptData(encryptedData)
+			Wipe(data)
+		}
+		if err != nil {
+			if opts.RemoveUndecryptable && errors.Is(err, errUndecryptable) {
+				_ = os.Remove(file)
+				delete(m.entries, s.relPath(file))
+			}
+			continue
+		}
+		if opts.RebuildManifest && s.checkManifestEntry(m, file, encryptedData) != nil {
+			m.rewrite(s.relPath(file), encryptedData)
+		}
+	}
+	if opts.RebuildManifest {
+		for rel := range m.entries {
+			if _, err := os.Stat(filepath.Join(s.dir, rel)); os.IsNotExist(err) {
+				delete(m.entries, rel)
+			}
+		}
+	}
+	return s.writeManifest(m)
+}
@@ -0,0 +1,194 @@
+package darkstore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func hasProblem(r *VerifyReport, kind ProblemKind) bool {
+	for _, p := range r.Problems {
+		if p.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func TestStore_Verify(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	dir := filepath.Join(testStoreDir, "verify_test")
+	defer os.RemoveAll(dir) //nolint: errcheck
+
+	store, err := NewStore(dir, testPassword)
+	assert.NoError(err)
+	defer store.Close()
+	assert.NoError(store.Save("a", []byte("alpha")))
+	assert.NoError(store.Save("b/c", []byte("charlie")))
+
+	// Test case 1: Healthy store
+	t.Run("Healthy", func(t *testing.T) {
+		r, err := store.Verify(ctx)
+		assert.NoError(err)
+		assert.True(r.OK(), "unexpected problems: %v", r.Err())
+		assert.NoError(r.Err())
+	})
+
+	// Test case 2: Leftovers and bad permissions
+	t.Run("Stray and permissions", func(t *testing.T) {
+		assert.NoError(os.MkdirAll(filepath.Join(dir, newPwDirName), 0700))
+		assert.NoError(os.MkdirAll(store.tempDir, 0700))
+		assert.NoError(os.Chmod(filepath.Join(store.keyDir, "key0"), 0666))
+
+		r, err := store.Verify(ctx)
+		assert.NoError(err)
+		assert.True(hasProblem(r, ProblemStray))
+		assert.True(hasProblem(r, ProblemPermissions))
+
+		r, err = store.Repair(ctx, RepairOptions{FixPermissions: true})
+		assert.NoError(err)
+		assert.True(r.OK(), "unexpected problems: %v", r.Err())
+	})
+
+	// Test case 3: Undecryptable and untracked data
+	t.Run("Bad data", func(t *testing.T) {
+		bad := filepath.Join(dir, "garbage")
+		assert.NoError(os.WriteFile(bad, []byte{0, 1, 2, 3}, 0600))
+
+		r, err := store.Verify(ctx)
+		assert.NoError(err)
+		assert.True(hasProblem(r, ProblemDataFile))
+
+		r, err = store.Repair(ctx, RepairOptions{})
+		assert.NoError(err)
+		assert.True(hasProblem(r, ProblemDataFile), "not removed without consent")
+
+		r, err = store.Repair(ctx, RepairOptions{RemoveUndecryptable: true})
+		assert.NoError(err)
+		assert.True(r.OK(), "unexpected problems: %v", r.Err())
+		_, err = os.Stat(bad)
+		assert.True(os.IsNotExist(err))
+	})
+
+	// Test case 4: Manifest out of date after a crash
+	t.Run("Rebuild manifest", func(t *testing.T) {
+		encryptedData, err := store.encryptData([]byte("alpha v2"))
+		assert.NoError(err)
+		assert.NoError(os.WriteFile(filepath.Join(dir, "a"), encryptedData, 0600))
+
+		r, err := store.Verify(ctx)
+		assert.NoError(err)
+		assert.True(hasProblem(r, ProblemIntegrity))
+
+		r, err = store.Repair(ctx, RepairOptions{RebuildManifest: true})
+		assert.NoError(err)
+		assert.True(r.OK(), "unexpected problems: %v", r.Err())
+		data, err := store.Load("a")
+		assert.NoError(err)
+		assert.Equal([]byte("alpha v2"), data)
+	})
+
+	// Test case 5: Unfinished rotation
+	t.Run("Rotation", func(t *testing.T) {
+		newKey, err := store.newKey(1)
+		assert.NoError(err)
+		store.setCurrentKey(newKey, 1)
+		assert.NoError(store.saveCurrentKeyIndex())
+
+		r, err := store.Verify(ctx)
+		assert.NoError(err)
+		assert.True(hasProblem(r, ProblemRotation))
+
+		r, err = store.Repair(ctx, RepairOptions{})
+		assert.NoError(err)
+		assert.True(r.OK(), "unexpected problems: %v", r.Err())
+		_, err = os.Stat(filepath.Join(store.keyDir, "key0"))
+		assert.True(os.IsNotExist(err))
+		data, err := store.Load("b/c")
+		assert.NoError(err)
+		assert.Equal([]byte("charlie"), data)
+	})
+
+	// Test case 6: Cancelled context
+	t.Run("Cancelled", func(t *testing.T) {
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err := store.Verify(cctx)
+		assert.ErrorIs(err, context.Canceled)
+	})
+}
+
+func TestStore_RepairOldPassword(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	dir := filepath.Join(testStoreDir, "repair_oldpw_test")
+	defer os.RemoveAll(dir) //nolint: errcheck
+
+	store, err := NewStore(dir, testPassword)
+	assert.NoError(err)
+	assert.NoError(store.Save("a", []byte("alpha")))
+	store.Close()
+
+	// Simulate Passwd dying after the swap but before the old keys
+	// directory was removed.
+	backup := filepath.Join(testStoreDir, "repair_oldpw_backup")
+	defer os.RemoveAll(backup) //nolint: errcheck
+	assert.NoError(copyDir(filepath.Join(dir, keyDirName), backup))
+	store, err = NewStore(dir, testPassword)
+	assert.NoError(err)
+	assert.NoError(store.Passwd([]byte("new-password")))
+	oldDir := filepath.Join(dir, oldPwDirName)
+	assert.NoError(os.Rename(backup, oldDir))
+
+	r, err := store.Verify(ctx)
+	assert.NoError(err)
+	assert.True(hasProblem(r, ProblemStray))
+
+	// While another Passwd holds the keys lock, .oldpw is left alone.
+	lk, err := store.lock(store.lockFile)
+	assert.NoError(err)
+	_, err = store.Repair(ctx, RepairOptions{})
+	assert.Error(err)
+	lk.unlock()
+	key0, err := os.ReadFile(filepath.Join(oldDir, "key0"))
+	assert.NoError(err)
+	assert.NotEqual(make([]byte, len(key0)), key0)
+
+	r, err = store.Repair(ctx, RepairOptions{RestoreOldPassword: true})
+	assert.NoError(err)
+	assert.True(r.OK(), "%v", r.Problems)
+	store.Close()
+
+	_, err = os.Stat(oldDir)
+	assert.True(os.IsNotExist(err))
+	store, err = NewStore(dir, testPassword)
+	assert.NoError(err)
+	defer store.Close()
+	data, err := store.Load("a")
+	assert.NoError(err)
+	assert.Equal([]byte("alpha"), data)
+}
+
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, info.Mode().Perm())
+	})
+}
@@ -0,0 +1,310 @@
+package darkstore
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchOptions are the settings of the key watcher.  They are options
+// so that tests can shorten them and make fsnotify fail.
+type watchOptions struct {
+	newWatcher   func() (*fsnotify.Watcher, error)
+	pollInterval time.Duration // How often to poll without a watch.
+	minBackoff   time.Duration // First wait before rebuilding a watch.
+	maxBackoff   time.Duration // Longest wait before rebuilding a watch.
+}
+
+// defaultWatchOptions returns the key watcher's usual settings.
+func defaultWatchOptions() watchOptions {
+	return watchOptions{
+		newWatcher:   fsnotify.NewWatcher,
+		pollInterval: 2 * time.Second,
+		minBackoff:   time.Second,
+		maxBackoff:   60 * time.Second,
+	}
+}
+
+// Health describes the state of the goroutine that watches for key
+// changes made by other processes.
+type Health struct {
+	Running       bool      // The watcher goroutine is running.
+	Watching      bool      // fsnotify watches are in place.
+	Polling       bool      // Watching failed; currentkey is polled instead.
+	Restarts      int       // Times the fsnotify watcher was rebuilt.
+	LastError     error     // Last error from watching or reloading keys.
+	LastErrorTime time.Time // When LastError happened.
+	Locked        bool      // The store returns ErrReauthRequired.
+}
+
+// keyFileState is what polling compares to see that the keys changed.
+type keyFileState struct {
+	dirDev, dirIno uint64    // The keys directory, replaced by Passwd.
+	curModTime     time.Time // currentkey, written by Rotate.
+	curSize        int64
+	throttleMod    time.Time // throttle, written by every unlock attempt.
+	throttleSize   int64
+}
+
+// Health returns the state of the store's key watcher.
+func (s *Store) Health() Health {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	h := s.health
+	h.Locked = s.reauth.Load()
+	return h
+}
+
+// setHealth updates the watcher's health under its lock.
+func (s *Store) setHealth(fn func(h *Health)) {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	fn(&s.health)
+}
+
+// watchError records err in the watcher's health.
+func (s *Store) watchError(err error) {
+	s.debug("watch error: %s", err.Error())
+	s.setHealth(func(h *Health) {
+		h.LastError = err
+		h.LastErrorTime = time.Now()
+	})
+}
+
+// startRotateWatch starts the goroutine that watches for key rotations
+// and keys directory replacements done by other processes.
+func (s *Store) startRotateWatch() {
+	if st, ok := s.statKeyFiles(); ok {
+		s.keyState = st
+	}
+	if t, err := s.readThrottle(); err == nil && t != nil {
+		s.seenFailures = t.failures
+	}
+	s.setHealth(func(h *Health) { h.Running = true })
+	s.goBackground(s.rotateWatch)
+}
+
+// rotateWatch is the goroutine that watches the keys directory to see
+// if any other process has done a key rotation, and the store directory
+// to see if the keys directory was replaced by Passwd or the like.  If
+// the watch cannot be set up or breaks, it is rebuilt with a growing
+// backoff, and currentkey is polled in the meantime.
+func (s *Store) rotateWatch() {
+	defer s.setHealth(func(h *Health) {
+		h.Running = false
+		h.Watching = false
+		h.Polling = false
+	})
+
+	wo := s.opts.watch
+	backoff := wo.minBackoff
+	for restarts := 0; ; restarts++ {
+		w, err := s.addWatches()
+		if err != nil {
+			s.watchError(err)
+			s.setHealth(func(h *Health) {
+				h.Watching = false
+				h.Polling = true
+			})
+			if !s.pollFor(backoff) {
+				return
+			}
+			backoff = min(backoff*2, wo.maxBackoff)
+			continue
+		}
+		backoff = wo.minBackoff
+		s.setHealth(func(h *Health) {
+			h.Watching = true
+			h.Polling = false
+			h.Restarts = restarts
+		})
+		// Catch anything that changed while nothing was watching.
+		s.checkKeyFiles(false)
+		s.syncInbox()
+		stopped := s.watchEvents(w)
+		_ = w.Close()
+		if stopped {
+			return
+		}
+	}
+}
+
+// addWatches returns a watcher on the store and keys directories, and
+// on the inbox if there is one.
+func (s *Store) addWatches() (*fsnotify.Watcher, error) {
+	w, err := s.opts.watch.newWatcher()
+	if err != nil {
+		// Release the inotify instance of a watcher that failed late.
+		if w != nil {
+			_ = w.Close()
+		}
+		return nil, err
+	}
+	for _, dir := range []string{s.dir, s.keyDir} {
+		if err = w.Add(dir); err != nil {
+			_ = w.Close()
+			return nil, err
+		}
+	}
+	// The inbox is only made by the first write-only save.
+	_ = w.Add(s.inboxDir())
+	return w, nil
+}
+
+// watchEvents handles events from w until the store is closed, when it
+// returns true, or until w breaks, when it returns false.
+func (s *Store) watchEvents(w *fsnotify.Watcher) bool {
+	for {
+		select {
+		case <-s.stopChan:
+			return true
+		case event, ok := <-w.Events:
+			if !ok {
+				return false
+			}
+			switch {
+			case event.Has(fsnotify.Write) && event.Name == s.curKeyIdxFile:
+				s.checkKeyFiles(true)
+			case event.Name == s.throttleFile():
+				s.checkKeyFiles(false)
+			case event.Has(fsnotify.Create) && event.Name == s.keyDir:
+				// The watch went away with the old keys directory.
+				_ = w.Remove(s.keyDir)
+				if err := w.Add(s.keyDir); err != nil {
+					s.watchError(err)
+					return false
+				}
+				_ = w.Add(s.inboxDir())
+				s.checkKeyFiles(false)
+				s.syncInbox()
+			case event.Has(fsnotify.Create) && event.Name == s.inboxDir():
+				_ = w.Add(s.inboxDir())
+				s.syncInbox()
+			case event.Has(fsnotify.Create) && filepath.Dir(event.Name) == s.inboxDir() &&
+				!strings.HasPrefix(filepath.Base(event.Name), "."):
+				s.syncInbox()
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return false
+			}
+			if err == nil {
+				continue
+			}
+			// Replacing the keys directory makes the old watch fail.
+			// Re-add it in case it is gone for another reason, and
+			// rebuild the watcher if that does not work.
+			s.watchError(err)
+			_ = w.Remove(s.keyDir)
+			if err := w.Add(s.keyDir); err != nil {
+				s.watchError(err)
+				return false
+			}
+		}
+	}
+}
+
+// pollFor checks the key files and the inbox every poll interval for
+// d.  It returns false if the store was closed.
+func (s *Store) pollFor(d time.Duration) bool {
+	ticker := time.NewTicker(min(s.opts.watch.pollInterval, d))
+	defer ticker.Stop()
+	deadline := time.Now().Add(d)
+	for {
+		select {
+		case <-s.stopChan:
+			return false
+		case <-ticker.C:
+			s.checkKeyFiles(false)
+			s.syncInbox()
+			if !time.Now().Before(deadline) {
+				return true
+			}
+		}
+	}
+}
+
+// statKeyFiles returns the state of the keys directory and currentkey.
+// It returns false while either is missing, such as in the middle of
+// Passwd replacing the keys directory.
+func (s *Store) statKeyFiles() (keyFileState, bool) {
+	var st keyFileState
+	dir, err := os.Stat(s.keyDir)
+	if err != nil {
+		return st, false
+	}
+	if sys, ok := dir.Sys().(*syscall.Stat_t); ok {
+		st.dirDev, st.dirIno = uint64(sys.Dev), sys.Ino //nolint: unconvert
+	}
+	cur, err := os.Stat(s.curKeyIdxFile)
+	if err != nil {
+		return st, false
+	}
+	st.curModTime, st.curSize = cur.ModTime(), cur.Size()
+	if t, err := os.Stat(s.throttleFile()); err == nil {
+		st.throttleMod, st.throttleSize = t.ModTime(), t.Size()
+	}
+	return st, true
+}
+
+// checkKeyFiles reloads the current key if the keys directory or
+// currentkey changed since it was last looked at, or if force is set,
+// and emits events for what changed.
+func (s *Store) checkKeyFiles(force bool) {
+	st, ok := s.statKeyFiles()
+	if !ok {
+		return
+	}
+	old := s.keyState
+	s.keyState = st
+	if st.throttleMod != old.throttleMod || st.throttleSize != old.throttleSize {
+		s.checkFailedUnlocks()
+	}
+	replaced := st.dirDev != old.dirDev || st.dirIno != old.dirIno
+	if replaced {
+		s.emit(PasswordChanged)
+	}
+	if !force && !replaced && st.curModTime == old.curModTime && st.curSize == old.curSize {
+		return
+	}
+	if s.reloadCurrentKey() {
+		s.emit(Rotated)
+	}
+}
+
+// reloadCurrentKey loads the current key after it may have changed on
+// disk, and reports whether its index changed.  If the keys can no
+// longer be read, the store is locked until it is reopened.
+func (s *Store) reloadCurrentKey() bool {
+	if s.reauth.Load() || s.isLocked() {
+		return false // Unlock reloads the keys.
+	}
+	lk, err := s.rLock(s.lockFile)
+	if err != nil {
+		s.watchError(err)
+		return false
+	}
+	defer lk.unlock()
+
+	oldIndex := s.keyIndex()
+	err = s.checkKeyWrapper()
+	if err == nil {
+		err = s.loadCurrentKey()
+	}
+	if err != nil && (s.isLocked() || s.stopping()) {
+		// The idle lock or Close wiped the keys while they were loading.
+		return false
+	} else if err != nil {
+		s.setHealth(func(h *Health) {
+			h.LastError = err
+			h.LastErrorTime = time.Now()
+		})
+		s.requireReauth(err)
+		return false
+	}
+	return s.keyIndex() != oldIndex
+}
@@ -0,0 +1,114 @@
+package darkstore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+)
+
+// withWatcher shortens the watcher's timings and has it create its
+// fsnotify watchers with newWatcher.
+func withWatcher(newWatcher func() (*fsnotify.Watcher, error)) Option {
+	return func(o *options) {
+		o.watch = watchOptions{
+			newWatcher:   newWatcher,
+			pollInterval: 10 * time.Millisecond,
+			minBackoff:   20 * time.Millisecond,
+			maxBackoff:   50 * time.Millisecond,
+		}
+	}
+}
+
+func TestStore_Health(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := filepath.Join(testStoreDir, "health")
+	defer os.RemoveAll(dir) //nolint: errcheck
+
+	// Test case 1: A store with working watches
+	t.Run("Watching", func(t *testing.T) {
+		store, err := NewStore(dir, testPassword)
+		assert.NoError(err)
+		assert.Eventually(func() bool { return store.Health().Watching },
+			5*time.Second, 10*time.Millisecond)
+		h := store.Health()
+		assert.True(h.Running)
+		assert.False(h.Polling)
+		assert.False(h.Locked)
+
+		store.Close()
+		h = store.Health()
+		assert.False(h.Running, "Close waits for the watcher")
+		assert.False(h.Watching)
+		store.Close()
+	})
+
+	// Test case 2: Polling finds a rotation when fsnotify fails
+	t.Run("Polling", func(t *testing.T) {
+		watchErr := errors.New("fake watch failure")
+		failing := withWatcher(func() (*fsnotify.Watcher, error) { return nil, watchErr })
+		other, err := NewStore(dir, testPassword)
+		assert.NoError(err)
+		defer other.Close()
+		store, err := NewStore(dir, testPassword, failing)
+		assert.NoError(err)
+		defer store.Close()
+
+		assert.Eventually(func() bool { return store.Health().Polling },
+			5*time.Second, 10*time.Millisecond)
+		h := store.Health()
+		assert.False(h.Watching)
+		assert.True(errors.Is(h.LastError, watchErr))
+		assert.False(h.LastErrorTime.IsZero())
+
+		assert.NoError(other.Rotate())
+		assert.Equal(Rotated, waitForEvent(store))
+		assert.Equal(other.keyIndex(), store.keyIndex())
+		waitForRotation(t, other)
+	})
+
+	// Test case 3: The watch is rebuilt once fsnotify works again
+	t.Run("Recover", func(t *testing.T) {
+		var failures atomic.Int32
+		store, err := NewStore(dir, testPassword, withWatcher(func() (*fsnotify.Watcher, error) {
+			if failures.Add(1) <= 3 {
+				return nil, errors.New("fake watch failure")
+			}
+			return fsnotify.NewWatcher()
+		}))
+		assert.NoError(err)
+		defer store.Close()
+
+		assert.Eventually(func() bool { return store.Health().Watching },
+			5*time.Second, 10*time.Millisecond)
+		h := store.Health()
+		assert.False(h.Polling)
+		assert.Equal(3, h.Restarts)
+		assert.Error(h.LastError)
+	})
+
+	// Test case 4: The watch survives the keys directory being replaced
+	t.Run("Passwd", func(t *testing.T) {
+		other, err := NewStore(dir, testPassword)
+		assert.NoError(err)
+		defer other.Close()
+		store, err := NewStore(dir, testPassword)
+		assert.NoError(err)
+		defer store.Close()
+
+		assert.NoError(other.Passwd([]byte("new password")))
+		assert.Equal(PasswordChanged, waitForEvent(store))
+		assert.NoError(other.Rotate())
+		assert.Equal(Rotated, waitForEvent(store, PasswordChanged))
+		assert.Eventually(func() bool { return store.Health().Watching },
+			5*time.Second, 10*time.Millisecond)
+		assert.False(store.Health().Locked)
+		waitForRotation(t, other)
+	})
+}
@@ -5,8 +5,9 @@ import (
 	"runtime"
 )
 
-// Wipe securely zeros out sensitive data in memory
-// This is required for FIPS-140 and Common Criteria compliance
+// Wipe securely zeros out sensitive data in memory, as FIPS 140-3
+// requires of keys once they are no longer needed.  See WithFIPS for
+// the algorithms a FIPS store is limited to.
 func Wipe(data []byte) {
 	if len(data) == 0 {
 		return
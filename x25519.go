@@ -0,0 +1,527 @@
+package darkstore
+
+import (
+	"bytes"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	x25519KeyLen     = curve25519.ScalarSize
+	x25519PublicTag  = "darkstore-x25519:"
+	x25519PrivateTag = "DARKSTORE-X25519-SECRET:"
+	x25519SlotInfo   = "darkstore x25519 slot v1"
+	inboxInfo        = "darkstore inbox v2"
+
+	writeKeyFile   = "writekey"
+	inboxDirName   = "inbox"
+	inboxLockFile  = ".inboxlock"
+	maxInboxSecret = 64 * 1024 * 1024
+)
+
+// ErrWriteOnly is returned by operations that need to read a store
+// that was opened with OpenWriteOnly.
+var ErrWriteOnly = errors.New("store is write-only")
+
+// GenerateIdentity generates an X25519 key pair.  The public key can be
+// given to AddRecipient, and the private key to Identity.  The private
+// key is returned in a printable form; keep it as carefully as a
+// password and Wipe it when done.
+func GenerateIdentity() (string, []byte, error) {
+	priv := make([]byte, x25519KeyLen)
+	defer Wipe(priv)
+	if _, err := rand.Read(priv); err != nil {
+		return "", nil, fmt.Errorf("failed to generate private key: %w", err)
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return "", nil, err
+	}
+	encoded := make([]byte, len(x25519PrivateTag)+hex.EncodedLen(len(priv)))
+	copy(encoded, x25519PrivateTag)
+	hex.Encode(encoded[len(x25519PrivateTag):], priv)
+	return formatPublicKey(pub), encoded, nil
+}
+
+// formatPublicKey returns the printable form of an X25519 public key.
+func formatPublicKey(pub []byte) string {
+	return x25519PublicTag + hex.EncodeToString(pub)
+}
+
+// parsePublicKey decodes a public key from GenerateIdentity or WriteKey.
+func parsePublicKey(publicKey string) ([]byte, error) {
+	text := strings.TrimSpace(publicKey)
+	if !strings.HasPrefix(text, x25519PublicTag) {
+		return nil, fmt.Errorf("not a darkstore X25519 public key")
+	}
+	pub, err := hex.DecodeString(text[len(x25519PublicTag):])
+	if err != nil || len(pub) != x25519KeyLen {
+		return nil, fmt.Errorf("X25519 public key is malformed")
+	}
+	return pub, nil
+}
+
+// parsePrivateKey decodes a private key from GenerateIdentity.
+func parsePrivateKey(privateKey []byte) ([]byte, error) {
+	text := bytes.TrimSpace(privateKey)
+	if !bytes.HasPrefix(text, []byte(x25519PrivateTag)) {
+		return nil, fmt.Errorf("not a darkstore X25519 private key")
+	}
+	text = text[len(x25519PrivateTag):]
+	if hex.DecodedLen(len(text)) != x25519KeyLen {
+		return nil, fmt.Errorf("X25519 private key is malformed")
+	}
+	priv := make([]byte, x25519KeyLen)
+	if _, err := hex.Decode(priv, text); err != nil {
+		Wipe(priv)
+		return nil, fmt.Errorf("X25519 private key is malformed")
+	}
+	return priv, nil
+}
+
+// sealTo encrypts plaintext so that only the holder of the private key
+// for pub can read it.  An ephemeral key pair is generated, the shared
+// secret is run through HKDF-SHA256 with both public keys as salt, and
+// the result keys ChaCha20-Poly1305.  Each key is used exactly once, so
+// the nonce is zero.  The output is the ephemeral public key followed
+// by the ciphertext.
+func sealTo(pub, plaintext []byte, info string) ([]byte, error) {
+	eph := make([]byte, x25519KeyLen)
+	defer Wipe(eph)
+	if _, err := rand.Read(eph); err != nil {
+		return nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+	ephPub, err := curve25519.X25519(eph, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(eph, pub)
+	if err != nil {
+		return nil, fmt.Errorf("invalid X25519 public key: %w", err)
+	}
+	defer Wipe(shared)
+	key, err := hkdf.Key(sha256.New, shared, append(append([]byte{}, ephPub...), pub...),
+		info, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(key)
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	return aead.Seal(ephPub, nonce, plaintext, nil), nil
+}
+
+// openFrom decrypts the output of sealTo with the private key priv.
+func openFrom(priv, sealed []byte, info string) ([]byte, error) {
+	if len(sealed) < x25519KeyLen+chacha20poly1305.Overhead {
+		return nil, fmt.Errorf("sealed data is too short")
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	ephPub := sealed[:x25519KeyLen]
+	shared, err := curve25519.X25519(priv, ephPub)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ephemeral key: %w", err)
+	}
+	defer Wipe(shared)
+	key, err := hkdf.Key(sha256.New, shared, append(append([]byte{}, ephPub...), pub...),
+		info, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(key)
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	plaintext, err := aead.Open(nil, nonce, sealed[x25519KeyLen:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	return plaintext, nil
+}
+
+// AddRecipient adds a key slot called name that wraps the master key to
+// an X25519 public key from GenerateIdentity, so the holder of the
+// private key can open the store with Identity.
+func (s *Store) AddRecipient(name string, publicKey string) error {
+	if s == nil {
+		return fmt.Errorf("no store")
+	}
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	if err := s.checkApproved("X25519 recipients"); err != nil {
+		return err
+	}
+	if err := s.checkMaster(); err != nil {
+		return err
+	}
+	masterBuf := s.master()
+	defer masterBuf.Destroy()
+	master := masterBuf.Bytes()
+	pub, err := parsePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	wrapped, err := sealTo(pub, master, x25519SlotInfo)
+	if err != nil {
+		return err
+	}
+	return s.addSlot(&keySlot{name: name, kind: slotTypeX25519, kdf: kdfX25519, salt: pub, wrapped: wrapped})
+}
+
+// identityUnlocker unlocks X25519 recipient slots.
+type identityUnlocker struct {
+	source Source
+}
+
+// Identity returns an Unlocker that opens the store with an X25519
+// private key from GenerateIdentity, using the slot added for its
+// public key with AddRecipient.
+func Identity(privateKey []byte) Unlocker {
+	return &identityUnlocker{source: func() ([]byte, error) {
+		return append([]byte{}, privateKey...), nil
+	}}
+}
+
+// IdentityFrom returns an Unlocker that reads an X25519 private key
+// from src, such as FromFile, and opens the store with it.
+func IdentityFrom(src Source) Unlocker {
+	return &identityUnlocker{source: src}
+}
+
+func (u *identityUnlocker) unlockStore(s *Store) error {
+	encoded, err := u.source()
+	if err != nil {
+		return err
+	}
+	priv, err := parsePrivateKey(encoded)
+	Wipe(encoded)
+	if err != nil {
+		return err
+	}
+	defer Wipe(priv)
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return err
+	}
+
+	slots, err := s.readSlots()
+	if err != nil {
+		return err
+	}
+	for _, ks := range slots {
+		if ks.kind != slotTypeX25519 || !bytes.Equal(ks.salt, pub) {
+			continue
+		}
+		masterKey, err := openFrom(priv, ks.wrapped, x25519SlotInfo)
+		if err != nil {
+			continue
+		}
+		s.setMaster(masterKey, ks.name)
+		return nil
+	}
+	return ErrNoMatchingSlot
+}
+
+// WriteKey returns the public key that OpenWriteOnly encrypts secrets
+// to, creating the store's write key pair on first use.  The private
+// half is kept in the keys directory, wrapped under the master key.
+func (s *Store) WriteKey() (string, error) {
+	if s == nil {
+		return "", fmt.Errorf("no store")
+	}
+	if err := s.checkOpen(); err != nil {
+		return "", err
+	}
+	if err := s.checkApproved("X25519 write keys"); err != nil {
+		return "", err
+	}
+	if err := s.checkMaster(); err != nil {
+		return "", err
+	}
+	masterBuf := s.master()
+	defer masterBuf.Destroy()
+	master := masterBuf.Bytes()
+	lk, err := s.lock(s.lockFile)
+	if err != nil {
+		return "", fmt.Errorf("error locking %s: %w", s.lockFile, err)
+	}
+	defer lk.unlock()
+
+	path := filepath.Join(s.keyDir, writeKeyFile)
+	priv, err := s.loadWriteKey()
+	if errors.Is(err, os.ErrNotExist) {
+		priv = make([]byte, x25519KeyLen)
+		if _, err := rand.Read(priv); err != nil {
+			return "", fmt.Errorf("failed to generate write key: %w", err)
+		}
+		encKey, err := encryptKey(priv, master)
+		if err != nil {
+			Wipe(priv)
+			return "", err
+		}
+		if err := s.writeFile(path, encKey); err != nil {
+			Wipe(priv)
+			return "", fmt.Errorf("failed to write write key: %w", err)
+		}
+	} else if err != nil {
+		return "", fmt.Errorf("failed to load write key: %w", err)
+	}
+	defer Wipe(priv)
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return "", err
+	}
+	return formatPublicKey(pub), nil
+}
+
+// loadWriteKey returns the private half of the store's write key, which
+// is wrapped under the master key.
+func (s *Store) loadWriteKey() ([]byte, error) {
+	data, err := s.readFile(filepath.Join(s.keyDir, writeKeyFile))
+	if err != nil {
+		return nil, err
+	}
+	masterBuf := s.master()
+	defer masterBuf.Destroy()
+	master := masterBuf.Bytes()
+	return decryptKey(data, master)
+}
+
+// OpenWriteOnly opens the store at dirpath for writing only.  Save
+// encrypts each secret to writeKey, the public key from WriteKey, and
+// leaves it in the store's inbox; no credential is needed and the
+// master key is never held, so nothing in the store can be read.  The
+// next time a store holding the master key is opened, or sees the
+// inbox change while open, it moves the inbox into the store.  Every
+// other method returns ErrWriteOnly.
+//
+// Anyone who can write to the store's directory can add to the inbox,
+// so secrets written this way are only as trustworthy as the machines
+// allowed to write them.  Each entry carries the time it was sealed,
+// and the manifest records the newest one taken in, so an old entry
+// put back in the inbox is discarded rather than rolling a secret
+// back.  Write-only stores on different machines therefore need
+// roughly synchronized clocks.
+func OpenWriteOnly(dirpath string, writeKey string, opts ...Option) (*Store, error) {
+	pub, err := parsePublicKey(writeKey)
+	if err != nil {
+		return nil, err
+	}
+	store, err := newStoreHandle(dirpath, opts...)
+	if err != nil {
+		return nil, err
+	}
+	isNewStore, err := store.checkNewStore()
+	if err != nil {
+		return nil, err
+	}
+	if isNewStore {
+		return nil, fmt.Errorf("no store at %s", store.dir)
+	}
+	if store.fips, err = store.isFIPSStore(); err != nil {
+		return nil, err
+	}
+	if store.fips || store.opts.fipsRequested() {
+		return nil, fmt.Errorf("X25519 write keys: %w", ErrNotApproved)
+	}
+	stat, err := os.Stat(store.dir)
+	if err != nil {
+		return nil, err
+	}
+	store.dirPerm = stat.Mode() & os.ModePerm
+	store.filePerm = store.dirPerm & 0666
+	store.writeOnly = pub
+	if err = store.harden(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// saveSealed encrypts the time, path and data to the write key and adds
+// them to the inbox.  Entries are named by time so they are applied in
+// order.
+func (s *Store) saveSealed(path string, data []byte) error {
+	fullPath, err := s.secretPath(path)
+	if err != nil {
+		return err
+	}
+	rel := s.relPath(fullPath)
+	now := time.Now()
+	plaintext := binary.BigEndian.AppendUint64(nil, uint64(now.UnixNano()))
+	plaintext = binary.BigEndian.AppendUint16(plaintext, uint16(len(rel)))
+	plaintext = append(plaintext, rel...)
+	plaintext = append(plaintext, data...)
+	defer Wipe(plaintext)
+	sealed, err := sealTo(s.writeOnly, plaintext, inboxInfo)
+	if err != nil {
+		return err
+	}
+
+	inbox := s.inboxDir()
+	if err := os.MkdirAll(inbox, s.dirPerm); err != nil {
+		return fmt.Errorf("failed to create inbox: %w", err)
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%020d-%x", now.UnixNano(), suffix)
+	tmp := filepath.Join(inbox, "."+name)
+	if err := s.syncWrite(tmp, sealed); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to write to inbox: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(inbox, name)); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to write to inbox: %w", err)
+	}
+	return nil
+}
+
+// inboxDir returns the directory write-only stores save to.
+func (s *Store) inboxDir() string {
+	return filepath.Join(s.keyDir, inboxDirName)
+}
+
+// syncInbox takes in the inbox if the store can save, for the watcher.
+func (s *Store) syncInbox() {
+	if s.checkOpen() != nil {
+		return
+	}
+	if err := s.ingestInbox(); err != nil {
+		s.debug("failed to empty inbox: %v", err)
+	}
+}
+
+// errBadInboxEntry is wrapped by the errors of ingestEntry for entries
+// that can never be saved, such as ones sealed to another key.
+var errBadInboxEntry = errors.New("bad inbox entry")
+
+// ingestInbox saves every secret left in the inbox by write-only
+// stores and removes it from the inbox.  Entries that cannot be
+// decrypted are discarded.  If a secret cannot be saved, it and the
+// entries after it are left for the next try and the error returned.
+// If another process is already emptying the inbox, it returns at once.
+func (s *Store) ingestInbox() error {
+	inbox := s.inboxDir()
+	entries, err := os.ReadDir(inbox)
+	if err != nil || len(entries) == 0 {
+		return nil
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, entry.Name())
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+
+	lk, err := s.lockNB(filepath.Join(inbox, inboxLockFile))
+	if err != nil {
+		return nil
+	}
+	defer lk.unlock()
+
+	priv, err := s.loadWriteKey()
+	if err != nil {
+		return fmt.Errorf("failed to load write key: %w", err)
+	}
+	defer Wipe(priv)
+
+	for _, name := range names {
+		path := filepath.Join(inbox, name)
+		sealed, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue // Already ingested by another process.
+		} else if err != nil {
+			return fmt.Errorf("failed to read inbox: %w", err)
+		}
+		if err := s.ingestEntry(priv, sealed); errors.Is(err, errBadInboxEntry) {
+			s.debug("discarding inbox entry %s: %v", name, err)
+		} else if err != nil {
+			// The write-only client cannot send it again, so keep it.
+			return fmt.Errorf("failed to save inbox entry %s: %w", name, err)
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove inbox entry: %w", err)
+		}
+	}
+	return nil
+}
+
+// ingestEntry decrypts one inbox entry and saves its secret, unless it
+// was sealed no later than the newest entry already taken in, and so
+// may be a replay.
+func (s *Store) ingestEntry(priv, sealed []byte) error {
+	if len(sealed) > maxInboxSecret {
+		return fmt.Errorf("%w: too large", errBadInboxEntry)
+	}
+	plaintext, err := openFrom(priv, sealed, inboxInfo)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errBadInboxEntry, err)
+	}
+	defer Wipe(plaintext)
+	if len(plaintext) < 10 {
+		return fmt.Errorf("%w: malformed", errBadInboxEntry)
+	}
+	sealedAt := int64(binary.BigEndian.Uint64(plaintext))
+	n := int(binary.BigEndian.Uint16(plaintext[8:]))
+	if len(plaintext) < 10+n {
+		return fmt.Errorf("%w: malformed", errBadInboxEntry)
+	}
+	path := string(plaintext[10 : 10+n])
+	if _, err := s.secretPath(path); err != nil {
+		return fmt.Errorf("%w: %w", errBadInboxEntry, err)
+	}
+
+	lk, err := s.rLock(s.txLockFile)
+	if err != nil {
+		return fmt.Errorf("error locking %s: %w", s.txLockFile, err)
+	}
+	m, err := s.readManifest()
+	lk.unlock()
+	if err != nil {
+		return err
+	}
+	if sealedAt <= m.inboxTime {
+		return fmt.Errorf("%w: %s was sealed before the last entry taken in: %w", errBadInboxEntry, path, ErrRollback)
+	}
+	if err := s.Save(path, plaintext[10+n:]); err != nil {
+		return err
+	}
+
+	// Saving it again after a crash here is harmless.
+	lk, err = s.lock(s.txLockFile)
+	if err != nil {
+		return fmt.Errorf("error locking %s: %w", s.txLockFile, err)
+	}
+	defer lk.unlock()
+	return s.updateManifest(func(m *manifest) {
+		m.inboxTime = max(m.inboxTime, sealedAt)
+	})
+}
@@ -0,0 +1,239 @@
+package darkstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestX25519(t *testing.T) {
+	assert := assert.New(t)
+
+	// Test case 1: Seal and open
+	t.Run("Seal", func(t *testing.T) {
+		pubText, privText, err := GenerateIdentity()
+		assert.NoError(err)
+		pub, err := parsePublicKey(pubText)
+		assert.NoError(err)
+		priv, err := parsePrivateKey(privText)
+		assert.NoError(err)
+
+		sealed, err := sealTo(pub, []byte("hello"), "test")
+		assert.NoError(err)
+		opened, err := openFrom(priv, sealed, "test")
+		assert.NoError(err)
+		assert.Equal([]byte("hello"), opened)
+
+		_, err = openFrom(priv, sealed, "other")
+		assert.Error(err, "info binds the purpose")
+		sealed[len(sealed)-1] ^= 1
+		_, err = openFrom(priv, sealed, "test")
+		assert.Error(err)
+	})
+
+	// Test case 2: Key encodings
+	t.Run("Encoding", func(t *testing.T) {
+		_, err := parsePublicKey("darkstore-x25519:abcd")
+		assert.Error(err)
+		_, err = parsePublicKey("age1something")
+		assert.Error(err)
+		_, err = parsePrivateKey([]byte("DARKSTORE-X25519-SECRET:zz"))
+		assert.Error(err)
+		pub, priv, err := GenerateIdentity()
+		assert.NoError(err)
+		_, err = parsePrivateKey([]byte(pub))
+		assert.Error(err)
+		_, err = parsePublicKey(string(priv))
+		assert.Error(err)
+	})
+}
+
+func TestStore_AddRecipient(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := filepath.Join(testStoreDir, "recipient")
+	idPath := filepath.Join(testStoreDir, "recipient.id")
+	defer os.RemoveAll(dir)    //nolint: errcheck
+	defer os.RemoveAll(idPath) //nolint: errcheck
+
+	pub, priv, err := GenerateIdentity()
+	assert.NoError(err)
+	assert.NoError(os.WriteFile(idPath, priv, 0600))
+
+	store, err := NewStore(dir, testPassword)
+	assert.NoError(err)
+	assert.NoError(store.Save("secret", []byte("for alice")))
+	assert.NoError(store.AddRecipient("alice", pub))
+	assert.Error(store.AddRecipient("bob", "not a key"))
+	slots, err := store.ListKeySlots()
+	assert.NoError(err)
+	assert.Equal("recipient", slots[0].Type)
+	store.Close()
+
+	// Test case 1: The private key opens the store
+	t.Run("Identity", func(t *testing.T) {
+		for _, u := range []Unlocker{Identity(priv), IdentityFrom(FromFile(idPath))} {
+			store, err := Open(dir, u)
+			if !assert.NoError(err) {
+				continue
+			}
+			data, err := store.Load("secret")
+			assert.NoError(err)
+			assert.Equal([]byte("for alice"), data)
+			assert.Error(store.Passwd([]byte("password")), "recipient slots have no password")
+			store.Close()
+		}
+	})
+
+	// Test case 2: Other private keys do not
+	t.Run("Wrong identity", func(t *testing.T) {
+		_, other, err := GenerateIdentity()
+		assert.NoError(err)
+		_, err = Open(dir, Identity(other))
+		assert.True(errors.Is(err, ErrNoMatchingSlot), "got %v", err)
+		_, err = Open(dir, Identity([]byte("garbage")))
+		assert.Error(err)
+	})
+}
+
+func TestOpenWriteOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := filepath.Join(testStoreDir, "write_only")
+	defer os.RemoveAll(dir) //nolint: errcheck
+
+	store, err := NewStore(dir, testPassword)
+	assert.NoError(err)
+	writeKey, err := store.WriteKey()
+	assert.NoError(err)
+	again, err := store.WriteKey()
+	assert.NoError(err)
+	assert.Equal(writeKey, again, "write key is created once")
+	store.Close()
+
+	// Test case 1: A write-only store can save but not read
+	t.Run("Save", func(t *testing.T) {
+		w, err := OpenWriteOnly(dir, writeKey)
+		assert.NoError(err)
+		assert.NoError(w.Save("from/ci", []byte("deploy token")))
+		assert.NoError(w.Save("from/ci", []byte("newer token")))
+		assert.NoError(w.Save("other", []byte("other secret")))
+		assert.Error(w.Save("../escape", []byte("x")))
+
+		_, err = w.Load("from/ci")
+		assert.True(errors.Is(err, ErrWriteOnly), "got %v", err)
+		assert.True(errors.Is(w.Delete("other"), ErrWriteOnly))
+		assert.True(errors.Is(w.Rotate(), ErrWriteOnly))
+		assert.True(errors.Is(w.Passwd([]byte("password")), ErrWriteOnly))
+		assert.True(errors.Is(w.Update(func(tx *Tx) error { return nil }), ErrWriteOnly))
+		w.Close()
+
+		_, err = os.Stat(filepath.Join(dir, "from", "ci"))
+		assert.True(os.IsNotExist(err), "nothing is readable until ingested")
+	})
+
+	// Test case 2: Opening the store takes in the inbox, newest last
+	t.Run("Ingest", func(t *testing.T) {
+		store, err := NewStore(dir, testPassword)
+		assert.NoError(err)
+		defer store.Close()
+		data, err := store.Load("from/ci")
+		assert.NoError(err)
+		assert.Equal([]byte("newer token"), data)
+		data, err = store.Load("other")
+		assert.NoError(err)
+		assert.Equal([]byte("other secret"), data)
+		entries, err := os.ReadDir(filepath.Join(dir, keyDirName, inboxDirName))
+		assert.NoError(err)
+		for _, entry := range entries {
+			assert.Equal(inboxLockFile, entry.Name())
+		}
+
+		// Saves from a write-only store are taken in by the watcher.
+		w, err := OpenWriteOnly(dir, writeKey)
+		assert.NoError(err)
+		assert.NoError(w.Save("late", []byte("arrival")))
+		w.Close()
+		assert.Eventually(func() bool {
+			data, err := store.Load("late")
+			return err == nil && bytes.Equal([]byte("arrival"), data)
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	// Test case 3: Entries that fail to save are kept
+	t.Run("Save fails", func(t *testing.T) {
+		store, err := NewStore(dir, testPassword)
+		assert.NoError(err)
+		defer store.Close()
+		store.reauth.Store(true) // Save fails until the store is reopened.
+		w, err := OpenWriteOnly(dir, writeKey)
+		assert.NoError(err)
+		assert.NoError(w.Save("kept", []byte("not lost")))
+		w.Close()
+
+		assert.True(errors.Is(store.ingestInbox(), ErrReauthRequired))
+		store.reauth.Store(false)
+		assert.NoError(store.ingestInbox())
+		data, err := store.Load("kept")
+		assert.NoError(err)
+		assert.Equal([]byte("not lost"), data)
+	})
+
+	// Test case 4: Entries sealed to another key are discarded
+	t.Run("Wrong key", func(t *testing.T) {
+		pub, _, err := GenerateIdentity()
+		assert.NoError(err)
+		w, err := OpenWriteOnly(dir, pub)
+		assert.NoError(err)
+		assert.NoError(w.Save("forged", []byte("x")))
+		w.Close()
+
+		store, err := NewStore(dir, testPassword)
+		assert.NoError(err)
+		defer store.Close()
+		_, err = store.Load("forged")
+		assert.Error(err)
+
+		_, err = OpenWriteOnly(filepath.Join(testStoreDir, "write_only_none"), writeKey)
+		assert.Error(err)
+	})
+
+	// Test case 5: An old entry put back in the inbox is discarded
+	t.Run("Replay", func(t *testing.T) {
+		inbox := filepath.Join(dir, keyDirName, inboxDirName)
+		w, err := OpenWriteOnly(dir, writeKey)
+		assert.NoError(err)
+		assert.NoError(w.Save("replayed", []byte("old")))
+		entries, err := os.ReadDir(inbox)
+		assert.NoError(err)
+		var old []byte
+		for _, entry := range entries {
+			if entry.Name() != inboxLockFile {
+				old, err = os.ReadFile(filepath.Join(inbox, entry.Name()))
+				assert.NoError(err)
+			}
+		}
+		assert.NoError(w.Save("replayed", []byte("new")))
+		w.Close()
+
+		store, err := NewStore(dir, testPassword)
+		assert.NoError(err)
+		defer store.Close()
+		replay := filepath.Join(inbox, fmt.Sprintf("%020d-replay", time.Now().UnixNano()))
+		assert.NoError(os.WriteFile(replay, old, 0600))
+		assert.NoError(store.ingestInbox())
+		data, err := store.Load("replayed")
+		assert.NoError(err)
+		assert.Equal([]byte("new"), data)
+		assert.Eventually(func() bool {
+			_, err := os.Stat(replay)
+			return os.IsNotExist(err)
+		}, 5*time.Second, 10*time.Millisecond, "replayed entry is removed")
+	})
+}